@@ -14,6 +14,7 @@ import (
 	"github.com/getlantern/lantern-water/dialer"
 	waterDownloader "github.com/getlantern/lantern-water/downloader"
 	"github.com/getlantern/lantern-water/logger"
+	"github.com/getlantern/lantern-water/proxy"
 	waterVC "github.com/getlantern/lantern-water/version_control"
 
 	_ "github.com/refraction-networking/water/transport/v1"
@@ -23,8 +24,9 @@ func main() {
 	ctx := context.Background()
 	log := slog.New(slog.NewTextHandler(os.Stdout, nil))
 
-	var listenerAddr, wasmAvailableAt, transportName, hashsum string
+	var listenerAddr, wasmAvailableAt, transportName, hashsum, localProxyAddr string
 	flag.StringVar(&listenerAddr, "proxyURL", "localhost:8080", "URL of the proxy")
+	flag.StringVar(&localProxyAddr, "localProxyAddr", "", "If set, run a local SOCKS5 and HTTP CONNECT proxy at this address forwarding through WATER (the listener must run with -tunnel)")
 	flag.StringVar(&wasmAvailableAt, "wasmAvailableAt", "https://github.com/getlantern/wateringhole/raw/716a062ffa977fb4004d17827d46bc401265e2ac/protocols/plain/v1.0.0/plain.wasm", "URL where the WASM is available")
 	flag.StringVar(&transportName, "transport", "plain", "Transport to use")
 	flag.StringVar(&hashsum, "hashsum", "b764e7ca6ea2d883d776f19600e1b263920488989f4f230ee195a56faea3b732", "Expected hash sum")
@@ -66,6 +68,23 @@ func main() {
 		return
 	}
 
+	if localProxyAddr != "" {
+		server, err := proxy.NewServer(proxy.Params{
+			Logger:  golog.LoggerFor("water-proxy"),
+			Dialer:  dialer,
+			Address: listenerAddr,
+		})
+		if err != nil {
+			log.Error("failed to create local proxy", slog.Any("err", err))
+			return
+		}
+		log.Info("local proxy listening", slog.String("addr", localProxyAddr))
+		if err = server.ListenAndServe(ctx, localProxyAddr); err != nil {
+			log.Error("local proxy stopped", slog.Any("err", err))
+		}
+		return
+	}
+
 	conn, err := dialer.DialContext(ctx, "tcp", listenerAddr)
 	if err != nil {
 		log.Error("failed to dial", slog.Any("err", err))
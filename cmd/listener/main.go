@@ -11,19 +11,25 @@ import (
 	"strings"
 	"time"
 
+	"github.com/getlantern/golog"
 	waterDownloader "github.com/getlantern/lantern-water/downloader"
 	"github.com/getlantern/lantern-water/listener"
+	"github.com/getlantern/lantern-water/proxy"
+	"github.com/getlantern/lantern-water/server"
 )
 
 func main() {
 	ctx := context.Background()
 	log := slog.New(slog.NewTextHandler(os.Stdout, nil))
 
-	var listenAddr, wasmAvailableAt, transportName, hashsum string
+	var listenAddr, wasmAvailableAt, transportName, hashsum, upstreamAddr string
+	var tunnel bool
 	flag.StringVar(&listenAddr, "proxyURL", "localhost:8080", "URL of the proxy")
 	flag.StringVar(&wasmAvailableAt, "wasmAvailableAt", "https://github.com/getlantern/wateringhole/raw/716a062ffa977fb4004d17827d46bc401265e2ac/protocols/plain/v1.0.0/plain.wasm", "URL where the WASM is available")
 	flag.StringVar(&transportName, "transport", "plain", "Transport to use")
 	flag.StringVar(&hashsum, "hashsum", "b764e7ca6ea2d883d776f19600e1b263920488989f4f230ee195a56faea3b732", "Expected hash sum")
+	flag.StringVar(&upstreamAddr, "upstream", "", "If set, forward every accepted connection to this TCP address")
+	flag.BoolVar(&tunnel, "tunnel", false, "Connect every accepted connection to the target requested by the dialer local proxy")
 	flag.Parse()
 
 	// Client for downloading WASM file
@@ -58,6 +64,29 @@ func main() {
 	}
 	defer l.Close()
 
+	if tunnel {
+		if err = proxy.NewTunnel(proxy.TunnelParams{Logger: golog.LoggerFor("water-tunnel")}).Serve(ctx, l); err != nil {
+			log.Error("tunnel stopped", slog.Any("err", err))
+		}
+		return
+	}
+
+	if upstreamAddr != "" {
+		srv, err := server.New(server.Params{
+			Logger:      golog.LoggerFor("water-server"),
+			Upstream:    upstreamAddr,
+			IdleTimeout: 5 * time.Minute,
+		})
+		if err != nil {
+			log.Error("failed to create server", slog.Any("err", err))
+			return
+		}
+		if err = srv.Serve(ctx, l); err != nil {
+			log.Error("server stopped", slog.Any("err", err))
+		}
+		return
+	}
+
 	go func() {
 		conn, err := l.Accept()
 		if err != nil {
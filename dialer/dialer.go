@@ -4,11 +4,16 @@ package dialer
 import (
 	"context"
 	"log/slog"
+	"net"
+	"time"
 
 	"github.com/getlantern/golog"
+	"github.com/getlantern/lantern-water/limits"
 	"github.com/getlantern/lantern-water/logger"
+	"github.com/getlantern/lantern-water/metrics"
+	"github.com/getlantern/lantern-water/tracing"
 	"github.com/refraction-networking/water"
-	_ "github.com/refraction-networking/water/transport/v1"
+	v1 "github.com/refraction-networking/water/transport/v1"
 )
 
 // DialerParameters are used when creating a new dialer.
@@ -19,21 +24,116 @@ type DialerParameters struct {
 	Logger    golog.Logger
 	Transport string // Specifies transport being used.
 	WASM      []byte // The WASM module to use.
+	// Limits are optional resource limits applied to the WASM module and to
+	// every dialed connection.
+	Limits limits.Limits
+	// Metrics is an optional recorder receiving the dial latency and errors,
+	// active connections and transferred bytes.
+	Metrics metrics.Recorder
+	// Tracer is an optional tracer receiving spans for the WASM compilation
+	// and every dial.
+	Tracer tracing.Tracer
 }
 
 // NewDialer creates a new water dialer with the given parameters.
+// Every dialed connection gets an ID, retrievable with logger.ConnID, that is
+// added to the logs of the connection along with its addresses.
 func NewDialer(ctx context.Context, params DialerParameters) (water.Dialer, error) {
+	wasm, err := params.Limits.LimitMemory(params.Transport, params.WASM)
+	if err != nil {
+		return nil, err
+	}
+
 	cfg := &water.Config{
-		TransportModuleBin: params.WASM,
+		TransportModuleBin: wasm,
 	}
 
+	tracer := tracing.OrNop(params.Tracer)
+	// make sure the WASM module exports a supported dialer
+	_, span := tracer.Start(ctx, tracing.SpanCompile, slog.String(tracing.AttrTransport, params.Transport))
+	_, err = water.NewDialerWithContext(ctx, cfg)
+	span.End(err)
+	if err != nil {
+		return nil, err
+	}
+
+	d := &connDialer{
+		ctx:       ctx,
+		config:    cfg,
+		transport: params.Transport,
+		metrics:   metrics.OrNop(params.Metrics),
+		tracer:    tracer,
+	}
 	if params.Logger != nil {
-		cfg.OverrideLogger = slog.New(logger.NewLogHandler(params.Logger, params.Transport))
+		d.handler = logger.NewLogHandler(params.Logger, params.Transport)
+	}
+	return params.Limits.WrapDialer(ctx, params.Transport, d), nil
+}
+
+// connDialer creates a water dialer for every connection, so the WASM runtime
+// logs made on behalf of the connection carry its ID and addresses.
+type connDialer struct {
+	water.UnimplementedDialer
+	ctx       context.Context
+	config    *water.Config
+	handler   slog.Handler
+	transport string
+	metrics   metrics.Recorder
+	tracer    tracing.Tracer
+}
+
+// Dial dials using the context given when the dialer was created.
+func (d *connDialer) Dial(network, address string) (water.Conn, error) {
+	return d.DialContext(d.ctx, network, address)
+}
+
+func (d *connDialer) DialContext(ctx context.Context, network, address string) (water.Conn, error) {
+	start := time.Now()
+	ctx, span := d.tracer.Start(ctx, tracing.SpanDial,
+		slog.String(tracing.AttrTransport, d.transport),
+		slog.String(tracing.AttrAddress, address))
+	conn, err := d.dialContext(ctx, network, address)
+	if id, ok := logger.ConnID(conn); ok {
+		span.SetAttributes(slog.String(tracing.AttrConnID, id))
 	}
+	span.End(err)
+	metrics.ObserveSince(d.metrics, metrics.DialDuration, start, metrics.Labels{
+		metrics.LabelTransport: d.transport,
+		metrics.LabelResult:    metrics.Result(err),
+	})
+	if err != nil {
+		d.metrics.Add(metrics.DialErrors, 1, metrics.Labels{metrics.LabelTransport: d.transport})
+	}
+	return conn, err
+}
+
+func (d *connDialer) dialContext(ctx context.Context, network, address string) (water.Conn, error) {
+	connCtx := logger.NewConnContext()
+	connCtx.SetRemoteAddr(address)
 
-	dialer, err := water.NewDialerWithContext(ctx, cfg)
+	handler := d.handler
+	if handler == nil {
+		handler = slog.Default().Handler()
+	}
+	cfg := d.config.Clone()
+	cfg.OverrideLogger = slog.New(connCtx.Handler(handler))
+	cfg.NetworkDialerFunc = func(network, address string) (net.Conn, error) {
+		conn, err := net.Dial(network, address)
+		if err == nil {
+			connCtx.SetLocalAddr(conn.LocalAddr().String())
+			connCtx.SetRemoteAddr(conn.RemoteAddr().String())
+		}
+		return conn, err
+	}
+
+	dialer, err := v1.NewDialerWithContext(d.ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := dialer.DialContext(ctx, network, address)
 	if err != nil {
 		return nil, err
 	}
-	return dialer, nil
+	conn = metrics.WrapConn(conn, d.metrics, d.transport, metrics.DirectionDial)
+	return logger.WrapConn(conn, connCtx), nil
 }
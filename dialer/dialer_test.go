@@ -4,12 +4,20 @@ import (
 	"bytes"
 	"context"
 	"embed"
+	"fmt"
 	"io"
 	"net"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/getlantern/golog"
+	"github.com/getlantern/lantern-water/limits"
 	"github.com/getlantern/lantern-water/listener"
+	"github.com/getlantern/lantern-water/logger"
+	"github.com/getlantern/lantern-water/metrics"
+	"github.com/getlantern/lantern-water/tracing"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
@@ -91,3 +99,166 @@ func TestNewDialer(t *testing.T) {
 	assert.Equal(t, len(expectedResponse), n)
 	assert.Equal(t, expectedResponse, string(buf[:n]))
 }
+
+func TestNewDialerWithLimits(t *testing.T) {
+	f, err := testData.Open("testdata/reverse_v1.wasm")
+	require.Nil(t, err)
+
+	wasm, err := io.ReadAll(f)
+	require.Nil(t, err)
+
+	_, err = NewDialer(context.Background(), DialerParameters{
+		Logger:    golog.LoggerFor("water_dialer"),
+		Transport: "reverse_v1",
+		WASM:      wasm,
+		Limits:    limits.Limits{MaxMemoryPages: 1},
+	})
+	assert.ErrorIs(t, err, limits.ErrMemoryLimitExceeded)
+}
+
+// logOutput is a golog.Output keeping the logged messages.
+type logOutput struct {
+	mu       sync.Mutex
+	messages []string
+}
+
+func (o *logOutput) Debug(prefix string, skipFrames int, printStack bool, severity string, arg interface{}, values map[string]interface{}) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.messages = append(o.messages, fmt.Sprint(arg))
+}
+
+func (o *logOutput) Error(prefix string, skipFrames int, printStack bool, severity string, arg interface{}, values map[string]interface{}) {
+	o.Debug(prefix, skipFrames, printStack, severity, arg, values)
+}
+
+func (o *logOutput) contains(s string) bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for _, m := range o.messages {
+		if strings.Contains(m, s) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestConnIDAndMetrics(t *testing.T) {
+	out := new(logOutput)
+	defer golog.SetOutput(out)()
+
+	ctx := context.Background()
+	f, err := testData.Open("testdata/reverse_v1.wasm")
+	require.NoError(t, err)
+	wasm, err := io.ReadAll(f)
+	require.NoError(t, err)
+	recorder := metrics.NewExpvarRecorder()
+
+	ll, err := listener.NewWATERListener(ctx, listener.ListenerParams{
+		Logger:    golog.LoggerFor("water_listener"),
+		Transport: "reverse_v1",
+		Address:   "127.0.0.1:0",
+		WASM:      wasm,
+		Limits:    limits.Limits{CallTimeout: time.Minute, ConnectionLifetime: time.Minute},
+		Metrics:   recorder,
+	})
+	require.NoError(t, err)
+	defer ll.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := ll.Accept()
+		if err == nil {
+			accepted <- conn
+		}
+	}()
+
+	d, err := NewDialer(ctx, DialerParameters{
+		Logger:    golog.LoggerFor("water_dialer"),
+		Transport: "reverse_v1",
+		WASM:      wasm,
+		Limits:    limits.Limits{CallTimeout: time.Minute, ConnectionLifetime: time.Minute},
+		Metrics:   recorder,
+	})
+	require.NoError(t, err)
+	conn, err := d.DialContext(ctx, "tcp", ll.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	serverConn := <-accepted
+	defer serverConn.Close()
+
+	dialedID, ok := logger.ConnID(conn)
+	require.True(t, ok)
+	acceptedID, ok := logger.ConnID(serverConn)
+	require.True(t, ok)
+	assert.NotEmpty(t, dialedID)
+	assert.NotEqual(t, dialedID, acceptedID)
+
+	assert.Eventually(t, func() bool {
+		return out.contains("conn_id="+dialedID) && out.contains("conn_id="+acceptedID)
+	}, time.Second, 10*time.Millisecond, "WASM runtime logs should carry the connection ID")
+	assert.True(t, out.contains("remote_addr="+ll.Addr().String()))
+
+	transport := metrics.Labels{metrics.LabelTransport: "reverse_v1"}
+	dialed := metrics.Labels{metrics.LabelTransport: "reverse_v1", metrics.LabelDirection: metrics.DirectionDial}
+	acceptedLabels := metrics.Labels{metrics.LabelTransport: "reverse_v1", metrics.LabelDirection: metrics.DirectionAccept}
+	assert.Equal(t, float64(1), recorder.Value(metrics.Accepts, transport))
+	assert.Equal(t, float64(1), recorder.Value(metrics.ActiveConnections, dialed))
+	assert.Equal(t, float64(1), recorder.Value(metrics.ActiveConnections, acceptedLabels))
+	assert.Equal(t, float64(1), recorder.Value(metrics.DialDuration+"_count", metrics.Labels{
+		metrics.LabelTransport: "reverse_v1",
+		metrics.LabelResult:    metrics.ResultSuccess,
+	}))
+
+	_, err = conn.Write([]byte("hello"))
+	require.NoError(t, err)
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(serverConn, buf)
+	require.NoError(t, err)
+	assert.Equal(t, float64(5), recorder.Value(metrics.BytesSent, dialed))
+	assert.Equal(t, float64(5), recorder.Value(metrics.BytesReceived, acceptedLabels))
+
+	require.NoError(t, conn.Close())
+	assert.Zero(t, recorder.Value(metrics.ActiveConnections, dialed))
+
+	_, err = d.DialContext(ctx, "tcp", closedAddress(t))
+	assert.Error(t, err)
+	assert.Equal(t, float64(1), recorder.Value(metrics.DialErrors, transport))
+}
+
+func TestNewDialerTracing(t *testing.T) {
+	ctx := context.Background()
+	f, err := testData.Open("testdata/reverse_v1.wasm")
+	require.NoError(t, err)
+	wasm, err := io.ReadAll(f)
+	require.NoError(t, err)
+	ll := echoListener(t, wasm)
+	defer ll.Close()
+
+	recorder := tracing.NewRecorder()
+	d, err := NewDialer(ctx, DialerParameters{
+		Transport: "reverse_v1",
+		WASM:      wasm,
+		Tracer:    recorder,
+	})
+	require.NoError(t, err)
+	compile := recorder.SpansNamed(tracing.SpanCompile)
+	require.Len(t, compile, 1)
+	assert.NoError(t, compile[0].Err)
+
+	conn, err := d.DialContext(ctx, "tcp", ll.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = d.DialContext(ctx, "tcp", closedAddress(t))
+	require.Error(t, err)
+
+	dials := recorder.SpansNamed(tracing.SpanDial)
+	require.Len(t, dials, 2)
+	id, _ := logger.ConnID(conn)
+	connID, ok := dials[0].Attr(tracing.AttrConnID)
+	require.True(t, ok)
+	assert.Equal(t, id, connID.String())
+	address, _ := dials[0].Attr(tracing.AttrAddress)
+	assert.Equal(t, ll.Addr().String(), address.String())
+	assert.NoError(t, dials[0].Err)
+	assert.Error(t, dials[1].Err)
+}
@@ -0,0 +1,288 @@
+package dialer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/getlantern/golog"
+	"github.com/getlantern/lantern-water/limits"
+	"github.com/getlantern/lantern-water/metrics"
+	"github.com/getlantern/lantern-water/tracing"
+	"github.com/refraction-networking/water"
+)
+
+// FallbackEntry is a transport that can be used by the FallbackDialer.
+type FallbackEntry struct {
+	Transport string // Specifies transport being used.
+	WASM      []byte // The WASM module to use.
+	// Address is the listener address for this transport. If empty, the
+	// address given to Dial/DialContext is used.
+	Address string
+}
+
+// FallbackParameters are used when creating a new FallbackDialer.
+type FallbackParameters struct {
+	// An optional golog.Logger used for keeping compatibility with http-proxy
+	// and flashlight logger. If not defined the dialers will use the default
+	// water logger.
+	Logger golog.Logger
+	// Entries is the ordered list of transports to try.
+	Entries []FallbackEntry
+	// Stagger is the delay between starting attempts on consecutive entries,
+	// Happy-Eyeballs style. If zero, entries are tried one after the other
+	// and the next one only starts when the previous fails.
+	Stagger time.Duration
+	// MaxFailures is the number of consecutive failures after which a
+	// transport is demoted to the end of the list. Zero disables demotion.
+	MaxFailures int
+	// Limits are optional resource limits applied to every transport.
+	Limits limits.Limits
+	// Metrics is an optional recorder receiving the metrics of every
+	// transport.
+	Metrics metrics.Recorder
+	// Tracer is an optional tracer receiving the spans of every transport.
+	Tracer tracing.Tracer
+}
+
+type fallbackTransport struct {
+	FallbackEntry
+	dialer   water.Dialer
+	failures int
+}
+
+// FallbackDialer is a water.Dialer that dials through a list of transports,
+// falling back to the next one when a transport fails. It remembers the last
+// transport that worked and tries it first, and demotes transports that keep
+// failing.
+type FallbackDialer struct {
+	water.UnimplementedDialer
+
+	ctx         context.Context
+	log         golog.Logger
+	stagger     time.Duration
+	maxFailures int
+
+	mu         sync.Mutex
+	transports []*fallbackTransport
+	preferred  *fallbackTransport
+}
+
+// NewFallbackDialer creates a dialer for every entry and returns a
+// FallbackDialer using them in the given order.
+func NewFallbackDialer(ctx context.Context, params FallbackParameters) (*FallbackDialer, error) {
+	if len(params.Entries) == 0 {
+		return nil, errors.New("fallback dialer requires at least one entry")
+	}
+
+	transports := make([]*fallbackTransport, 0, len(params.Entries))
+	for _, entry := range params.Entries {
+		d, err := NewDialer(ctx, DialerParameters{
+			Logger:    params.Logger,
+			Transport: entry.Transport,
+			WASM:      entry.WASM,
+			Limits:    params.Limits,
+			Metrics:   params.Metrics,
+			Tracer:    params.Tracer,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to create dialer for transport %s: %w", entry.Transport, err)
+		}
+		transports = append(transports, &fallbackTransport{FallbackEntry: entry, dialer: d})
+	}
+
+	return &FallbackDialer{
+		ctx:         ctx,
+		log:         params.Logger,
+		stagger:     params.Stagger,
+		maxFailures: params.MaxFailures,
+		transports:  transports,
+	}, nil
+}
+
+// Preferred returns the transport that worked last, or an empty string if
+// none has worked yet.
+func (d *FallbackDialer) Preferred() string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.preferred == nil {
+		return ""
+	}
+	return d.preferred.Transport
+}
+
+// Dial dials using the context given when the dialer was created.
+func (d *FallbackDialer) Dial(network, address string) (water.Conn, error) {
+	return d.DialContext(d.ctx, network, address)
+}
+
+type fallbackResult struct {
+	transport *fallbackTransport
+	conn      water.Conn
+	cancel    context.CancelFunc
+	err       error
+}
+
+// DialContext dials through the transports until one of them succeeds. The
+// address is used for entries without their own address.
+func (d *FallbackDialer) DialContext(ctx context.Context, network, address string) (water.Conn, error) {
+	transports := d.order()
+	results := make(chan fallbackResult, len(transports))
+	cancels := make(map[*fallbackTransport]context.CancelFunc, len(transports))
+	defer func() {
+		for _, cancel := range cancels {
+			cancel()
+		}
+	}()
+
+	start := func(t *fallbackTransport) {
+		attemptCtx, cancel := context.WithCancel(ctx)
+		cancels[t] = cancel
+		addr := t.Address
+		if addr == "" {
+			addr = address
+		}
+		go func() {
+			conn, err := t.dialer.DialContext(attemptCtx, network, addr)
+			results <- fallbackResult{transport: t, conn: conn, cancel: cancel, err: err}
+		}()
+	}
+
+	var (
+		timer   *time.Timer
+		stagger <-chan time.Time
+	)
+	defer func() {
+		if timer != nil {
+			timer.Stop()
+		}
+	}()
+	next := 0
+	// startNext starts the next transport, if any, and rearms the stagger
+	// timer for the one after it. It reports whether a transport started.
+	startNext := func() bool {
+		if timer != nil {
+			timer.Stop()
+		}
+		stagger = nil
+		if next >= len(transports) {
+			return false
+		}
+		start(transports[next])
+		next++
+		if d.stagger > 0 && next < len(transports) {
+			timer = time.NewTimer(d.stagger)
+			stagger = timer.C
+		}
+		return true
+	}
+
+	startNext()
+	joinedErrs := errors.New("failed to dial through all transports")
+	for pending := 1; pending > 0; {
+		select {
+		case <-stagger:
+			if startNext() {
+				pending++
+			}
+		case res := <-results:
+			pending--
+			if res.err == nil {
+				d.markSuccess(res.transport)
+				// the winning attempt context must live as long as the connection
+				delete(cancels, res.transport)
+				go d.drain(results, pending)
+				return &fallbackConn{Conn: res.conn, cancel: res.cancel}, nil
+			}
+			if ctx.Err() != nil {
+				go d.drain(results, pending)
+				return nil, fmt.Errorf("context complete: %w", ctx.Err())
+			}
+			d.markFailure(res.transport, res.err)
+			joinedErrs = errors.Join(joinedErrs, fmt.Errorf("transport %s: %w", res.transport.Transport, res.err))
+			if startNext() {
+				pending++
+			}
+		case <-ctx.Done():
+			go d.drain(results, pending)
+			return nil, fmt.Errorf("context complete: %w", ctx.Err())
+		}
+	}
+	return nil, joinedErrs
+}
+
+// drain closes connections from attempts that finished after a winner was
+// picked or the dial was canceled.
+func (d *FallbackDialer) drain(results <-chan fallbackResult, pending int) {
+	for ; pending > 0; pending-- {
+		res := <-results
+		if res.conn != nil {
+			res.conn.Close()
+		}
+	}
+}
+
+// order returns the transports in the order they should be tried: the
+// preferred transport first, then the others in their original order with
+// the demoted ones at the end.
+func (d *FallbackDialer) order() []*fallbackTransport {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	transports := slices.Clone(d.transports)
+	slices.SortStableFunc(transports, func(a, b *fallbackTransport) int {
+		return d.rank(a) - d.rank(b)
+	})
+	return transports
+}
+
+func (d *FallbackDialer) rank(t *fallbackTransport) int {
+	switch {
+	case t == d.preferred:
+		return 0
+	case d.maxFailures > 0 && t.failures >= d.maxFailures:
+		return 2
+	default:
+		return 1
+	}
+}
+
+func (d *FallbackDialer) markSuccess(t *fallbackTransport) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	t.failures = 0
+	d.preferred = t
+}
+
+func (d *FallbackDialer) markFailure(t *fallbackTransport, err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	t.failures++
+	if d.preferred == t {
+		d.preferred = nil
+	}
+	if d.log != nil {
+		d.log.Debugf("transport %s failed %d times in a row: %v", t.Transport, t.failures, err)
+	}
+}
+
+// fallbackConn releases the dial attempt context when the connection is
+// closed.
+type fallbackConn struct {
+	water.Conn
+	cancel context.CancelFunc
+}
+
+func (c *fallbackConn) Close() error {
+	err := c.Conn.Close()
+	c.cancel()
+	return err
+}
+
+// NetConn returns the underlying connection.
+func (c *fallbackConn) NetConn() net.Conn {
+	return c.Conn
+}
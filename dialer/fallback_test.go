@@ -0,0 +1,183 @@
+package dialer
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/getlantern/golog"
+	"github.com/getlantern/lantern-water/listener"
+	"github.com/refraction-networking/water"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// closedAddress returns a local address where nothing is listening.
+func closedAddress(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := l.Addr().String()
+	require.NoError(t, l.Close())
+	return addr
+}
+
+// echoListener starts a WATER listener that echoes everything it receives.
+func echoListener(t *testing.T, wasm []byte) net.Listener {
+	ll, err := listener.NewWATERListener(context.Background(), listener.ListenerParams{
+		Logger:    golog.LoggerFor("water_listener"),
+		Transport: "reverse_v1",
+		Address:   "127.0.0.1:0",
+		WASM:      wasm,
+	})
+	require.NoError(t, err)
+	go func() {
+		for {
+			conn, err := ll.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return ll
+}
+
+// failingDialer fails every dial after its delay.
+type failingDialer struct {
+	water.UnimplementedDialer
+	delay time.Duration
+}
+
+func (d *failingDialer) DialContext(ctx context.Context, _, _ string) (water.Conn, error) {
+	select {
+	case <-time.After(d.delay):
+		return nil, errors.New("dial failed")
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func TestFallbackDialer(t *testing.T) {
+	f, err := testData.Open("testdata/reverse_v1.wasm")
+	require.NoError(t, err)
+	wasm, err := io.ReadAll(f)
+	require.NoError(t, err)
+
+	ll := echoListener(t, wasm)
+	defer ll.Close()
+
+	var tests = []struct {
+		name    string
+		stagger time.Duration
+	}{
+		{name: "it should fall back to the next transport in order"},
+		{name: "it should fall back to the next transport with staggered starts", stagger: 50 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			d, err := NewFallbackDialer(ctx, FallbackParameters{
+				Logger: golog.LoggerFor("water_dialer"),
+				Entries: []FallbackEntry{
+					{Transport: "blocked", WASM: wasm, Address: closedAddress(t)},
+					{Transport: "working", WASM: wasm, Address: ll.Addr().String()},
+				},
+				Stagger:     tt.stagger,
+				MaxFailures: 1,
+			})
+			require.NoError(t, err)
+			assert.Empty(t, d.Preferred())
+
+			conn, err := d.DialContext(ctx, "tcp", "")
+			require.NoError(t, err)
+			defer conn.Close()
+
+			_, err = conn.Write([]byte("hello"))
+			require.NoError(t, err)
+			buf := make([]byte, 5)
+			_, err = io.ReadFull(conn, buf)
+			require.NoError(t, err)
+			assert.Equal(t, "hello", string(buf))
+
+			assert.Equal(t, "working", d.Preferred())
+			order := d.order()
+			require.Len(t, order, 2)
+			assert.Equal(t, "working", order[0].Transport)
+			assert.Equal(t, "blocked", order[1].Transport)
+		})
+	}
+
+	t.Run("it should return an error when all transports fail", func(t *testing.T) {
+		ctx := context.Background()
+		d, err := NewFallbackDialer(ctx, FallbackParameters{
+			Entries: []FallbackEntry{
+				{Transport: "first", WASM: wasm, Address: closedAddress(t)},
+				{Transport: "second", WASM: wasm, Address: closedAddress(t)},
+			},
+		})
+		require.NoError(t, err)
+
+		_, err = d.DialContext(ctx, "tcp", "")
+		assert.ErrorContains(t, err, "failed to dial through all transports")
+		assert.ErrorContains(t, err, "transport first")
+		assert.ErrorContains(t, err, "transport second")
+		assert.Empty(t, d.Preferred())
+	})
+
+	t.Run("it should return an error when all transports fail with staggered starts", func(t *testing.T) {
+		ctx := context.Background()
+		// the first transports fail before the stagger delay, so the failures
+		// start the next ones, and the last one fails after the delay
+		d := &FallbackDialer{
+			ctx:     ctx,
+			stagger: 20 * time.Millisecond,
+			transports: []*fallbackTransport{
+				{FallbackEntry: FallbackEntry{Transport: "first"}, dialer: &failingDialer{}},
+				{FallbackEntry: FallbackEntry{Transport: "second"}, dialer: &failingDialer{}},
+				{FallbackEntry: FallbackEntry{Transport: "third"}, dialer: &failingDialer{delay: 100 * time.Millisecond}},
+			},
+		}
+
+		errs := make(chan error, 1)
+		go func() {
+			_, err := d.DialContext(ctx, "tcp", "")
+			errs <- err
+		}()
+		var err error
+		select {
+		case err = <-errs:
+		case <-time.After(5 * time.Second):
+			t.Fatal("dial didn't return after all transports failed")
+		}
+		assert.ErrorContains(t, err, "transport first")
+		assert.ErrorContains(t, err, "transport second")
+		assert.ErrorContains(t, err, "transport third")
+	})
+
+	t.Run("it should demote transports that keep failing", func(t *testing.T) {
+		ctx := context.Background()
+		d, err := NewFallbackDialer(ctx, FallbackParameters{
+			Entries: []FallbackEntry{
+				{Transport: "first", WASM: wasm, Address: closedAddress(t)},
+				{Transport: "second", WASM: wasm, Address: closedAddress(t)},
+				{Transport: "third", WASM: wasm, Address: closedAddress(t)},
+			},
+			MaxFailures: 2,
+		})
+		require.NoError(t, err)
+
+		d.markFailure(d.transports[0], assert.AnError)
+		assert.Equal(t, "first", d.order()[0].Transport)
+		d.markFailure(d.transports[0], assert.AnError)
+		order := d.order()
+		assert.Equal(t, "second", order[0].Transport)
+		assert.Equal(t, "third", order[1].Transport)
+		assert.Equal(t, "first", order[2].Transport)
+	})
+}
@@ -0,0 +1,308 @@
+package downloader
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Encodings of the compressed WASM files, named as in the Content-Encoding
+// header.
+const (
+	EncodingGzip   = "gzip"
+	EncodingZstd   = "zstd"
+	EncodingBrotli = "br"
+)
+
+// DefaultMaxSize is the default limit of the size of the WASM file, after
+// decompressing it.
+const DefaultMaxSize = 64 << 20
+
+// ErrTooLarge is returned when the WASM file is larger than the maximum size,
+// which blocks decompression bombs.
+var ErrTooLarge = errors.New("WASM file exceeds the maximum size")
+
+// errTrailingData is returned when bytes follow the end of the compressed
+// stream.
+var errTrailingData = errors.New("unexpected data after the compressed WASM file")
+
+// Decompressor returns a reader decompressing r.
+type Decompressor func(r io.Reader) (io.ReadCloser, error)
+
+// WithDecompressor sets the decompressor used for the given encoding,
+// replacing the default one. Gzip, zstd and brotli are supported by default.
+func WithDecompressor(encoding string, decompressor Decompressor) Option {
+	return func(d *downloader) {
+		d.decompressors[encoding] = decompressor
+	}
+}
+
+// WithMaxSize limits the size of the WASM file after decompressing it. It
+// defaults to DefaultMaxSize.
+func WithMaxSize(size int64) Option {
+	return func(d *downloader) {
+		d.maxSize = size
+	}
+}
+
+// defaultDecompressors returns the decompressors of the supported encodings.
+// Their output is limited by the maximum size like any WASM file.
+func defaultDecompressors() map[string]Decompressor {
+	return map[string]Decompressor{
+		EncodingGzip: func(r io.Reader) (io.ReadCloser, error) {
+			return gzip.NewReader(r)
+		},
+		EncodingZstd: func(r io.Reader) (io.ReadCloser, error) {
+			// the window is bounded too, so frames can't make the decoder
+			// allocate more memory than a WASM file can take
+			d, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1), zstd.WithDecoderMaxMemory(DefaultMaxSize))
+			if err != nil {
+				return nil, err
+			}
+			return d.IOReadCloser(), nil
+		},
+		EncodingBrotli: func(r io.Reader) (io.ReadCloser, error) {
+			return io.NopCloser(brotli.NewReader(r)), nil
+		},
+	}
+}
+
+// magicBytes identify the encodings with a fixed header. Brotli streams don't
+// have one, so they're only detected by extension or Content-Encoding.
+var magicBytes = []struct {
+	encoding string
+	magic    []byte
+}{
+	{encoding: EncodingGzip, magic: []byte{0x1f, 0x8b}},
+	{encoding: EncodingZstd, magic: []byte{0x28, 0xb5, 0x2f, 0xfd}},
+}
+
+// maxMagicLen is the number of bytes needed for detecting the encoding.
+const maxMagicLen = 4
+
+// encodingFromURL returns the encoding indicated by the extension of the URL
+// path, or of the display name of magnet links.
+func encodingFromURL(rawURL string) string {
+	name := rawURL
+	if u, err := url.Parse(rawURL); err == nil {
+		name = u.Path
+		if u.Scheme == "magnet" {
+			name = u.Query().Get("dn")
+		}
+	}
+	switch strings.ToLower(path.Ext(name)) {
+	case ".gz":
+		return EncodingGzip
+	case ".zst":
+		return EncodingZstd
+	case ".br":
+		return EncodingBrotli
+	default:
+		return ""
+	}
+}
+
+// decodingWriter decompresses the bytes written to it into out while
+// computing the digest of the received bytes. The encoding is given by the
+// URL or the Content-Encoding header, or detected from the first bytes. Close
+// must be called once all the bytes were written.
+type decodingWriter struct {
+	out           io.Writer
+	decompressors map[string]Decompressor
+	encoding      string
+	rawHash       hash.Hash
+	raw           int64
+
+	head    []byte
+	started bool
+	err     error
+	pipe    *io.PipeWriter
+	done    chan error
+}
+
+func newDecodingWriter(out io.Writer, decompressors map[string]Decompressor, encoding string) *decodingWriter {
+	return &decodingWriter{
+		out:           out,
+		decompressors: decompressors,
+		encoding:      encoding,
+		rawHash:       sha256.New(),
+	}
+}
+
+type decoderKey struct{}
+
+// withDecoder returns a context carrying the decoder, for the source
+// downloaders to set the encoding given by the transfer.
+func withDecoder(ctx context.Context, w *decodingWriter) context.Context {
+	return context.WithValue(ctx, decoderKey{}, w)
+}
+
+// decoderFrom returns the decoder carried by ctx, or nil.
+func decoderFrom(ctx context.Context) *decodingWriter {
+	w, _ := ctx.Value(decoderKey{}).(*decodingWriter)
+	return w
+}
+
+// setEncoding sets the encoding given by the transfer, such as the
+// Content-Encoding header. It's ignored once bytes were decoded.
+func (w *decodingWriter) setEncoding(encoding string) {
+	if w == nil || w.started || encoding == "" || encoding == "identity" {
+		return
+	}
+	w.encoding = strings.ToLower(encoding)
+}
+
+// compressed reports whether the received bytes were decompressed.
+func (w *decodingWriter) compressed() bool {
+	return w.encoding != ""
+}
+
+// rawSum returns the hex encoded SHA-256 digest of the received bytes.
+func (w *decodingWriter) rawSum() string {
+	return fmt.Sprintf("%x", w.rawHash.Sum(nil))
+}
+
+func (w *decodingWriter) Write(b []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	w.rawHash.Write(b)
+	w.raw += int64(len(b))
+	switch {
+	case !w.started:
+		w.head = append(w.head, b...)
+		if w.encoding == "" && len(w.head) < maxMagicLen {
+			return len(b), nil
+		}
+		w.err = w.start()
+	case w.pipe == nil:
+		_, w.err = w.out.Write(b)
+	default:
+		if _, err := w.pipe.Write(b); err != nil {
+			w.err = w.decodeErr(err)
+		}
+	}
+	if w.err != nil {
+		return 0, w.err
+	}
+	return len(b), nil
+}
+
+// start detects the encoding if unknown and starts decompressing the
+// received bytes.
+func (w *decodingWriter) start() error {
+	w.started = true
+	if w.encoding == "" {
+		for _, m := range magicBytes {
+			if bytes.HasPrefix(w.head, m.magic) {
+				w.encoding = m.encoding
+				break
+			}
+		}
+	}
+	if w.encoding == "" {
+		_, err := w.out.Write(w.head)
+		w.head = nil
+		return err
+	}
+
+	decompressor, ok := w.decompressors[w.encoding]
+	if !ok {
+		return fmt.Errorf("unsupported WASM file encoding %q", w.encoding)
+	}
+	r, pipe := io.Pipe()
+	w.pipe = pipe
+	w.done = make(chan error, 1)
+	go func() {
+		err := decompress(w.out, r, decompressor)
+		r.CloseWithError(err)
+		w.done <- err
+	}()
+	_, err := w.pipe.Write(w.head)
+	w.head = nil
+	if err != nil {
+		return w.decodeErr(err)
+	}
+	return nil
+}
+
+func decompress(out io.Writer, r io.Reader, decompressor Decompressor) error {
+	rc, err := decompressor(r)
+	if err != nil {
+		return fmt.Errorf("failed to decompress WASM file: %w", err)
+	}
+	defer rc.Close()
+	if _, err = io.Copy(out, rc); err != nil {
+		return fmt.Errorf("failed to decompress WASM file: %w", err)
+	}
+	// refuse trailing bytes rather than reading them without a limit, the
+	// writer is unblocked once the pipe is closed with the error
+	if _, err = io.ReadFull(r, make([]byte, 1)); err == nil {
+		return fmt.Errorf("failed to decompress WASM file: %w", errTrailingData)
+	}
+	return nil
+}
+
+// decodeErr returns the error that stopped the decompression, if any, instead
+// of the pipe error.
+func (w *decodingWriter) decodeErr(err error) error {
+	w.pipe.CloseWithError(err)
+	if decodeErr := <-w.done; decodeErr != nil {
+		w.done <- decodeErr
+		return decodeErr
+	}
+	w.done <- nil
+	return err
+}
+
+// Close flushes the bytes not decoded yet and waits for the decompression to
+// finish.
+func (w *decodingWriter) Close() error {
+	if w.err == nil && !w.started {
+		w.err = w.start()
+	}
+	if w.pipe == nil {
+		return w.err
+	}
+	w.pipe.Close()
+	err := <-w.done
+	w.done <- err
+	return err
+}
+
+// abort stops the decompression after the download failed with err.
+func (w *decodingWriter) abort(err error) {
+	if w.pipe == nil {
+		return
+	}
+	w.pipe.CloseWithError(err)
+	decodeErr := <-w.done
+	w.done <- decodeErr
+}
+
+// limitWriter fails with ErrTooLarge when more than max bytes are written.
+type limitWriter struct {
+	w       io.Writer
+	max     int64
+	written int64
+}
+
+func (w *limitWriter) Write(b []byte) (int, error) {
+	if w.written+int64(len(b)) > w.max {
+		return 0, fmt.Errorf("%w of %d bytes", ErrTooLarge, w.max)
+	}
+	n, err := w.w.Write(b)
+	w.written += int64(n)
+	return n, err
+}
@@ -0,0 +1,241 @@
+package downloader
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func gzipped(t *testing.T, b []byte) []byte {
+	buf := new(bytes.Buffer)
+	w := gzip.NewWriter(buf)
+	_, err := w.Write(b)
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	return buf.Bytes()
+}
+
+func zstdCompressed(t *testing.T, b []byte) []byte {
+	w, err := zstd.NewWriter(nil)
+	require.NoError(t, err)
+	defer w.Close()
+	return w.EncodeAll(b, nil)
+}
+
+func brotliCompressed(t *testing.T, b []byte) []byte {
+	buf := new(bytes.Buffer)
+	w := brotli.NewWriter(buf)
+	_, err := w.Write(b)
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	return buf.Bytes()
+}
+
+func sum(b []byte) string {
+	return fmt.Sprintf("%x", sha256.Sum256(b))
+}
+
+func TestDownloadCompressedWASM(t *testing.T) {
+	content := bytes.Repeat([]byte("wasm"), 1024)
+	compressed := gzipped(t, content)
+	bomb := bytes.Repeat([]byte{0}, 1<<20)
+
+	var tests = []struct {
+		name    string
+		path    string
+		body    []byte
+		header  http.Header
+		hashsum string
+		opts    []Option
+		assert  func(t *testing.T, b []byte, err error)
+	}{
+		{
+			name:    "it should decompress gzip files detected by magic bytes",
+			path:    "/module.wasm",
+			body:    compressed,
+			hashsum: sum(content),
+			assert: func(t *testing.T, b []byte, err error) {
+				require.NoError(t, err)
+				assert.Equal(t, content, b)
+			},
+		},
+		{
+			name:    "it should accept the hash sum of the compressed file",
+			path:    "/module.wasm.gz",
+			body:    compressed,
+			hashsum: sum(compressed),
+			assert: func(t *testing.T, b []byte, err error) {
+				require.NoError(t, err)
+				assert.Equal(t, content, b)
+			},
+		},
+		{
+			name:    "it should decompress files with a Content-Encoding",
+			path:    "/module",
+			body:    append([]byte("compressed:"), content...),
+			header:  http.Header{"Content-Encoding": []string{"test"}},
+			hashsum: sum(content),
+			opts: []Option{WithDecompressor("test", func(r io.Reader) (io.ReadCloser, error) {
+				b, err := io.ReadAll(r)
+				return io.NopCloser(bytes.NewReader(bytes.TrimPrefix(b, []byte("compressed:")))), err
+			})},
+			assert: func(t *testing.T, b []byte, err error) {
+				require.NoError(t, err)
+				assert.Equal(t, content, b)
+			},
+		},
+		{
+			name:    "it should fail on unsupported encodings",
+			path:    "/module",
+			body:    compressed,
+			header:  http.Header{"Content-Encoding": []string{"compress"}},
+			hashsum: sum(content),
+			assert: func(t *testing.T, b []byte, err error) {
+				assert.ErrorContains(t, err, `unsupported WASM file encoding "compress"`)
+			},
+		},
+		{
+			name:    "it should decompress zstd files detected by magic bytes",
+			path:    "/module.wasm",
+			body:    zstdCompressed(t, content),
+			hashsum: sum(content),
+			assert: func(t *testing.T, b []byte, err error) {
+				require.NoError(t, err)
+				assert.Equal(t, content, b)
+			},
+		},
+		{
+			name:    "it should decompress brotli files by extension",
+			path:    "/module.wasm.br",
+			body:    brotliCompressed(t, content),
+			hashsum: sum(content),
+			assert: func(t *testing.T, b []byte, err error) {
+				require.NoError(t, err)
+				assert.Equal(t, content, b)
+			},
+		},
+		{
+			name:    "it should decompress brotli files with a Content-Encoding",
+			path:    "/module",
+			body:    brotliCompressed(t, content),
+			header:  http.Header{"Content-Encoding": []string{"br"}},
+			hashsum: sum(content),
+			assert: func(t *testing.T, b []byte, err error) {
+				require.NoError(t, err)
+				assert.Equal(t, content, b)
+			},
+		},
+		{
+			name:    "it should fail on data after the compressed stream",
+			path:    "/module",
+			body:    append(bytes.Clone(content), "trailing"...),
+			header:  http.Header{"Content-Encoding": []string{"test"}},
+			hashsum: sum(content),
+			opts: []Option{WithDecompressor("test", func(r io.Reader) (io.ReadCloser, error) {
+				return io.NopCloser(io.LimitReader(r, int64(len(content)))), nil
+			})},
+			assert: func(t *testing.T, b []byte, err error) {
+				assert.ErrorIs(t, err, errTrailingData)
+			},
+		},
+		{
+			name:    "it should fail on data after a brotli stream",
+			path:    "/module.wasm.br",
+			body:    append(brotliCompressed(t, content), "trailing"...),
+			hashsum: sum(content),
+			assert: func(t *testing.T, b []byte, err error) {
+				assert.Error(t, err)
+			},
+		},
+		{
+			name:    "it should fail on data after a gzip stream",
+			path:    "/module.wasm.gz",
+			body:    append(gzipped(t, content), "trailing"...),
+			hashsum: sum(content),
+			assert: func(t *testing.T, b []byte, err error) {
+				assert.Error(t, err)
+			},
+		},
+		{
+			name:    "it should stop gzip decompression bombs",
+			path:    "/module.wasm.gz",
+			body:    gzipped(t, bomb),
+			hashsum: sum(content),
+			opts:    []Option{WithMaxSize(1 << 10)},
+			assert: func(t *testing.T, b []byte, err error) {
+				assert.ErrorIs(t, err, ErrTooLarge)
+				assert.Empty(t, b)
+			},
+		},
+		{
+			name:    "it should stop zstd decompression bombs",
+			path:    "/module.wasm.zst",
+			body:    zstdCompressed(t, bomb),
+			hashsum: sum(content),
+			opts:    []Option{WithMaxSize(1 << 10)},
+			assert: func(t *testing.T, b []byte, err error) {
+				assert.ErrorIs(t, err, ErrTooLarge)
+				assert.Empty(t, b)
+			},
+		},
+		{
+			name:    "it should stop brotli decompression bombs",
+			path:    "/module.wasm.br",
+			body:    brotliCompressed(t, bomb),
+			hashsum: sum(content),
+			opts:    []Option{WithMaxSize(1 << 10)},
+			assert: func(t *testing.T, b []byte, err error) {
+				assert.ErrorIs(t, err, ErrTooLarge)
+				assert.Empty(t, b)
+			},
+		},
+		{
+			name:    "it should pass through files shorter than the magic bytes",
+			path:    "/module.wasm",
+			body:    []byte("w"),
+			hashsum: sum([]byte("w")),
+			assert: func(t *testing.T, b []byte, err error) {
+				require.NoError(t, err)
+				assert.Equal(t, "w", string(b))
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				for key, values := range tt.header {
+					w.Header()[key] = values
+				}
+				w.Write(tt.body)
+			}))
+			defer srv.Close()
+
+			d, err := New(tt.hashsum, []string{srv.URL + tt.path}, append([]Option{WithHTTPClient(srv.Client())}, tt.opts...)...)
+			require.NoError(t, err)
+			b := new(bytes.Buffer)
+			err = d.DownloadWASM(context.Background(), b)
+			tt.assert(t, b.Bytes(), err)
+		})
+	}
+}
+
+func TestEncodingFromURL(t *testing.T) {
+	assert.Equal(t, EncodingGzip, encodingFromURL("https://example.com/module.wasm.gz?v=1"))
+	assert.Equal(t, EncodingZstd, encodingFromURL("https://example.com/module.wasm.ZST"))
+	assert.Equal(t, EncodingBrotli, encodingFromURL("https://example.com/module.wasm.br"))
+	assert.Equal(t, EncodingGzip, encodingFromURL("magnet:?xt=urn:btih:abc&dn=module.wasm.gz"))
+	assert.Empty(t, encodingFromURL("https://example.com/module.wasm"))
+	assert.Empty(t, encodingFromURL(strings.Repeat("%", 3)))
+}
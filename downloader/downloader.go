@@ -1,5 +1,7 @@
 // Package downloader provides a WASM downloader that can download the WASM
-// file from a given URL. The downloader supports both HTTPS URLs and magnet links.
+// file from a given URL. The downloader supports HTTPS URLs, magnet links,
+// .torrent files and torrents given with WithTorrent. Other URL schemes can
+// be supported by registering a SourceFactory.
 package downloader
 
 import (
@@ -9,8 +11,12 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"log/slog"
 	"net/http"
-	"strings"
+	"time"
+
+	"github.com/getlantern/lantern-water/metrics"
+	"github.com/getlantern/lantern-water/tracing"
 )
 
 //go:generate mockgen -package=downloader -destination=mocks.go . WASMDownloader,torrentClient,torrentInfo
@@ -23,24 +29,154 @@ type WASMDownloader interface {
 }
 
 type downloader struct {
-	expectedHashSum string
-	urls            []string
-	httpClient      *http.Client
+	expectedHashSum   string
+	urls              []string
+	httpClient        *http.Client
+	torrentHTTPClient *http.Client
+	header            http.Header
+	sourceTimeout     time.Duration
+	timeout           time.Duration
+	retryPolicy       RetryPolicy
+	decompressors     map[string]Decompressor
+	maxSize           int64
+	sources           map[string]SourceFactory // overrides of the registered sources, nil disables
+	torrents          []TorrentSpec
+	torrentClient     *TorrentClient
+	metrics           metrics.Recorder
+	tracer            tracing.Tracer
+	progress          ProgressFunc
+}
+
+// Option configures optional features of the WASMDownloader.
+type Option func(*downloader)
+
+// WithMetrics sets a recorder receiving the duration, bytes and hash failures
+// of every download attempt, labeled by source type.
+func WithMetrics(recorder metrics.Recorder) Option {
+	return func(d *downloader) {
+		d.metrics = recorder
+	}
+}
+
+// WithTracer sets a tracer receiving a span for every download attempt and
+// for waiting on torrent metadata.
+func WithTracer(tracer tracing.Tracer) Option {
+	return func(d *downloader) {
+		d.tracer = tracer
+	}
+}
+
+// WithHTTPClient sets the client used for downloading from HTTPS mirrors. It
+// defaults to http.DefaultClient.
+func WithHTTPClient(client *http.Client) Option {
+	return func(d *downloader) {
+		if client != nil {
+			d.httpClient = client
+		}
+	}
+}
+
+// WithTorrentClient sets a torrent client shared by the magnet and torrent
+// downloads, instead of creating one for every download. Its own HTTP client
+// and User-Agent are used, and it isn't closed by the WASMDownloader.
+func WithTorrentClient(client *TorrentClient) Option {
+	return func(d *downloader) {
+		d.torrentClient = client
+	}
+}
+
+// WithTorrentHTTPClient sets the client whose transport is used by the torrent
+// client for HTTP trackers and web seeds. It defaults to the client set with
+// WithHTTPClient.
+func WithTorrentHTTPClient(client *http.Client) Option {
+	return func(d *downloader) {
+		d.torrentHTTPClient = client
+	}
+}
+
+// WithSourceTimeout limits the time spent downloading from every source,
+// including retries, after which the next one is tried.
+func WithSourceTimeout(timeout time.Duration) Option {
+	return func(d *downloader) {
+		d.sourceTimeout = timeout
+	}
+}
+
+// WithTimeout limits the time spent by DownloadWASM across all the sources.
+func WithTimeout(timeout time.Duration) Option {
+	return func(d *downloader) {
+		d.timeout = timeout
+	}
+}
+
+// WithUserAgent sets the User-Agent header sent to HTTPS mirrors, torrent
+// trackers and web seeds.
+func WithUserAgent(userAgent string) Option {
+	return func(d *downloader) {
+		d.header.Set("User-Agent", userAgent)
+	}
+}
+
+// WithHeader adds a header sent to HTTPS mirrors. It can be given several
+// times, also for the same key.
+func WithHeader(key, value string) Option {
+	return func(d *downloader) {
+		d.header.Add(key, value)
+	}
 }
 
-// NewWASMDownloader creates a new WASMDownloader instance.
-func NewWASMDownloader(hashsum string, urls []string, httpClient *http.Client) (WASMDownloader, error) {
+// New creates a new WASMDownloader verifying the downloaded file against the
+// SHA-256 hashsum and trying the URLs in order. Compressed files are
+// decompressed while downloading, and the hashsum can be the one of either the
+// compressed or the decompressed file.
+func New(hashsum string, urls []string, opts ...Option) (WASMDownloader, error) {
 	if hashsum == "" {
 		return nil, fmt.Errorf("missing required hashsum")
 	}
-	if len(urls) == 0 {
-		return nil, fmt.Errorf("WASM downloader requires URLs to download but received empty list")
-	}
-	return &downloader{
+	d := &downloader{
 		urls:            urls,
-		httpClient:      httpClient,
+		httpClient:      http.DefaultClient,
+		header:          make(http.Header),
+		decompressors:   defaultDecompressors(),
+		maxSize:         DefaultMaxSize,
+		sources:         map[string]SourceFactory{"file": nil, "data": nil},
 		expectedHashSum: hashsum,
-	}, nil
+	}
+	for _, opt := range opts {
+		opt(d)
+	}
+	if len(d.torrents) > 0 {
+		torrentURLs, factory, err := torrentSources(d.torrents)
+		if err != nil {
+			return nil, err
+		}
+		d.urls = append(d.urls[:len(d.urls):len(d.urls)], torrentURLs...)
+		d.sources["torrent"] = factory
+	}
+	if len(d.urls) == 0 {
+		return nil, fmt.Errorf("WASM downloader requires URLs to download but received empty list")
+	}
+	if d.maxSize <= 0 {
+		return nil, fmt.Errorf("maximum size must be positive")
+	}
+	if d.sourceTimeout < 0 || d.timeout < 0 {
+		return nil, fmt.Errorf("timeouts must not be negative")
+	}
+	if err := d.retryPolicy.validate(); err != nil {
+		return nil, err
+	}
+	if d.torrentHTTPClient == nil {
+		d.torrentHTTPClient = d.httpClient
+	}
+	d.metrics = metrics.OrNop(d.metrics)
+	d.tracer = tracing.OrNop(d.tracer)
+	return d, nil
+}
+
+// NewWASMDownloader creates a new WASMDownloader instance using httpClient for
+// the downloads. It's equivalent to New with WithHTTPClient.
+func NewWASMDownloader(hashsum string, urls []string, httpClient *http.Client, opts ...Option) (WASMDownloader, error) {
+	return New(hashsum, urls, append([]Option{WithHTTPClient(httpClient)}, opts...)...)
 }
 
 func (d *downloader) Close() error {
@@ -50,15 +186,19 @@ func (d *downloader) Close() error {
 // DownloadWASM downloads the WASM file from the given URLs, verifies the hash
 // sum and writes the file to the given writer.
 func (d *downloader) DownloadWASM(ctx context.Context, w io.Writer) error {
+	if d.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d.timeout)
+		defer cancel()
+	}
+
 	joinedErrs := errors.New("failed to download WASM from all URLs")
 	for _, url := range d.urls {
-		tempBuffer := &bytes.Buffer{}
-		if err := d.downloadWASM(ctx, tempBuffer, url); err != nil {
-			joinedErrs = errors.Join(joinedErrs, err)
-			continue
+		if ctx.Err() != nil {
+			return errors.Join(joinedErrs, fmt.Errorf("context complete: %w", ctx.Err()))
 		}
-
-		if err := d.verifyHashSum(tempBuffer.Bytes()); err != nil {
+		tempBuffer, err := d.downloadFromSource(ctx, url)
+		if err != nil {
 			joinedErrs = errors.Join(joinedErrs, err)
 			continue
 		}
@@ -72,28 +212,135 @@ func (d *downloader) DownloadWASM(ctx context.Context, w io.Writer) error {
 	return joinedErrs
 }
 
-// downloadWASM checks what kind of URL was given and downloads the WASM file
-// from the URL. It can be a HTTPS URL or a magnet link.
-func (d *downloader) downloadWASM(ctx context.Context, w io.Writer, url string) error {
-	switch {
-	case strings.HasPrefix(url, "http://"), strings.HasPrefix(url, "https://"):
-		return newHTTPSDownloader(d.httpClient, url).DownloadWASM(ctx, w)
-	case strings.HasPrefix(url, "magnet:?"):
-		downloader, err := newMagnetDownloader(ctx, d.httpClient, url)
+// downloadFromSource downloads and verifies the WASM file from the URL,
+// retrying as allowed by the retry policy.
+func (d *downloader) downloadFromSource(ctx context.Context, url string) (*bytes.Buffer, error) {
+	if d.sourceTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d.sourceTimeout)
+		defer cancel()
+	}
+
+	var errs []error
+	for attempt := 1; ; attempt++ {
+		buf := new(bytes.Buffer)
+		err := d.downloadAndVerify(ctx, buf, url, attempt)
+		if err == nil {
+			return buf, nil
+		}
+		errs = append(errs, err)
+		if attempt > d.retryPolicy.Retries || !retryable(err) {
+			return nil, errors.Join(errs...)
+		}
+		if err = d.retryPolicy.wait(ctx, attempt); err != nil {
+			return nil, errors.Join(append(errs, err)...)
+		}
+		d.metrics.Add(metrics.DownloadRetries, 1, metrics.Labels{metrics.LabelSource: d.sourceType(url)})
+	}
+}
+
+// downloadAndVerify makes an attempt to download the WASM file from the URL
+// into the buffer and verifies its hash sum, recording the attempt metrics and
+// reporting its progress.
+func (d *downloader) downloadAndVerify(ctx context.Context, buf *bytes.Buffer, url string, attempt int) (err error) {
+	source := metrics.Labels{metrics.LabelSource: d.sourceType(url)}
+	tracker := newProgressTracker(ctx, d.progress, url, attempt)
+	tracker.start()
+	start := time.Now()
+	ctx, span := d.tracer.Start(ctx, tracing.SpanDownload,
+		slog.String(tracing.AttrURL, url),
+		slog.String(tracing.AttrSource, source[metrics.LabelSource]),
+		slog.Int(tracing.AttrAttempt, attempt))
+	defer func() {
 		if err != nil {
-			return err
+			tracker.fail(err)
 		}
-		defer downloader.Close()
-		return downloader.DownloadWASM(ctx, w)
-	default:
-		return fmt.Errorf("unsupported protocol: %s", url)
+		span.SetAttributes(slog.Int(tracing.AttrBytes, buf.Len()))
+		span.End(err)
+		metrics.ObserveSince(d.metrics, metrics.DownloadDuration, start, metrics.Labels{
+			metrics.LabelSource: source[metrics.LabelSource],
+			metrics.LabelResult: metrics.Result(err),
+		})
+	}()
+
+	attemptCtx, dog, stop := newWatchdog(ctx, d.retryPolicy, source[metrics.LabelSource] == "https")
+	// the received bytes are reported, then decompressed into buf if needed
+	decoder := newDecodingWriter(&limitWriter{w: buf, max: d.maxSize}, d.decompressors, encodingFromURL(url))
+	var w io.Writer = io.MultiWriter(decoder, dog)
+	if tracker != nil {
+		w = &progressWriter{w: w, tracker: tracker}
+	}
+	attemptCtx = withDecoder(withTracker(attemptCtx, tracker), decoder)
+	err = d.downloadWASM(attemptCtx, w, url)
+	if err != nil && ctx.Err() == nil {
+		// report the policy timeout that aborted the attempt, if any
+		if cause := context.Cause(attemptCtx); cause != nil && !errors.Is(cause, context.Canceled) {
+			err = fmt.Errorf("%w: %w", cause, err)
+		}
+	}
+	stop()
+	if err != nil {
+		decoder.abort(err)
+	} else {
+		err = decoder.Close()
+	}
+	if decoder.raw > 0 {
+		d.metrics.Add(metrics.DownloadBytes, float64(decoder.raw), source)
+	}
+	if err != nil {
+		return err
+	}
+
+	err = d.verifyHashSum(buf.Bytes())
+	if err != nil && decoder.compressed() && decoder.rawSum() == d.expectedHashSum {
+		// the hash sum is the one of the compressed file
+		err = nil
+	}
+	span.SetAttributes(slog.Bool(tracing.AttrHashOK, err == nil))
+	if err != nil {
+		d.metrics.Add(metrics.HashFailures, 1, source)
+		return err
+	}
+	return nil
+}
+
+// sourceType returns the kind of source of the URL, used for labeling
+// metrics. It's the URL scheme if supported, with http reported as https.
+func (d *downloader) sourceType(url string) string {
+	if _, err := d.source(url); err != nil {
+		return "unknown"
+	}
+	if scheme := scheme(url); scheme != "http" {
+		return scheme
+	}
+	return "https"
+}
+
+// downloadWASM downloads the WASM file from the URL with the downloader
+// created by the source factory for its scheme.
+func (d *downloader) downloadWASM(ctx context.Context, w io.Writer, url string) error {
+	factory, err := d.source(url)
+	if err != nil {
+		return err
+	}
+	downloader, err := factory(ctx, url, SourceConfig{
+		HTTPClient:        d.httpClient,
+		TorrentHTTPClient: d.torrentHTTPClient,
+		Header:            d.header,
+		Tracer:            d.tracer,
+		TorrentClient:     d.torrentClient,
+	})
+	if err != nil {
+		return err
 	}
+	defer downloader.Close()
+	return downloader.DownloadWASM(ctx, w)
 }
 
 func (d *downloader) verifyHashSum(data []byte) error {
 	got := fmt.Sprintf("%x", sha256.Sum256(data))
 	if d.expectedHashSum != got {
-		return fmt.Errorf("hashsum verification failed, expected %s, but got %s", d.expectedHashSum, got)
+		return fmt.Errorf("%w, expected %s, but got %s", errHashMismatch, d.expectedHashSum, got)
 	}
 	return nil
 }
@@ -7,8 +7,12 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/getlantern/lantern-water/metrics"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -167,3 +171,127 @@ func TestDownloadWASM(t *testing.T) {
 		})
 	}
 }
+
+func TestDownloadWASMMetrics(t *testing.T) {
+	ctx := context.Background()
+	contentMessage := "content"
+	hashsum := fmt.Sprintf("%x", sha256.Sum256([]byte(contentMessage)))
+	client := &http.Client{
+		Transport: &roundTripFunc{
+			f: func(req *http.Request) (*http.Response, error) {
+				return &http.Response{
+					StatusCode: http.StatusOK,
+					Body:       io.NopCloser(bytes.NewBufferString(contentMessage)),
+				}, nil
+			},
+		},
+	}
+	https := metrics.Labels{metrics.LabelSource: "https"}
+
+	t.Run("it should record successful downloads", func(t *testing.T) {
+		recorder := metrics.NewExpvarRecorder()
+		d, err := NewWASMDownloader(hashsum, []string{"http://example.com"}, client, WithMetrics(recorder))
+		require.NoError(t, err)
+		require.NoError(t, d.DownloadWASM(ctx, new(bytes.Buffer)))
+
+		assert.Equal(t, float64(len(contentMessage)), recorder.Value(metrics.DownloadBytes, https))
+		assert.Equal(t, float64(1), recorder.Value(metrics.DownloadDuration+"_count", metrics.Labels{
+			metrics.LabelSource: "https",
+			metrics.LabelResult: metrics.ResultSuccess,
+		}))
+		assert.Zero(t, recorder.Value(metrics.HashFailures, https))
+	})
+
+	t.Run("it should record hash failures", func(t *testing.T) {
+		recorder := metrics.NewExpvarRecorder()
+		d, err := NewWASMDownloader("invalid", []string{"http://example.com", "udp://example.com"}, client, WithMetrics(recorder))
+		require.NoError(t, err)
+		require.Error(t, d.DownloadWASM(ctx, new(bytes.Buffer)))
+
+		assert.Equal(t, float64(1), recorder.Value(metrics.HashFailures, https))
+		assert.Equal(t, float64(1), recorder.Value(metrics.DownloadDuration+"_count", metrics.Labels{
+			metrics.LabelSource: "https",
+			metrics.LabelResult: metrics.ResultFailure,
+		}))
+		assert.Equal(t, float64(1), recorder.Value(metrics.DownloadDuration+"_count", metrics.Labels{
+			metrics.LabelSource: "unknown",
+			metrics.LabelResult: metrics.ResultFailure,
+		}))
+	})
+}
+
+func TestNew(t *testing.T) {
+	content := []byte("content")
+	hashsum := fmt.Sprintf("%x", sha256.Sum256(content))
+
+	t.Run("it should default the HTTP clients", func(t *testing.T) {
+		wDownloader, err := New(hashsum, []string{"http://example.com"})
+		require.NoError(t, err)
+		d := wDownloader.(*downloader)
+		assert.Equal(t, http.DefaultClient, d.httpClient)
+		assert.Equal(t, http.DefaultClient, d.torrentHTTPClient)
+
+		mirrors, torrents := new(http.Client), new(http.Client)
+		wDownloader, err = New(hashsum, []string{"http://example.com"}, WithHTTPClient(mirrors), WithTorrentHTTPClient(torrents))
+		require.NoError(t, err)
+		d = wDownloader.(*downloader)
+		assert.Same(t, mirrors, d.httpClient)
+		assert.Same(t, torrents, d.torrentHTTPClient)
+	})
+
+	t.Run("it should reject negative timeouts", func(t *testing.T) {
+		_, err := New(hashsum, []string{"http://example.com"}, WithSourceTimeout(-time.Second))
+		assert.Error(t, err)
+	})
+
+	t.Run("it should send the user agent and headers", func(t *testing.T) {
+		var got http.Header
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			got = r.Header
+			w.Write(content)
+		}))
+		defer srv.Close()
+
+		d, err := New(hashsum, []string{srv.URL},
+			WithHTTPClient(srv.Client()),
+			WithUserAgent("lantern-water-test"),
+			WithHeader("X-Test", "a"),
+			WithHeader("X-Test", "b"))
+		require.NoError(t, err)
+		require.NoError(t, d.DownloadWASM(context.Background(), new(bytes.Buffer)))
+		assert.Equal(t, "lantern-water-test", got.Get("User-Agent"))
+		assert.Equal(t, []string{"a", "b"}, got.Values("X-Test"))
+	})
+
+	t.Run("it should try the next source after the source timeout", func(t *testing.T) {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/slow" {
+				<-r.Context().Done()
+				return
+			}
+			w.Write(content)
+		}))
+		defer srv.Close()
+
+		d, err := New(hashsum, []string{srv.URL + "/slow", srv.URL}, WithHTTPClient(srv.Client()), WithSourceTimeout(50*time.Millisecond))
+		require.NoError(t, err)
+		b := new(bytes.Buffer)
+		require.NoError(t, d.DownloadWASM(context.Background(), b))
+		assert.Equal(t, content, b.Bytes())
+	})
+
+	t.Run("it should stop trying sources after the overall timeout", func(t *testing.T) {
+		var requests atomic.Int32
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests.Add(1)
+			<-r.Context().Done()
+		}))
+		defer srv.Close()
+
+		d, err := New(hashsum, []string{srv.URL, srv.URL}, WithHTTPClient(srv.Client()), WithTimeout(50*time.Millisecond))
+		require.NoError(t, err)
+		err = d.DownloadWASM(context.Background(), new(bytes.Buffer))
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+		assert.Equal(t, int32(1), requests.Load())
+	})
+}
@@ -8,12 +8,15 @@ import (
 )
 
 type httpsDownloader struct {
-	cli *http.Client
-	url string
+	cli    *http.Client
+	url    string
+	header http.Header
 }
 
-func newHTTPSDownloader(client *http.Client, url string) WASMDownloader {
-	return &httpsDownloader{cli: client, url: url}
+// newHTTPSDownloader creates a downloader for the URL sending the given
+// headers, which can be nil.
+func newHTTPSDownloader(client *http.Client, url string, header http.Header) WASMDownloader {
+	return &httpsDownloader{cli: client, url: url, header: header}
 }
 
 // Close for httpsDownloader does nothing.
@@ -28,6 +31,9 @@ func (d *httpsDownloader) DownloadWASM(ctx context.Context, w io.Writer) error {
 	if err != nil {
 		return fmt.Errorf("failed to create a new HTTP request: %w", err)
 	}
+	for key, values := range d.header {
+		req.Header[key] = values
+	}
 	resp, err := d.cli.Do(req)
 	if err != nil {
 		return fmt.Errorf("failed to send a HTTP request: %w", err)
@@ -35,8 +41,10 @@ func (d *httpsDownloader) DownloadWASM(ctx context.Context, w io.Writer) error {
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("failed to download WASM file: %s", resp.Status)
+		return &StatusError{StatusCode: resp.StatusCode, Status: resp.Status}
 	}
+	trackerFrom(ctx).setTotal(resp.ContentLength)
+	decoderFrom(ctx).setEncoding(resp.Header.Get("Content-Encoding"))
 
 	_, err = io.Copy(w, resp.Body)
 	if err != nil {
@@ -83,7 +83,7 @@ func TestHTTPSDownloadWASM(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			b := new(bytes.Buffer)
-			err := newHTTPSDownloader(tt.givenHTTPClient, tt.givenURL).DownloadWASM(ctx, b)
+			err := newHTTPSDownloader(tt.givenHTTPClient, tt.givenURL, nil).DownloadWASM(ctx, b)
 			tt.assert(t, b, err)
 		})
 	}
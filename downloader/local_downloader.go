@@ -0,0 +1,201 @@
+package downloader
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// WithFileURLs enables or disables file:// URLs, for modules sideloaded on
+// removable storage. When roots are given, only files within them can be
+// read. They're disabled by default.
+func WithFileURLs(enabled bool, roots ...string) Option {
+	return func(d *downloader) {
+		d.sources["file"] = nil
+		if enabled {
+			d.sources["file"] = func(_ context.Context, url string, _ SourceConfig) (WASMDownloader, error) {
+				return newFileDownloader(url, roots), nil
+			}
+		}
+	}
+}
+
+// WithDataURLs enables or disables base64 encoded data: URLs, for tiny modules
+// embedded in configuration. They're disabled by default.
+func WithDataURLs(enabled bool) Option {
+	return func(d *downloader) {
+		d.sources["data"] = nil
+		if enabled {
+			d.sources["data"] = func(_ context.Context, url string, _ SourceConfig) (WASMDownloader, error) {
+				return newDataDownloader(url), nil
+			}
+		}
+	}
+}
+
+type fileDownloader struct {
+	url   string
+	roots []string
+}
+
+// newFileDownloader creates a downloader reading the file of a file:// URL,
+// which must be within one of the roots if any.
+func newFileDownloader(fileURL string, roots []string) WASMDownloader {
+	return &fileDownloader{url: fileURL, roots: roots}
+}
+
+// Close for fileDownloader does nothing.
+func (d *fileDownloader) Close() error {
+	return nil
+}
+
+// DownloadWASM copies the file to the given writer.
+func (d *fileDownloader) DownloadWASM(ctx context.Context, w io.Writer) error {
+	path, err := d.path()
+	if err != nil {
+		return err
+	}
+	// the file is opened before checking its path, so it can't be replaced in
+	// between by one the checks would reject
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open WASM file: %w", err)
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat WASM file: %w", err)
+	}
+	if err = d.checkRoots(path, info); err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("WASM file %s is not a regular file", path)
+	}
+	trackerFrom(ctx).setTotal(info.Size())
+
+	if _, err = io.Copy(w, f); err != nil {
+		return fmt.Errorf("failed to write the WASM file: %w", err)
+	}
+	return nil
+}
+
+// path returns the local path of the URL, after checking it's safe to read.
+func (d *fileDownloader) path() (string, error) {
+	u, err := url.Parse(d.url)
+	if err != nil {
+		return "", fmt.Errorf("invalid file URL: %w", err)
+	}
+	if u.Host != "" && u.Host != "localhost" {
+		return "", fmt.Errorf("file URL %s must not point to a remote host", d.url)
+	}
+	if u.RawQuery != "" || u.Fragment != "" {
+		return "", fmt.Errorf("file URL %s must not have a query or fragment", d.url)
+	}
+	path := localPath(u.Path)
+	if !filepath.IsAbs(path) {
+		return "", fmt.Errorf("file URL %s must have an absolute path", d.url)
+	}
+	for _, elem := range strings.Split(u.Path, "/") {
+		if elem == ".." {
+			return "", fmt.Errorf("file URL %s must not have parent directory references", d.url)
+		}
+	}
+	return path, nil
+}
+
+// localPath converts the path of a file URL to a local path. On Windows, the
+// path of file:///C:/mods/module.wasm is /C:/mods/module.wasm, so the slash
+// before the drive letter is removed.
+func localPath(urlPath string) string {
+	if len(urlPath) > 1 && urlPath[0] == '/' && filepath.VolumeName(urlPath[1:]) != "" {
+		urlPath = urlPath[1:]
+	}
+	return filepath.FromSlash(urlPath)
+}
+
+// checkRoots checks the file opened from path, described by info, is within
+// one of the roots if any.
+func (d *fileDownloader) checkRoots(path string, info os.FileInfo) error {
+	if len(d.roots) == 0 {
+		return nil
+	}
+
+	// symbolic links are resolved so they can't escape the roots
+	resolved, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return fmt.Errorf("failed to resolve WASM file path: %w", err)
+	}
+	if !d.withinRoots(resolved) {
+		return fmt.Errorf("file URL %s is outside of the allowed directories", d.url)
+	}
+	// the checked path must still lead to the opened file
+	resolvedInfo, err := os.Stat(resolved)
+	if err != nil || !os.SameFile(info, resolvedInfo) {
+		return fmt.Errorf("WASM file %s changed while being opened", path)
+	}
+	return nil
+}
+
+func (d *fileDownloader) withinRoots(path string) bool {
+	for _, root := range d.roots {
+		root, err := filepath.EvalSymlinks(root)
+		if err != nil {
+			continue
+		}
+		if rel, err := filepath.Rel(root, path); err == nil && filepath.IsLocal(rel) {
+			return true
+		}
+	}
+	return false
+}
+
+type dataDownloader struct {
+	url string
+}
+
+// newDataDownloader creates a downloader decoding a base64 encoded data: URL.
+func newDataDownloader(dataURL string) WASMDownloader {
+	return &dataDownloader{url: dataURL}
+}
+
+// Close for dataDownloader does nothing.
+func (d *dataDownloader) Close() error {
+	return nil
+}
+
+// DownloadWASM decodes the data of the URL and writes it to the given writer.
+func (d *dataDownloader) DownloadWASM(ctx context.Context, w io.Writer) error {
+	header, data, ok := strings.Cut(strings.TrimPrefix(d.url, "data:"), ",")
+	if !ok {
+		return fmt.Errorf("invalid data URL: missing comma")
+	}
+	if !strings.HasSuffix(header, ";base64") {
+		return fmt.Errorf("invalid data URL: only base64 encoded data is supported")
+	}
+	data, err := url.PathUnescape(data)
+	if err != nil {
+		return fmt.Errorf("invalid data URL: %w", err)
+	}
+	decoded, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		// padding is commonly omitted
+		decoded, err = base64.RawStdEncoding.DecodeString(strings.TrimRight(data, "="))
+		if err != nil {
+			return fmt.Errorf("failed to decode data URL: %w", err)
+		}
+	}
+	trackerFrom(ctx).setTotal(int64(len(decoded)))
+
+	if _, err = io.Copy(w, bytes.NewReader(decoded)); err != nil {
+		return fmt.Errorf("failed to write the WASM file: %w", err)
+	}
+	return nil
+}
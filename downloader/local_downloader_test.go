@@ -0,0 +1,211 @@
+package downloader
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fileURL returns the file URL of the path, such as file:///C:/module.wasm
+// for C:\module.wasm on Windows.
+func fileURL(path string) string {
+	path = filepath.ToSlash(path)
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	return "file://" + path
+}
+
+func TestFileDownloadWASM(t *testing.T) {
+	content := []byte("wasm")
+	root := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(root, "module.wasm"), content, 0o644))
+	outside := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(outside, "module.wasm"), content, 0o644))
+	require.NoError(t, os.Symlink(filepath.Join(outside, "module.wasm"), filepath.Join(root, "link.wasm")))
+
+	var tests = []struct {
+		name   string
+		url    string
+		roots  []string
+		assert func(t *testing.T, b []byte, err error)
+	}{
+		{
+			name:  "it should read a file within the roots",
+			url:   fileURL(filepath.Join(root, "module.wasm")),
+			roots: []string{root},
+			assert: func(t *testing.T, b []byte, err error) {
+				require.NoError(t, err)
+				assert.Equal(t, content, b)
+			},
+		},
+		{
+			name: "it should read any file without roots",
+			url:  fileURL(filepath.Join(outside, "module.wasm")),
+			assert: func(t *testing.T, b []byte, err error) {
+				require.NoError(t, err)
+				assert.Equal(t, content, b)
+			},
+		},
+		{
+			name:  "it should reject files outside of the roots",
+			url:   fileURL(filepath.Join(outside, "module.wasm")),
+			roots: []string{root},
+			assert: func(t *testing.T, b []byte, err error) {
+				assert.ErrorContains(t, err, "outside of the allowed directories")
+			},
+		},
+		{
+			name:  "it should reject symbolic links escaping the roots",
+			url:   fileURL(filepath.Join(root, "link.wasm")),
+			roots: []string{root},
+			assert: func(t *testing.T, b []byte, err error) {
+				assert.ErrorContains(t, err, "outside of the allowed directories")
+			},
+		},
+		{
+			name:  "it should reject parent directory references",
+			url:   fileURL(root) + "/../" + filepath.Base(outside) + "/module.wasm",
+			roots: []string{filepath.Dir(root)},
+			assert: func(t *testing.T, b []byte, err error) {
+				assert.ErrorContains(t, err, "parent directory references")
+			},
+		},
+		{
+			name: "it should reject remote hosts",
+			url:  "file://example.com/module.wasm",
+			assert: func(t *testing.T, b []byte, err error) {
+				assert.ErrorContains(t, err, "remote host")
+			},
+		},
+		{
+			name: "it should reject directories",
+			url:  fileURL(root),
+			assert: func(t *testing.T, b []byte, err error) {
+				assert.ErrorContains(t, err, "not a regular file")
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := new(bytes.Buffer)
+			err := newFileDownloader(tt.url, tt.roots).DownloadWASM(context.Background(), b)
+			tt.assert(t, b.Bytes(), err)
+		})
+	}
+}
+
+func TestLocalPath(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		assert.Equal(t, `C:\mods\module.wasm`, localPath("/C:/mods/module.wasm"))
+	} else {
+		assert.Equal(t, "/C:/mods/module.wasm", localPath("/C:/mods/module.wasm"))
+	}
+	assert.Equal(t, filepath.FromSlash("/mods/module.wasm"), localPath("/mods/module.wasm"))
+}
+
+func TestFileDownloaderCheckRoots(t *testing.T) {
+	root := t.TempDir()
+	path := filepath.Join(root, "module.wasm")
+	require.NoError(t, os.WriteFile(path, []byte("wasm"), 0o644))
+	other := filepath.Join(t.TempDir(), "module.wasm")
+	require.NoError(t, os.WriteFile(other, []byte("other"), 0o644))
+	d := &fileDownloader{url: fileURL(path), roots: []string{root}}
+
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.NoError(t, d.checkRoots(path, info))
+
+	// a file opened before the path was replaced doesn't match the path
+	otherInfo, err := os.Stat(other)
+	require.NoError(t, err)
+	assert.ErrorContains(t, d.checkRoots(path, otherInfo), "changed while being opened")
+}
+
+func TestDataDownloadWASM(t *testing.T) {
+	content := []byte("wasm module")
+	encoded := base64.StdEncoding.EncodeToString(content)
+
+	var tests = []struct {
+		name   string
+		url    string
+		assert func(t *testing.T, b []byte, err error)
+	}{
+		{
+			name: "it should decode base64 data",
+			url:  "data:application/wasm;base64," + encoded,
+			assert: func(t *testing.T, b []byte, err error) {
+				require.NoError(t, err)
+				assert.Equal(t, content, b)
+			},
+		},
+		{
+			name: "it should decode base64 data without padding",
+			url:  "data:;base64," + base64.RawStdEncoding.EncodeToString(content),
+			assert: func(t *testing.T, b []byte, err error) {
+				require.NoError(t, err)
+				assert.Equal(t, content, b)
+			},
+		},
+		{
+			name: "it should reject data not encoded with base64",
+			url:  "data:application/wasm,wasm",
+			assert: func(t *testing.T, b []byte, err error) {
+				assert.ErrorContains(t, err, "only base64")
+			},
+		},
+		{
+			name: "it should reject invalid base64 data",
+			url:  "data:;base64,!!!",
+			assert: func(t *testing.T, b []byte, err error) {
+				assert.ErrorContains(t, err, "failed to decode")
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := new(bytes.Buffer)
+			err := newDataDownloader(tt.url).DownloadWASM(context.Background(), b)
+			tt.assert(t, b.Bytes(), err)
+		})
+	}
+}
+
+func TestLocalURLsToggle(t *testing.T) {
+	content := []byte("wasm")
+	path := filepath.Join(t.TempDir(), "module.wasm")
+	require.NoError(t, os.WriteFile(path, content, 0o644))
+	urls := []string{fileURL(path), "data:;base64," + base64.StdEncoding.EncodeToString(content)}
+
+	t.Run("it should reject file and data URLs by default", func(t *testing.T) {
+		d, err := New(sum(content), urls)
+		require.NoError(t, err)
+		err = d.DownloadWASM(context.Background(), new(bytes.Buffer))
+		assert.ErrorContains(t, err, "file URLs are disabled")
+		assert.ErrorContains(t, err, "data URLs are disabled")
+	})
+
+	t.Run("it should accept enabled file and data URLs", func(t *testing.T) {
+		for i, url := range urls {
+			d, err := New(sum(content), []string{url}, WithFileURLs(i == 0, filepath.Dir(path)), WithDataURLs(i == 1))
+			require.NoError(t, err)
+			b := new(bytes.Buffer)
+			require.NoError(t, d.DownloadWASM(context.Background(), b))
+			assert.Equal(t, content, b.Bytes())
+		}
+	})
+
+	t.Run("it should verify the hash sum", func(t *testing.T) {
+		d, err := New("invalid", urls[1:], WithDataURLs(true))
+		require.NoError(t, err)
+		assert.ErrorIs(t, d.DownloadWASM(context.Background(), new(bytes.Buffer)), errHashMismatch)
+	})
+}
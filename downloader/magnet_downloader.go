@@ -5,36 +5,63 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"net"
+	"log/slog"
 	"net/http"
-	"os"
+	"net/url"
+	"strings"
+	"time"
 
 	"github.com/anacrolix/chansync/events"
 	"github.com/anacrolix/torrent"
+	"github.com/getlantern/lantern-water/tracing"
 )
 
+// webSeedInfoTimeout is how long to wait for the torrent metadata before
+// downloading the file straight from the web seeds, since they can't provide
+// the metadata of a magnet link.
+const webSeedInfoTimeout = 10 * time.Second
+
+// magnetDownloader downloads the torrent of a magnet link, or the one
+// described by spec when set, in which case magnetURL only names it.
 type magnetDownloader struct {
 	magnetURL string
+	spec      *torrent.TorrentSpec
 	client    torrentClient
+	tracer    tracing.Tracer
+
+	// httpClient and header are used for downloading from the web seeds when
+	// the metadata doesn't arrive within infoTimeout.
+	httpClient  *http.Client
+	header      http.Header
+	infoTimeout time.Duration
 }
 
-// newWaterMagnetDownloader creates a new WASMDownloader instance.
-func newMagnetDownloader(ctx context.Context, httpClient *http.Client, magnetURL string) (WASMDownloader, error) {
-	cfg, err := generateTorrentClientConfig(ctx, httpClient)
+// newWaterMagnetDownloader creates a new WASMDownloader instance, using the
+// shared torrent client of the config if any.
+func newMagnetDownloader(_ context.Context, magnetURL string, cfg SourceConfig) (WASMDownloader, error) {
+	client, err := newTorrentClient(cfg)
 	if err != nil {
 		return nil, err
 	}
-
-	client, err := torrent.NewClient(cfg)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create torrent client: %w", err)
-	}
 	return &magnetDownloader{
-		magnetURL: magnetURL,
-		client:    newTorrentCliWrapper(client),
+		magnetURL:   magnetURL,
+		client:      client,
+		tracer:      tracing.OrNop(cfg.Tracer),
+		httpClient:  cfg.TorrentHTTPClient,
+		header:      userAgentHeader(cfg.Header.Get("User-Agent")),
+		infoTimeout: webSeedInfoTimeout,
 	}, nil
 }
 
+// userAgentHeader returns the headers sent to web seeds.
+func userAgentHeader(userAgent string) http.Header {
+	header := make(http.Header)
+	if userAgent != "" {
+		header.Set("User-Agent", userAgent)
+	}
+	return header
+}
+
 // Close for magnetDownloader closes the torrent client.
 func (d *magnetDownloader) Close() error {
 	errs := d.client.Close()
@@ -48,28 +75,9 @@ func (d *magnetDownloader) Close() error {
 	return closeErr
 }
 
-type torrentCliWrapper struct {
-	client *torrent.Client
-}
-
-func newTorrentCliWrapper(client *torrent.Client) *torrentCliWrapper {
-	return &torrentCliWrapper{
-		client: client,
-	}
-}
-
-// AddMagnet for torrentCliWrapper adds a magnet URL to the torrent client.
-func (t *torrentCliWrapper) AddMagnet(magnetURL string) (torrentInfo, error) {
-	return t.client.AddMagnet(magnetURL)
-}
-
-// Close for torrentCliWrapper closes the torrent client.
-func (t *torrentCliWrapper) Close() []error {
-	return t.client.Close()
-}
-
 type torrentClient interface {
 	AddMagnet(string) (torrentInfo, error)
+	AddTorrentSpec(*torrent.TorrentSpec) (torrentInfo, error)
 	Close() []error
 }
 
@@ -78,46 +86,157 @@ type torrentInfo interface {
 	NewReader() torrent.Reader
 }
 
-func dialContext(ctx context.Context, network, addr string) (net.Conn, error) {
-	select {
-	case <-ctx.Done():
-		return nil, fmt.Errorf("context complete: %w", ctx.Err())
-	default:
-		return new(net.Dialer).DialContext(ctx, network, addr)
-	}
+// torrentStats is implemented by *torrent.Torrent and used for reporting the
+// progress when the torrentInfo supports it.
+type torrentStats interface {
+	Length() int64
+	Stats() torrent.TorrentStats
 }
 
-func generateTorrentClientConfig(ctx context.Context, httpClient *http.Client) (*torrent.ClientConfig, error) {
-	cfg := torrent.NewDefaultClientConfig()
-	path, err := os.MkdirTemp("", "lantern-water-module")
-	if err != nil {
-		return nil, fmt.Errorf("failed to create temp dir: %w", err)
-	}
-	cfg.DataDir = path
-	cfg.HTTPDialContext = dialContext
-	cfg.TrackerDialContext = dialContext
-	if httpClient != nil && httpClient.Transport != nil {
-		cfg.WebTransport = httpClient.Transport
-	}
-	return cfg, nil
-}
+// peersReportInterval is how often the number of peers is reported while
+// downloading a magnet link.
+const peersReportInterval = time.Second
 
 // DownloadWASM downloads the WASM file from the given URL.
 func (d *magnetDownloader) DownloadWASM(ctx context.Context, w io.Writer) error {
-	t, err := d.client.AddMagnet(d.magnetURL)
+	t, err := d.addTorrent()
 	if err != nil {
-		return fmt.Errorf("failed to add magnet: %w", err)
+		return err
+	}
+
+	tracker := trackerFrom(ctx)
+	stats, hasStats := t.(torrentStats)
+	if hasStats && tracker != nil {
+		stop, stopped := make(chan struct{}), make(chan struct{})
+		go func() {
+			defer close(stopped)
+			reportPeers(tracker, stats, stop)
+		}()
+		defer func() {
+			close(stop)
+			<-stopped
+		}()
+	}
+
+	// the torrent client downloads from the web seeds along with the peers
+	// once it has the metadata, but only the peers can provide it
+	name, webSeeds := d.webSeeds()
+	var infoTimeout <-chan time.Time
+	if len(webSeeds) > 0 {
+		timer := time.NewTimer(d.infoTimeout)
+		defer timer.Stop()
+		infoTimeout = timer.C
 	}
 
+	_, span := tracing.OrNop(d.tracer).Start(ctx, tracing.SpanTorrentInfo, slog.String(tracing.AttrURL, d.magnetURL))
 	select {
 	case <-t.GotInfo():
+		span.End(nil)
+		if hasStats {
+			tracker.setTotal(stats.Length())
+		}
+	case <-infoTimeout:
+		span.End(errNoTorrentInfo)
+		return d.downloadFromWebSeeds(ctx, name, webSeeds, w)
 	case <-ctx.Done():
-		return fmt.Errorf("context complete: %w", ctx.Err())
+		err = fmt.Errorf("context complete: %w", ctx.Err())
+		span.End(err)
+		return err
 	}
 
-	_, err = io.Copy(w, t.NewReader())
+	// the reader waits for pieces with its own context, so it's given ctx for
+	// the timeouts to abort the download
+	r := t.NewReader()
+	r.SetContext(ctx)
+	defer r.Close()
+	_, err = io.Copy(w, r)
 	if err != nil {
 		return fmt.Errorf("failed to copy torrent reader to writer: %w", err)
 	}
 	return nil
 }
+
+// addTorrent adds the torrent of the spec if set, or of the magnet link.
+func (d *magnetDownloader) addTorrent() (torrentInfo, error) {
+	if d.spec != nil {
+		t, err := d.client.AddTorrentSpec(d.spec)
+		if err != nil {
+			return nil, fmt.Errorf("failed to add torrent: %w", err)
+		}
+		return t, nil
+	}
+	t, err := d.client.AddMagnet(d.magnetURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to add magnet: %w", err)
+	}
+	return t, nil
+}
+
+// errNoTorrentInfo is recorded when the metadata didn't arrive in time and the
+// web seeds are used instead.
+var errNoTorrentInfo = errors.New("timed out waiting for torrent metadata")
+
+// webSeeds returns the name of the file and the web seeds of the torrent.
+func (d *magnetDownloader) webSeeds() (string, []string) {
+	if d.spec != nil {
+		return d.spec.DisplayName, d.spec.Webseeds
+	}
+	spec, err := torrent.TorrentSpecFromMagnetUri(d.magnetURL)
+	if err != nil {
+		return "", nil
+	}
+	return spec.DisplayName, spec.Webseeds
+}
+
+// downloadFromWebSeeds downloads the file from the web seeds over HTTP, trying
+// the next one until any data was written. As defined by BEP 19, the name of
+// the file is appended to the web seeds ending with a slash.
+func (d *magnetDownloader) downloadFromWebSeeds(ctx context.Context, name string, webSeeds []string, w io.Writer) error {
+	client := d.httpClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	cw := &countingWriter{w: w}
+	var errs []error
+	for _, webSeed := range webSeeds {
+		if strings.HasSuffix(webSeed, "/") {
+			webSeed += url.PathEscape(name)
+		}
+		err := newHTTPSDownloader(client, webSeed, d.header).DownloadWASM(ctx, cw)
+		if err == nil {
+			return nil
+		}
+		errs = append(errs, fmt.Errorf("web seed %s: %w", webSeed, err))
+		if cw.written > 0 || ctx.Err() != nil {
+			break
+		}
+	}
+	return fmt.Errorf("failed to download from web seeds: %w", errors.Join(errs...))
+}
+
+// countingWriter counts the bytes written to w.
+type countingWriter struct {
+	w       io.Writer
+	written int64
+}
+
+func (w *countingWriter) Write(b []byte) (int, error) {
+	n, err := w.w.Write(b)
+	w.written += int64(n)
+	return n, err
+}
+
+// reportPeers reports the number of active peers of the torrent until stop is
+// closed.
+func reportPeers(tracker *progressTracker, stats torrentStats, stop <-chan struct{}) {
+	ticker := time.NewTicker(peersReportInterval)
+	defer ticker.Stop()
+	for {
+		tracker.setPeers(stats.Stats().ActivePeers)
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
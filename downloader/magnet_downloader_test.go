@@ -5,9 +5,13 @@ import (
 	"context"
 	"io"
 	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"testing"
+	"time"
 
 	events "github.com/anacrolix/chansync/events"
+	"github.com/getlantern/lantern-water/tracing"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	gomock "go.uber.org/mock/gomock"
@@ -38,6 +42,8 @@ func TestMagnetDownloadWASM(t *testing.T) {
 					copy(p, []byte("hello world"))
 					return len(p), io.EOF
 				}).AnyTimes()
+				torrentReader.EXPECT().SetContext(gomock.Any())
+				torrentReader.EXPECT().Close().Return(nil)
 
 				torrentClient.EXPECT().AddMagnet(downloader.magnetURL).Return(torrentInfo, nil).Times(1)
 				done := make(chan struct{})
@@ -63,7 +69,7 @@ func TestMagnetDownloadWASM(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			downloader, err := newMagnetDownloader(tt.givenCtx, tt.givenHTTPClient, tt.givenMagnetURL)
+			downloader, err := newMagnetDownloader(tt.givenCtx, tt.givenMagnetURL, SourceConfig{TorrentHTTPClient: tt.givenHTTPClient})
 			require.NoError(t, err)
 			defer downloader.Close()
 			if tt.setup != nil {
@@ -79,3 +85,150 @@ func TestMagnetDownloadWASM(t *testing.T) {
 		})
 	}
 }
+
+func TestMagnetDownloadWASMTracing(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	recorder := tracing.NewRecorder()
+	torrentClient := NewMocktorrentClient(ctrl)
+	torrentInfo := NewMocktorrentInfo(ctrl)
+	torrentReader := NewMockReader(ctrl)
+	torrentReader.EXPECT().Read(gomock.Any()).Return(0, io.EOF).AnyTimes()
+	torrentReader.EXPECT().SetContext(gomock.Any())
+	torrentReader.EXPECT().Close().Return(nil)
+	torrentClient.EXPECT().AddMagnet("magnet:?xt=test").Return(torrentInfo, nil)
+	done := make(chan struct{})
+	close(done)
+	torrentInfo.EXPECT().GotInfo().Return(events.Done(done))
+	torrentInfo.EXPECT().NewReader().Return(torrentReader)
+
+	d := &magnetDownloader{magnetURL: "magnet:?xt=test", client: torrentClient, tracer: recorder}
+	require.NoError(t, d.DownloadWASM(context.Background(), new(bytes.Buffer)))
+
+	spans := recorder.SpansNamed(tracing.SpanTorrentInfo)
+	require.Len(t, spans, 1)
+	assert.NoError(t, spans[0].Err)
+	url, _ := spans[0].Attr(tracing.AttrURL)
+	assert.Equal(t, "magnet:?xt=test", url.String())
+}
+
+func TestMagnetDownloadWASMStalled(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	torrentClient := NewMocktorrentClient(ctrl)
+	torrentInfo := NewMocktorrentInfo(ctrl)
+	torrentReader := NewMockReader(ctrl)
+	torrentClient.EXPECT().AddMagnet("magnet:?xt=test").Return(torrentInfo, nil)
+	done := make(chan struct{})
+	close(done)
+	torrentInfo.EXPECT().GotInfo().Return(events.Done(done))
+	torrentInfo.EXPECT().NewReader().Return(torrentReader)
+	// the reader blocks like a stalled swarm until its context is done
+	var readerCtx context.Context
+	torrentReader.EXPECT().SetContext(gomock.Any()).Do(func(ctx context.Context) {
+		readerCtx = ctx
+	})
+	torrentReader.EXPECT().Read(gomock.Any()).DoAndReturn(func(p []byte) (int, error) {
+		<-readerCtx.Done()
+		return 0, readerCtx.Err()
+	})
+	torrentReader.EXPECT().Close().Return(nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	d := &magnetDownloader{magnetURL: "magnet:?xt=test", client: torrentClient}
+	errs := make(chan error, 1)
+	go func() {
+		errs <- d.DownloadWASM(ctx, new(bytes.Buffer))
+	}()
+	select {
+	case err := <-errs:
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+	case <-time.After(5 * time.Second):
+		t.Fatal("download didn't return at the timeout")
+	}
+}
+
+func TestMagnetDownloadWASMWebSeeds(t *testing.T) {
+	content := []byte("wasm")
+	var paths []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.Path)
+		if r.URL.Path == "/missing/module.wasm" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(content)
+	}))
+	defer srv.Close()
+
+	var tests = []struct {
+		name      string
+		magnetURL string
+		assert    func(t *testing.T, b []byte, err error)
+	}{
+		{
+			name:      "it should download from the web seeds without metadata",
+			magnetURL: "magnet:?xt=urn:btih:0000000000000000000000000000000000000000&dn=module.wasm&ws=" + url.QueryEscape(srv.URL+"/wasm/"),
+			assert: func(t *testing.T, b []byte, err error) {
+				require.NoError(t, err)
+				assert.Equal(t, content, b)
+				assert.Equal(t, []string{"/wasm/module.wasm"}, paths)
+			},
+		},
+		{
+			name: "it should try the next web seed on failure",
+			magnetURL: "magnet:?xt=urn:btih:0000000000000000000000000000000000000000&dn=module.wasm&ws=" +
+				url.QueryEscape(srv.URL+"/missing/") + "&ws=" + url.QueryEscape(srv.URL+"/file.wasm"),
+			assert: func(t *testing.T, b []byte, err error) {
+				require.NoError(t, err)
+				assert.Equal(t, content, b)
+				assert.Equal(t, []string{"/missing/module.wasm", "/file.wasm"}, paths)
+			},
+		},
+		{
+			name:      "it should fail when all the web seeds fail",
+			magnetURL: "magnet:?xt=urn:btih:0000000000000000000000000000000000000000&dn=module.wasm&ws=" + url.QueryEscape(srv.URL+"/missing/"),
+			assert: func(t *testing.T, b []byte, err error) {
+				assert.ErrorContains(t, err, "failed to download from web seeds")
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			paths = nil
+			ctrl := gomock.NewController(t)
+			torrentClient := NewMocktorrentClient(ctrl)
+			torrentInfo := NewMocktorrentInfo(ctrl)
+			torrentClient.EXPECT().AddMagnet(tt.magnetURL).Return(torrentInfo, nil)
+			// the metadata never arrives without peers
+			torrentInfo.EXPECT().GotInfo().Return(events.Done(make(chan struct{}))).AnyTimes()
+
+			d := &magnetDownloader{
+				magnetURL:   tt.magnetURL,
+				client:      torrentClient,
+				httpClient:  srv.Client(),
+				infoTimeout: 10 * time.Millisecond,
+			}
+			b := new(bytes.Buffer)
+			err := d.DownloadWASM(context.Background(), b)
+			tt.assert(t, b.Bytes(), err)
+		})
+	}
+
+	t.Run("it should keep waiting for the metadata without web seeds", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		torrentClient := NewMocktorrentClient(ctrl)
+		torrentInfo := NewMocktorrentInfo(ctrl)
+		torrentClient.EXPECT().AddMagnet(gomock.Any()).Return(torrentInfo, nil)
+		torrentInfo.EXPECT().GotInfo().Return(events.Done(make(chan struct{}))).AnyTimes()
+
+		d := &magnetDownloader{
+			magnetURL:   "magnet:?xt=urn:btih:0000000000000000000000000000000000000000",
+			client:      torrentClient,
+			infoTimeout: time.Millisecond,
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		err := d.DownloadWASM(ctx, new(bytes.Buffer))
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+	})
+}
@@ -110,6 +110,21 @@ func (mr *MocktorrentClientMockRecorder) AddMagnet(arg0 any) *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "AddMagnet", reflect.TypeOf((*MocktorrentClient)(nil).AddMagnet), arg0)
 }
 
+// AddTorrentSpec mocks base method.
+func (m *MocktorrentClient) AddTorrentSpec(arg0 *torrent.TorrentSpec) (torrentInfo, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "AddTorrentSpec", arg0)
+	ret0, _ := ret[0].(torrentInfo)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// AddTorrentSpec indicates an expected call of AddTorrentSpec.
+func (mr *MocktorrentClientMockRecorder) AddTorrentSpec(arg0 any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "AddTorrentSpec", reflect.TypeOf((*MocktorrentClient)(nil).AddTorrentSpec), arg0)
+}
+
 // Close mocks base method.
 func (m *MocktorrentClient) Close() []error {
 	m.ctrl.T.Helper()
@@ -0,0 +1,152 @@
+package downloader
+
+import (
+	"context"
+	"io"
+	"sync"
+)
+
+// Progress is a snapshot of a WASM download, reported to a ProgressFunc every
+// time it changes.
+type Progress struct {
+	// Source is the URL currently being downloaded.
+	Source string
+	// Attempt is the number of the attempt to download from Source,
+	// starting at 1 and increased on every retry.
+	Attempt int
+	// BytesReceived is the number of bytes received from Source so far.
+	BytesReceived int64
+	// TotalBytes is the size of the file when known from the Content-Length
+	// header or the torrent info, and -1 otherwise.
+	TotalBytes int64
+	// Peers is the number of active torrent peers, always zero for HTTPS
+	// sources.
+	Peers int
+	// Err is set when the attempt to download from Source failed. The
+	// source is retried or the next one, if any, is tried after reporting
+	// it.
+	Err error
+}
+
+// ProgressFunc observes the progress of a download. Calls for a single
+// download are serialized and it must not block.
+type ProgressFunc func(Progress)
+
+// WithProgress sets a function observing the progress of every download.
+func WithProgress(fn ProgressFunc) Option {
+	return func(d *downloader) {
+		d.progress = fn
+	}
+}
+
+type progressKey struct{}
+
+// ContextWithProgress returns a context making the downloaders report the
+// progress of the downloads made with it to fn, in addition to the function
+// given with WithProgress.
+func ContextWithProgress(ctx context.Context, fn ProgressFunc) context.Context {
+	return context.WithValue(ctx, progressKey{}, fn)
+}
+
+// progressTracker keeps the progress of an attempt to download from a source and
+// reports every change. A nil tracker reports nothing, so sources can update
+// it without checking whether progress is observed.
+type progressTracker struct {
+	observers []ProgressFunc
+
+	mu       sync.Mutex
+	progress Progress
+}
+
+// newProgressTracker returns a tracker reporting to fn and to the function
+// carried by ctx, or nil if there are none.
+func newProgressTracker(ctx context.Context, fn ProgressFunc, source string, attempt int) *progressTracker {
+	var observers []ProgressFunc
+	if fn != nil {
+		observers = append(observers, fn)
+	}
+	if fn, ok := ctx.Value(progressKey{}).(ProgressFunc); ok && fn != nil {
+		observers = append(observers, fn)
+	}
+	if len(observers) == 0 {
+		return nil
+	}
+	return &progressTracker{
+		observers: observers,
+		progress:  Progress{Source: source, Attempt: attempt, TotalBytes: -1},
+	}
+}
+
+type trackerKey struct{}
+
+// withTracker returns a context carrying the tracker, for the source
+// downloaders to report the total size and peers. A nil tracker hides the one
+// of ctx.
+func withTracker(ctx context.Context, t *progressTracker) context.Context {
+	return context.WithValue(ctx, trackerKey{}, t)
+}
+
+// trackerFrom returns the tracker carried by ctx, or nil.
+func trackerFrom(ctx context.Context) *progressTracker {
+	t, _ := ctx.Value(trackerKey{}).(*progressTracker)
+	return t
+}
+
+func (t *progressTracker) update(fn func(*Progress)) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	fn(&t.progress)
+	for _, observer := range t.observers {
+		observer(t.progress)
+	}
+}
+
+// start reports that the download from the source started.
+func (t *progressTracker) start() {
+	t.update(func(*Progress) {})
+}
+
+// received adds n to the bytes received.
+func (t *progressTracker) received(n int) {
+	t.update(func(p *Progress) { p.BytesReceived += int64(n) })
+}
+
+// setTotal sets the size of the file.
+func (t *progressTracker) setTotal(total int64) {
+	t.update(func(p *Progress) { p.TotalBytes = total })
+}
+
+// setPeers sets the number of active peers, reporting only changes.
+func (t *progressTracker) setPeers(peers int) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	changed := t.progress.Peers != peers
+	t.mu.Unlock()
+	if changed {
+		t.update(func(p *Progress) { p.Peers = peers })
+	}
+}
+
+// fail reports that the download from the source failed.
+func (t *progressTracker) fail(err error) {
+	t.update(func(p *Progress) { p.Err = err })
+}
+
+// progressWriter reports the bytes written through it to the tracker.
+type progressWriter struct {
+	w       io.Writer
+	tracker *progressTracker
+}
+
+func (w *progressWriter) Write(b []byte) (int, error) {
+	n, err := w.w.Write(b)
+	if n > 0 {
+		w.tracker.received(n)
+	}
+	return n, err
+}
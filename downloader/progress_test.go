@@ -0,0 +1,111 @@
+package downloader
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	events "github.com/anacrolix/chansync/events"
+	"github.com/anacrolix/torrent"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	gomock "go.uber.org/mock/gomock"
+)
+
+func TestDownloadWASMProgress(t *testing.T) {
+	content := []byte("hello world")
+	hashsum := fmt.Sprintf("%x", sha256.Sum256(content))
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(content)
+	}))
+	defer srv.Close()
+
+	var reported []Progress
+	var forwarded int
+	d, err := NewWASMDownloader(hashsum, []string{srv.URL + "/missing", srv.URL}, srv.Client(), WithProgress(func(p Progress) {
+		reported = append(reported, p)
+	}))
+	require.NoError(t, err)
+	ctx := ContextWithProgress(context.Background(), func(Progress) { forwarded++ })
+	require.NoError(t, d.DownloadWASM(ctx, new(bytes.Buffer)))
+
+	require.NotEmpty(t, reported)
+	assert.Equal(t, len(reported), forwarded)
+
+	var failure *Progress
+	for i, p := range reported {
+		if p.Err != nil {
+			failure = &reported[i]
+			break
+		}
+	}
+	require.NotNil(t, failure, "the failed source should be reported")
+	assert.Equal(t, srv.URL+"/missing", failure.Source)
+	assert.ErrorContains(t, failure.Err, "404")
+
+	last := reported[len(reported)-1]
+	assert.Equal(t, srv.URL, last.Source)
+	assert.NoError(t, last.Err)
+	assert.Equal(t, int64(len(content)), last.BytesReceived)
+	assert.Equal(t, int64(len(content)), last.TotalBytes)
+	assert.Zero(t, last.Peers)
+}
+
+// statsTorrentInfo is a torrentInfo reporting its length and peers.
+type statsTorrentInfo struct {
+	*MocktorrentInfo
+	length int64
+	peers  int
+}
+
+func (t *statsTorrentInfo) Length() int64 {
+	return t.length
+}
+
+func (t *statsTorrentInfo) Stats() torrent.TorrentStats {
+	var stats torrent.TorrentStats
+	stats.ActivePeers = t.peers
+	return stats
+}
+
+func TestMagnetDownloadWASMProgress(t *testing.T) {
+	content := []byte("hello world")
+	ctrl := gomock.NewController(t)
+	torrentClient := NewMocktorrentClient(ctrl)
+	info := &statsTorrentInfo{MocktorrentInfo: NewMocktorrentInfo(ctrl), length: int64(len(content)), peers: 3}
+	torrentClient.EXPECT().AddMagnet("magnet:?xt=test").Return(info, nil)
+	done := make(chan struct{})
+	close(done)
+	info.EXPECT().GotInfo().Return(events.Done(done))
+	torrentReader := NewMockReader(ctrl)
+	torrentReader.EXPECT().Read(gomock.Any()).DoAndReturn(func(p []byte) (int, error) {
+		return copy(p, content), io.EOF
+	})
+	torrentReader.EXPECT().SetContext(gomock.Any())
+	torrentReader.EXPECT().Close().Return(nil)
+	info.EXPECT().NewReader().Return(torrentReader)
+
+	var reported []Progress
+	tracker := newProgressTracker(context.Background(), func(p Progress) {
+		reported = append(reported, p)
+	}, "magnet:?xt=test", 1)
+	d := &magnetDownloader{magnetURL: "magnet:?xt=test", client: torrentClient}
+	w := &progressWriter{w: new(bytes.Buffer), tracker: tracker}
+	require.NoError(t, d.DownloadWASM(withTracker(context.Background(), tracker), w))
+
+	require.NotEmpty(t, reported)
+	last := reported[len(reported)-1]
+	assert.Equal(t, "magnet:?xt=test", last.Source)
+	assert.Equal(t, int64(len(content)), last.BytesReceived)
+	assert.Equal(t, int64(len(content)), last.TotalBytes)
+	assert.Equal(t, 3, last.Peers)
+}
@@ -0,0 +1,99 @@
+package downloader
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/getlantern/lantern-water/tracing"
+)
+
+// SourceConfig holds the settings of a downloader given to the source
+// factories.
+type SourceConfig struct {
+	// HTTPClient is the client for downloading from HTTPS mirrors.
+	HTTPClient *http.Client
+	// TorrentHTTPClient is the client for torrent trackers and web seeds.
+	TorrentHTTPClient *http.Client
+	// Header holds the headers sent to HTTP sources, including the
+	// User-Agent if set.
+	Header http.Header
+	// Tracer receives the spans of the source, never nil.
+	Tracer tracing.Tracer
+	// TorrentClient is the shared torrent client set with WithTorrentClient,
+	// or nil if every torrent download creates its own.
+	TorrentClient *TorrentClient
+}
+
+// SourceFactory creates a WASMDownloader for a URL of the scheme it was
+// registered for. The downloader is closed after every download.
+type SourceFactory func(ctx context.Context, url string, cfg SourceConfig) (WASMDownloader, error)
+
+var (
+	registryMu sync.RWMutex
+	registry   = map[string]SourceFactory{
+		"http":   httpsSource,
+		"https":  httpsSource,
+		"magnet": magnetSource,
+	}
+)
+
+// Register registers the factory of the downloaders for URLs with the given
+// scheme, such as "https", for all the WASMDownloaders. It replaces the
+// factory registered for the scheme if any, including the default ones for
+// http, https and magnet.
+func Register(scheme string, factory SourceFactory) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	registry[strings.ToLower(scheme)] = factory
+}
+
+// WithSource sets the factory of the downloaders for URLs with the given
+// scheme for this WASMDownloader only, overriding the registered one. A nil
+// factory disables the scheme.
+func WithSource(scheme string, factory SourceFactory) Option {
+	return func(d *downloader) {
+		d.sources[strings.ToLower(scheme)] = factory
+	}
+}
+
+func httpsSource(_ context.Context, url string, cfg SourceConfig) (WASMDownloader, error) {
+	if isTorrentFileURL(url) {
+		return newTorrentDownloader(url, TorrentSpec{MetainfoURL: url}, cfg), nil
+	}
+	return newHTTPSDownloader(cfg.HTTPClient, url, cfg.Header), nil
+}
+
+func magnetSource(ctx context.Context, url string, cfg SourceConfig) (WASMDownloader, error) {
+	return newMagnetDownloader(ctx, url, cfg)
+}
+
+// scheme returns the lower case scheme of the URL, or an empty string.
+func scheme(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return ""
+	}
+	return strings.ToLower(u.Scheme)
+}
+
+// source returns the factory for the URL, preferring the ones set for this
+// downloader. It returns an error if the scheme is unsupported or disabled.
+func (d *downloader) source(url string) (SourceFactory, error) {
+	scheme := scheme(url)
+	if factory, ok := d.sources[scheme]; ok {
+		if factory == nil {
+			return nil, fmt.Errorf("%s URLs are disabled", scheme)
+		}
+		return factory, nil
+	}
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	if factory, ok := registry[scheme]; ok && factory != nil {
+		return factory, nil
+	}
+	return nil, fmt.Errorf("unsupported protocol: %s", url)
+}
@@ -0,0 +1,91 @@
+package downloader
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"testing"
+
+	"github.com/getlantern/lantern-water/metrics"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// staticDownloader writes the same content on every download.
+type staticDownloader struct {
+	content []byte
+	closed  bool
+}
+
+func (d *staticDownloader) DownloadWASM(_ context.Context, w io.Writer) error {
+	_, err := w.Write(d.content)
+	return err
+}
+
+func (d *staticDownloader) Close() error {
+	d.closed = true
+	return nil
+}
+
+func TestSourceRegistry(t *testing.T) {
+	content := []byte("wasm")
+
+	t.Run("it should use the registered factories", func(t *testing.T) {
+		source := &staticDownloader{content: content}
+		var gotURL string
+		var gotCfg SourceConfig
+		Register("CONFIG", func(_ context.Context, url string, cfg SourceConfig) (WASMDownloader, error) {
+			gotURL, gotCfg = url, cfg
+			return source, nil
+		})
+		t.Cleanup(func() {
+			registryMu.Lock()
+			defer registryMu.Unlock()
+			delete(registry, "config")
+		})
+
+		recorder := metrics.NewExpvarRecorder()
+		client := new(http.Client)
+		d, err := New(sum(content), []string{"config://transports/test"}, WithHTTPClient(client), WithUserAgent("test"), WithMetrics(recorder))
+		require.NoError(t, err)
+		b := new(bytes.Buffer)
+		require.NoError(t, d.DownloadWASM(context.Background(), b))
+		assert.Equal(t, content, b.Bytes())
+		assert.True(t, source.closed)
+		assert.Equal(t, "config://transports/test", gotURL)
+		assert.Same(t, client, gotCfg.HTTPClient)
+		assert.Equal(t, "test", gotCfg.Header.Get("User-Agent"))
+		assert.NotNil(t, gotCfg.Tracer)
+		assert.Equal(t, float64(len(content)), recorder.Value(metrics.DownloadBytes, metrics.Labels{metrics.LabelSource: "config"}))
+	})
+
+	t.Run("it should override the registered factories per downloader", func(t *testing.T) {
+		override := func(context.Context, string, SourceConfig) (WASMDownloader, error) {
+			return &staticDownloader{content: content}, nil
+		}
+		d, err := New(sum(content), []string{"https://example.com/module.wasm"}, WithSource("https", override))
+		require.NoError(t, err)
+		b := new(bytes.Buffer)
+		require.NoError(t, d.DownloadWASM(context.Background(), b))
+		assert.Equal(t, content, b.Bytes())
+
+		registryMu.RLock()
+		defer registryMu.RUnlock()
+		assert.NotNil(t, registry["https"])
+	})
+
+	t.Run("it should disable schemes with a nil factory", func(t *testing.T) {
+		d, err := New(sum(content), []string{"magnet:?xt=urn:btih:test"}, WithSource("magnet", nil))
+		require.NoError(t, err)
+		err = d.DownloadWASM(context.Background(), new(bytes.Buffer))
+		assert.ErrorContains(t, err, "magnet URLs are disabled")
+	})
+
+	t.Run("it should reject unknown schemes", func(t *testing.T) {
+		d, err := New(sum(content), []string{"ftp://example.com/module.wasm"})
+		require.NoError(t, err)
+		err = d.DownloadWASM(context.Background(), new(bytes.Buffer))
+		assert.ErrorContains(t, err, "unsupported protocol")
+	})
+}
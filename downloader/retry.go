@@ -0,0 +1,217 @@
+package downloader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Errors reported when an attempt is aborted by the RetryPolicy timeouts.
+var (
+	ErrConnectTimeout   = errors.New("timed out connecting to the source")
+	ErrFirstByteTimeout = errors.New("timed out waiting for the first byte")
+	ErrStalled          = errors.New("download stalled")
+)
+
+// errHashMismatch is wrapped by the hash verification errors.
+var errHashMismatch = errors.New("hashsum verification failed")
+
+// StatusError is returned when an HTTPS source responds with a status other
+// than 200 OK.
+type StatusError struct {
+	StatusCode int
+	Status     string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("failed to download WASM file: %s", e.Status)
+}
+
+// RetryPolicy defines how long an attempt to download from a source may take
+// and how many times a source is retried. The zero value makes a single
+// attempt without timeouts.
+type RetryPolicy struct {
+	// ConnectTimeout limits the time taken to connect to HTTPS sources.
+	ConnectTimeout time.Duration
+	// FirstByteTimeout limits the time until the first byte of the file is
+	// received.
+	FirstByteTimeout time.Duration
+	// StallTimeout aborts an attempt when no bytes are received for that
+	// long after the first one.
+	StallTimeout time.Duration
+	// Retries is the number of times a source is retried after a retryable
+	// error, such as a 5xx status or a connection reset. Permanent errors,
+	// such as a 404 status or a hash sum mismatch, are never retried.
+	Retries int
+	// InitialBackoff is the delay before the first retry, which doubles for
+	// every following retry up to MaxBackoff. Each delay is randomized
+	// between half and all of it.
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+}
+
+// DefaultRetryPolicy returns a policy suitable for slow and unreliable
+// networks.
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		ConnectTimeout:   30 * time.Second,
+		FirstByteTimeout: time.Minute,
+		StallTimeout:     30 * time.Second,
+		Retries:          3,
+		InitialBackoff:   time.Second,
+		MaxBackoff:       30 * time.Second,
+	}
+}
+
+// WithRetryPolicy sets the policy applied to every source.
+func WithRetryPolicy(policy RetryPolicy) Option {
+	return func(d *downloader) {
+		d.retryPolicy = policy
+	}
+}
+
+func (p RetryPolicy) validate() error {
+	if p.ConnectTimeout < 0 || p.FirstByteTimeout < 0 || p.StallTimeout < 0 {
+		return fmt.Errorf("retry policy timeouts must not be negative")
+	}
+	if p.Retries < 0 || p.InitialBackoff < 0 || p.MaxBackoff < 0 {
+		return fmt.Errorf("retry policy retries and backoff must not be negative")
+	}
+	return nil
+}
+
+// backoff returns the randomized delay before the given retry, starting at 1.
+func (p RetryPolicy) backoff(retry int) time.Duration {
+	delay := p.InitialBackoff
+	for i := 1; i < retry && (p.MaxBackoff == 0 || delay < p.MaxBackoff); i++ {
+		delay *= 2
+	}
+	if p.MaxBackoff > 0 && delay > p.MaxBackoff {
+		delay = p.MaxBackoff
+	}
+	if delay <= 0 {
+		return 0
+	}
+	return delay/2 + rand.N(delay/2+1)
+}
+
+// wait waits for the delay before the given retry, returning early with an
+// error if ctx is done.
+func (p RetryPolicy) wait(ctx context.Context, retry int) error {
+	timer := time.NewTimer(p.backoff(retry))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("context complete: %w", ctx.Err())
+	}
+}
+
+// retryable reports whether an attempt failing with err may succeed if
+// repeated.
+func retryable(err error) bool {
+	if errors.Is(err, errHashMismatch) {
+		return false
+	}
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.StatusCode >= 500 ||
+			statusErr.StatusCode == http.StatusRequestTimeout ||
+			statusErr.StatusCode == http.StatusTooManyRequests
+	}
+	if errors.Is(err, ErrConnectTimeout) || errors.Is(err, ErrFirstByteTimeout) || errors.Is(err, ErrStalled) {
+		return true
+	}
+	// a host that doesn't resolve won't resolve on the next attempt either
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return dnsErr.IsTemporary || dnsErr.IsTimeout
+	}
+	if errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.ECONNABORTED) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// watchdog cancels an attempt when the RetryPolicy timeouts expire.
+type watchdog struct {
+	policy RetryPolicy
+	cancel context.CancelCauseFunc
+
+	mu        sync.Mutex
+	timer     *time.Timer
+	connected bool
+	received  bool
+}
+
+// newWatchdog returns a context canceled with the timeout error when the
+// connect, first byte or stall timeouts of the policy expire. The connect
+// timeout is applied to HTTP connections only. The returned function must be
+// called once the attempt is done.
+func newWatchdog(ctx context.Context, policy RetryPolicy, isHTTP bool) (context.Context, *watchdog, func()) {
+	ctx, cancel := context.WithCancelCause(ctx)
+	w := &watchdog{policy: policy, cancel: cancel}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	switch {
+	case isHTTP && policy.ConnectTimeout > 0:
+		ctx = httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+			GotConn: func(httptrace.GotConnInfo) { w.gotConn() },
+		})
+		w.timer = time.AfterFunc(policy.ConnectTimeout, func() { cancel(ErrConnectTimeout) })
+	case policy.FirstByteTimeout > 0:
+		w.timer = time.AfterFunc(policy.FirstByteTimeout, func() { cancel(ErrFirstByteTimeout) })
+	}
+	return ctx, w, func() {
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		if w.timer != nil {
+			w.timer.Stop()
+		}
+		cancel(nil)
+	}
+}
+
+// reset replaces the running timer.
+func (w *watchdog) reset(timeout time.Duration, cause error) {
+	if w.timer != nil {
+		w.timer.Stop()
+		w.timer = nil
+	}
+	if timeout > 0 {
+		w.timer = time.AfterFunc(timeout, func() { w.cancel(cause) })
+	}
+}
+
+func (w *watchdog) gotConn() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.connected || w.received {
+		return
+	}
+	w.connected = true
+	w.reset(w.policy.FirstByteTimeout, ErrFirstByteTimeout)
+}
+
+// Write restarts the stall timer every time bytes are received.
+func (w *watchdog) Write(b []byte) (int, error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.received = true
+	w.reset(w.policy.StallTimeout, ErrStalled)
+	return len(b), nil
+}
@@ -0,0 +1,221 @@
+package downloader
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/getlantern/lantern-water/metrics"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	policy := RetryPolicy{InitialBackoff: 100 * time.Millisecond, MaxBackoff: time.Second}
+	var tests = []struct {
+		retry    int
+		min, max time.Duration
+	}{
+		{retry: 1, min: 50 * time.Millisecond, max: 100 * time.Millisecond},
+		{retry: 2, min: 100 * time.Millisecond, max: 200 * time.Millisecond},
+		{retry: 3, min: 200 * time.Millisecond, max: 400 * time.Millisecond},
+		{retry: 10, min: 500 * time.Millisecond, max: time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("retry %d", tt.retry), func(t *testing.T) {
+			for range 100 {
+				delay := policy.backoff(tt.retry)
+				assert.GreaterOrEqual(t, delay, tt.min)
+				assert.LessOrEqual(t, delay, tt.max)
+			}
+		})
+	}
+	assert.Zero(t, RetryPolicy{}.backoff(1))
+}
+
+func TestRetryable(t *testing.T) {
+	var tests = []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{name: "5xx status", err: &StatusError{StatusCode: http.StatusBadGateway}, want: true},
+		{name: "429 status", err: &StatusError{StatusCode: http.StatusTooManyRequests}, want: true},
+		{name: "404 status", err: fmt.Errorf("wrapped: %w", &StatusError{StatusCode: http.StatusNotFound}), want: false},
+		{name: "hash mismatch", err: fmt.Errorf("%w, expected a, but got b", errHashMismatch), want: false},
+		{name: "connection reset", err: fmt.Errorf("failed to read: %w", syscall.ECONNRESET), want: true},
+		{name: "connection refused", err: &net.OpError{Op: "dial", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}, want: true},
+		{name: "permanent dial error", err: &net.OpError{Op: "dial", Err: assert.AnError}, want: false},
+		{name: "DNS timeout", err: &net.OpError{Op: "dial", Err: &net.DNSError{Err: "i/o timeout", IsTimeout: true}}, want: true},
+		{name: "temporary DNS error", err: &net.DNSError{Err: "server misbehaving", Name: "example.com", IsTemporary: true}, want: true},
+		{name: "unknown host", err: &net.OpError{Op: "dial", Err: &net.DNSError{Err: "no such host", Name: "example.invalid", IsNotFound: true}}, want: false},
+		{name: "stalled", err: fmt.Errorf("%w: context canceled", ErrStalled), want: true},
+		{name: "unsupported protocol", err: fmt.Errorf("unsupported protocol: udp://example.com"), want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, retryable(tt.err))
+		})
+	}
+}
+
+func TestDownloadWASMRetries(t *testing.T) {
+	content := []byte("content")
+	hashsum := fmt.Sprintf("%x", sha256.Sum256(content))
+	policy := RetryPolicy{Retries: 2, InitialBackoff: time.Millisecond, MaxBackoff: 10 * time.Millisecond}
+
+	var tests = []struct {
+		name         string
+		hashsum      string
+		policy       RetryPolicy
+		handler      func(attempt int32, w http.ResponseWriter, r *http.Request)
+		wantAttempts int32
+		assert       func(t *testing.T, err error)
+	}{
+		{
+			name:   "it should retry 5xx statuses until succeeding",
+			policy: policy,
+			handler: func(attempt int32, w http.ResponseWriter, r *http.Request) {
+				if attempt < 3 {
+					w.WriteHeader(http.StatusServiceUnavailable)
+					return
+				}
+				w.Write(content)
+			},
+			wantAttempts: 3,
+			assert: func(t *testing.T, err error) {
+				assert.NoError(t, err)
+			},
+		},
+		{
+			name:   "it should give up after the retries",
+			policy: policy,
+			handler: func(attempt int32, w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusInternalServerError)
+			},
+			wantAttempts: 3,
+			assert: func(t *testing.T, err error) {
+				var statusErr *StatusError
+				require.ErrorAs(t, err, &statusErr)
+				assert.Equal(t, http.StatusInternalServerError, statusErr.StatusCode)
+			},
+		},
+		{
+			name:   "it should not retry a 404 status",
+			policy: policy,
+			handler: func(attempt int32, w http.ResponseWriter, r *http.Request) {
+				http.NotFound(w, r)
+			},
+			wantAttempts: 1,
+			assert: func(t *testing.T, err error) {
+				assert.ErrorContains(t, err, "404")
+			},
+		},
+		{
+			name:    "it should not retry a hash mismatch",
+			hashsum: "invalid",
+			policy:  policy,
+			handler: func(attempt int32, w http.ResponseWriter, r *http.Request) {
+				w.Write(content)
+			},
+			wantAttempts: 1,
+			assert: func(t *testing.T, err error) {
+				assert.ErrorIs(t, err, errHashMismatch)
+			},
+		},
+		{
+			name: "it should retry a stalled download",
+			policy: RetryPolicy{
+				StallTimeout:   50 * time.Millisecond,
+				Retries:        1,
+				InitialBackoff: time.Millisecond,
+			},
+			handler: func(attempt int32, w http.ResponseWriter, r *http.Request) {
+				if attempt == 1 {
+					w.Header().Set("Content-Length", fmt.Sprint(len(content)))
+					w.Write(content[:1])
+					w.(http.Flusher).Flush()
+					<-r.Context().Done()
+					return
+				}
+				w.Write(content)
+			},
+			wantAttempts: 2,
+			assert: func(t *testing.T, err error) {
+				assert.NoError(t, err)
+			},
+		},
+		{
+			name:   "it should abort when the first byte takes too long",
+			policy: RetryPolicy{FirstByteTimeout: 50 * time.Millisecond},
+			handler: func(attempt int32, w http.ResponseWriter, r *http.Request) {
+				<-r.Context().Done()
+			},
+			wantAttempts: 1,
+			assert: func(t *testing.T, err error) {
+				assert.ErrorIs(t, err, ErrFirstByteTimeout)
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var attempts atomic.Int32
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				tt.handler(attempts.Add(1), w, r)
+			}))
+			defer srv.Close()
+
+			expectedHashSum := hashsum
+			if tt.hashsum != "" {
+				expectedHashSum = tt.hashsum
+			}
+			recorder := metrics.NewExpvarRecorder()
+			d, err := New(expectedHashSum, []string{srv.URL}, WithHTTPClient(srv.Client()), WithRetryPolicy(tt.policy), WithMetrics(recorder))
+			require.NoError(t, err)
+			err = d.DownloadWASM(context.Background(), new(bytes.Buffer))
+			tt.assert(t, err)
+			assert.Equal(t, tt.wantAttempts, attempts.Load())
+			assert.Equal(t, float64(tt.wantAttempts-1), recorder.Value(metrics.DownloadRetries, metrics.Labels{metrics.LabelSource: "https"}))
+		})
+	}
+}
+
+func TestDownloadWASMConnectTimeout(t *testing.T) {
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			<-ctx.Done()
+			return nil, ctx.Err()
+		},
+	}}
+	d, err := New("hashsum", []string{"http://example.com"}, WithHTTPClient(client), WithRetryPolicy(RetryPolicy{ConnectTimeout: 50 * time.Millisecond}))
+	require.NoError(t, err)
+	err = d.DownloadWASM(context.Background(), new(bytes.Buffer))
+	assert.ErrorIs(t, err, ErrConnectTimeout)
+}
+
+func TestDownloadWASMUnknownHost(t *testing.T) {
+	var dials atomic.Int32
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(context.Context, string, string) (net.Conn, error) {
+			dials.Add(1)
+			return nil, &net.OpError{Op: "dial", Net: "tcp", Err: &net.DNSError{Err: "no such host", Name: "example.invalid", IsNotFound: true}}
+		},
+	}}
+	policy := RetryPolicy{Retries: 2, InitialBackoff: time.Millisecond}
+	d, err := New("hashsum", []string{"http://example.invalid"}, WithHTTPClient(client), WithRetryPolicy(policy))
+	require.NoError(t, err)
+	err = d.DownloadWASM(context.Background(), new(bytes.Buffer))
+	var dnsErr *net.DNSError
+	require.ErrorAs(t, err, &dnsErr)
+	assert.True(t, dnsErr.IsNotFound)
+	assert.Equal(t, int32(1), dials.Load(), "unknown hosts should not be retried")
+}
@@ -0,0 +1,326 @@
+package downloader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/anacrolix/dht/v2"
+	"github.com/anacrolix/dht/v2/krpc"
+	"github.com/anacrolix/torrent"
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/anacrolix/torrent/storage"
+)
+
+// dhtNodesFile is the file of the data directory where the DHT routing table
+// is saved.
+const dhtNodesFile = "dht.nodes"
+
+// TorrentClientParams contain the parameters for creating a TorrentClient.
+type TorrentClientParams struct {
+	// DataDir is where the downloaded torrents and the DHT routing table are
+	// kept across sessions. If empty, a temporary directory removed on Close
+	// is used.
+	DataDir string
+	// MaxAge prunes the torrents of DataDir that weren't downloaded for this
+	// long when the client is created. If zero, the torrents are kept until
+	// the caller removes them, as every WASM file downloaded adds one.
+	MaxAge time.Duration
+	// HTTPClient is an optional client whose transport is used for trackers
+	// and web seeds.
+	HTTPClient *http.Client
+	// UserAgent is an optional User-Agent sent to trackers and web seeds.
+	UserAgent string
+}
+
+// TorrentClient is a BitTorrent client that can be shared by the magnet and
+// torrent downloads of several WASMDownloaders with WithTorrentClient, so they
+// don't start cold every time. Its lifecycle is owned by the caller, who must
+// close it once no download is using it anymore.
+type TorrentClient struct {
+	client  *torrent.Client
+	storage storage.ClientImplCloser
+	dataDir string
+	temp    bool
+
+	mu sync.Mutex
+	// refs counts the downloads using every torrent, which is dropped when
+	// none is left.
+	refs map[*torrent.Torrent]int
+}
+
+// NewTorrentClient creates a TorrentClient storing every torrent in a
+// directory named after its info hash within the data directory, and
+// bootstrapping the DHT with the routing table saved by the last session.
+// The torrents older than MaxAge are pruned first.
+func NewTorrentClient(params TorrentClientParams) (*TorrentClient, error) {
+	if params.MaxAge < 0 {
+		return nil, errors.New("torrent max age must not be negative")
+	}
+	dataDir, temp := params.DataDir, false
+	if dataDir == "" {
+		dir, err := os.MkdirTemp("", "lantern-water-module")
+		if err != nil {
+			return nil, fmt.Errorf("failed to create temp dir: %w", err)
+		}
+		dataDir, temp = dir, true
+	} else if err := os.MkdirAll(dataDir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create data dir: %w", err)
+	} else if params.MaxAge > 0 {
+		if err = pruneTorrents(dataDir, params.MaxAge); err != nil {
+			return nil, err
+		}
+	}
+
+	cfg := generateTorrentClientConfig(params.HTTPClient, params.UserAgent)
+	cfg.DataDir = dataDir
+	fileStorage := storage.NewFileOpts(storage.NewFileClientOpts{
+		ClientBaseDir: dataDir,
+		TorrentDirMaker: func(baseDir string, _ *metainfo.Info, infoHash metainfo.Hash) string {
+			return filepath.Join(baseDir, infoHash.HexString())
+		},
+	})
+	cfg.DefaultStorage = fileStorage
+
+	client, err := torrent.NewClient(cfg)
+	if err != nil {
+		err = errors.Join(err, fileStorage.Close())
+		if temp {
+			err = errors.Join(err, os.RemoveAll(dataDir))
+		}
+		return nil, fmt.Errorf("failed to create torrent client: %w", err)
+	}
+	c := &TorrentClient{
+		client:  client,
+		storage: fileStorage,
+		dataDir: dataDir,
+		temp:    temp,
+		refs:    make(map[*torrent.Torrent]int),
+	}
+	c.loadDHTNodes()
+	return c, nil
+}
+
+// pruneTorrents removes the torrent directories of the data directory last
+// modified longer than maxAge ago. The directory of a torrent is touched
+// whenever a download is done with it.
+func pruneTorrents(dataDir string, maxAge time.Duration) error {
+	entries, err := os.ReadDir(dataDir)
+	if err != nil {
+		return fmt.Errorf("failed to read data dir: %w", err)
+	}
+	var errs []error
+	for _, entry := range entries {
+		var h metainfo.Hash
+		if !entry.IsDir() || h.FromHexString(entry.Name()) != nil {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil || time.Since(info.ModTime()) < maxAge {
+			continue
+		}
+		if err = os.RemoveAll(filepath.Join(dataDir, entry.Name())); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("failed to prune torrents: %w", errors.Join(errs...))
+	}
+	return nil
+}
+
+// DataDir returns the directory where the torrents are stored.
+func (c *TorrentClient) DataDir() string {
+	return c.dataDir
+}
+
+// Close saves the DHT routing table and closes the client, removing the data
+// directory if it's temporary.
+func (c *TorrentClient) Close() error {
+	var errs []error
+	if !c.temp {
+		if err := c.saveDHTNodes(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	errs = append(errs, c.client.Close()...)
+	if err := c.storage.Close(); err != nil {
+		errs = append(errs, fmt.Errorf("failed to close torrent storage: %w", err))
+	}
+	if c.temp {
+		if err := os.RemoveAll(c.dataDir); err != nil {
+			errs = append(errs, fmt.Errorf("failed to remove temp dir: %w", err))
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("failed to close torrent client: %w", errors.Join(errs...))
+	}
+	return nil
+}
+
+// dhtServers returns the DHT servers of the client.
+func (c *TorrentClient) dhtServers() []*dht.Server {
+	var servers []*dht.Server
+	for _, s := range c.client.DhtServers() {
+		if w, ok := s.(torrent.AnacrolixDhtServerWrapper); ok {
+			servers = append(servers, w.Server)
+		}
+	}
+	return servers
+}
+
+// loadDHTNodes adds the nodes saved by the last session to the DHT servers.
+// Nodes of the wrong address family are ignored by the servers.
+func (c *TorrentClient) loadDHTNodes() {
+	nodes, err := dht.ReadNodesFromFile(filepath.Join(c.dataDir, dhtNodesFile))
+	if err != nil {
+		return
+	}
+	for _, s := range c.dhtServers() {
+		for _, node := range nodes {
+			_ = s.AddNode(node)
+		}
+	}
+}
+
+// saveDHTNodes saves the nodes of the DHT servers for the next session.
+func (c *TorrentClient) saveDHTNodes() error {
+	var nodes []krpc.NodeInfo
+	for _, s := range c.dhtServers() {
+		nodes = append(nodes, s.Nodes()...)
+	}
+	if len(nodes) == 0 {
+		return nil
+	}
+	if err := dht.WriteNodesToFile(nodes, filepath.Join(c.dataDir, dhtNodesFile)); err != nil {
+		return fmt.Errorf("failed to save DHT nodes: %w", err)
+	}
+	return nil
+}
+
+// session returns a torrentClient for a single download, which closes the
+// client too when owned.
+func (c *TorrentClient) session(owned bool) torrentClient {
+	return &torrentCliWrapper{client: c, owned: owned}
+}
+
+// acquire counts a download using the torrent.
+func (c *TorrentClient) acquire(t *torrent.Torrent) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.refs[t]++
+}
+
+// release drops the torrent once no download is using it. Its data is kept in
+// the data directory, so downloading it again only verifies it, and its
+// directory is touched so it's pruned after MaxAge only.
+func (c *TorrentClient) release(t *torrent.Torrent) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.refs[t]--; c.refs[t] > 0 {
+		return
+	}
+	delete(c.refs, t)
+	t.Drop()
+	now := time.Now()
+	// the directory doesn't exist if no data was downloaded
+	_ = os.Chtimes(filepath.Join(c.dataDir, t.InfoHash().HexString()), now, now)
+}
+
+// torrentCliWrapper is the torrentClient of a single download, releasing the
+// torrents it added on Close.
+type torrentCliWrapper struct {
+	client   *TorrentClient
+	owned    bool
+	torrents []*torrent.Torrent
+}
+
+// AddMagnet for torrentCliWrapper adds a magnet URL to the torrent client.
+func (t *torrentCliWrapper) AddMagnet(magnetURL string) (torrentInfo, error) {
+	tor, err := t.client.client.AddMagnet(magnetURL)
+	if err != nil {
+		return nil, err
+	}
+	t.add(tor)
+	return tor, nil
+}
+
+// AddTorrentSpec for torrentCliWrapper adds a torrent spec to the torrent
+// client.
+func (t *torrentCliWrapper) AddTorrentSpec(spec *torrent.TorrentSpec) (torrentInfo, error) {
+	tor, _, err := t.client.client.AddTorrentSpec(spec)
+	if err != nil {
+		return nil, err
+	}
+	t.add(tor)
+	return tor, nil
+}
+
+func (t *torrentCliWrapper) add(tor *torrent.Torrent) {
+	t.client.acquire(tor)
+	t.torrents = append(t.torrents, tor)
+}
+
+// Close for torrentCliWrapper releases the torrents of the download, and
+// closes the torrent client if owned.
+func (t *torrentCliWrapper) Close() []error {
+	for _, tor := range t.torrents {
+		t.client.release(tor)
+	}
+	t.torrents = nil
+	if !t.owned {
+		return nil
+	}
+	if err := t.client.Close(); err != nil {
+		return []error{err}
+	}
+	return nil
+}
+
+// newTorrentClient returns the torrentClient of a download, using the shared
+// TorrentClient of the config if any, or a new one with a temporary data
+// directory otherwise.
+func newTorrentClient(cfg SourceConfig) (torrentClient, error) {
+	if cfg.TorrentClient != nil {
+		return cfg.TorrentClient.session(false), nil
+	}
+	client, err := NewTorrentClient(TorrentClientParams{
+		HTTPClient: cfg.TorrentHTTPClient,
+		UserAgent:  cfg.Header.Get("User-Agent"),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return client.session(true), nil
+}
+
+func dialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	select {
+	case <-ctx.Done():
+		return nil, fmt.Errorf("context complete: %w", ctx.Err())
+	default:
+		return new(net.Dialer).DialContext(ctx, network, addr)
+	}
+}
+
+func generateTorrentClientConfig(httpClient *http.Client, userAgent string) *torrent.ClientConfig {
+	cfg := torrent.NewDefaultClientConfig()
+	// downloads don't need a well known port, and the default one may be in
+	// use by a seeder or a previous download still releasing it
+	cfg.ListenPort = 0
+	cfg.HTTPDialContext = dialContext
+	cfg.TrackerDialContext = dialContext
+	if httpClient != nil && httpClient.Transport != nil {
+		cfg.WebTransport = httpClient.Transport
+	}
+	if userAgent != "" {
+		cfg.HTTPUserAgent = userAgent
+	}
+	return cfg
+}
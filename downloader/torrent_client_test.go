@@ -0,0 +1,157 @@
+package downloader
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/anacrolix/dht/v2"
+	"github.com/anacrolix/dht/v2/krpc"
+	"github.com/anacrolix/torrent"
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTorrentClientLifecycle(t *testing.T) {
+	t.Run("it should remove the temporary data dir on close", func(t *testing.T) {
+		c, err := NewTorrentClient(TorrentClientParams{})
+		require.NoError(t, err)
+		require.DirExists(t, c.DataDir())
+		require.NoError(t, c.Close())
+		assert.NoDirExists(t, c.DataDir())
+	})
+
+	t.Run("it should keep the DHT nodes across sessions", func(t *testing.T) {
+		dir := filepath.Join(t.TempDir(), "torrents")
+		c, err := NewTorrentClient(TorrentClientParams{DataDir: dir})
+		require.NoError(t, err)
+		servers := c.dhtServers()
+		require.NotEmpty(t, servers)
+		ip := net.ParseIP("192.0.2.1").To4()
+		node := krpc.NodeInfo{ID: dht.RandomNodeID(), Addr: krpc.NodeAddr{IP: ip, Port: 6881}}
+		dht.SecureNodeId(&node.ID, ip)
+		for _, s := range servers {
+			_ = s.AddNode(node)
+		}
+		require.NoError(t, c.Close())
+		assert.DirExists(t, dir)
+		assert.FileExists(t, filepath.Join(dir, dhtNodesFile))
+
+		c, err = NewTorrentClient(TorrentClientParams{DataDir: dir})
+		require.NoError(t, err)
+		defer c.Close()
+		var found bool
+		for _, s := range c.dhtServers() {
+			for _, n := range s.Nodes() {
+				found = found || n.ID == node.ID
+			}
+		}
+		assert.True(t, found)
+	})
+
+	t.Run("it should prune the torrents older than the max age", func(t *testing.T) {
+		dir := t.TempDir()
+		old := time.Now().Add(-2 * time.Hour)
+		mkdir := func(name string, modTime time.Time) string {
+			path := filepath.Join(dir, name)
+			require.NoError(t, os.Mkdir(path, 0o755))
+			require.NoError(t, os.Chtimes(path, modTime, modTime))
+			return path
+		}
+		oldTorrent := mkdir("0123456789012345678901234567890123456789", old)
+		recentTorrent := mkdir("2123456789012345678901234567890123456789", time.Now())
+		other := mkdir("other", old)
+
+		c, err := NewTorrentClient(TorrentClientParams{DataDir: dir, MaxAge: time.Hour})
+		require.NoError(t, err)
+		assert.NoDirExists(t, oldTorrent)
+		assert.DirExists(t, recentTorrent)
+		assert.DirExists(t, other)
+
+		// a download touches the torrent directory, so it's kept longer
+		released := mkdir("1123456789012345678901234567890123456789", old)
+		s := c.session(false)
+		spec := &torrent.TorrentSpec{AddTorrentOpts: torrent.AddTorrentOpts{InfoHash: metainfo.NewHashFromHex(filepath.Base(released))}}
+		_, err = s.AddTorrentSpec(spec)
+		require.NoError(t, err)
+		assert.Empty(t, s.Close())
+		require.NoError(t, c.Close())
+
+		c, err = NewTorrentClient(TorrentClientParams{DataDir: dir, MaxAge: time.Hour})
+		require.NoError(t, err)
+		defer c.Close()
+		assert.DirExists(t, released)
+	})
+
+	t.Run("it should reject a negative max age", func(t *testing.T) {
+		_, err := NewTorrentClient(TorrentClientParams{DataDir: t.TempDir(), MaxAge: -time.Hour})
+		assert.Error(t, err)
+	})
+}
+
+func TestTorrentClientSessions(t *testing.T) {
+	c, err := NewTorrentClient(TorrentClientParams{})
+	require.NoError(t, err)
+	defer c.Close()
+
+	spec := &torrent.TorrentSpec{AddTorrentOpts: torrent.AddTorrentOpts{InfoHash: metainfo.NewHashFromHex("0123456789012345678901234567890123456789")}}
+	first, second := c.session(false), c.session(false)
+	info, err := first.AddTorrentSpec(spec)
+	require.NoError(t, err)
+	_, err = second.AddTorrentSpec(spec)
+	require.NoError(t, err)
+	tor := info.(*torrent.Torrent)
+
+	assert.Empty(t, first.Close())
+	select {
+	case <-tor.Closed():
+		t.Fatal("the torrent was dropped while still used")
+	default:
+	}
+	assert.Empty(t, second.Close())
+	select {
+	case <-tor.Closed():
+	case <-time.After(time.Second):
+		t.Fatal("the torrent wasn't dropped")
+	}
+	assert.Empty(t, c.client.Torrents())
+}
+
+func TestDownloadWASMWithTorrentClient(t *testing.T) {
+	content := bytes.Repeat([]byte("wasm"), 16*1024)
+	metainfoBytes, peer := newTestSeeder(t, content)
+	mi, err := metainfo.Load(bytes.NewReader(metainfoBytes))
+	require.NoError(t, err)
+
+	dir := t.TempDir()
+	c, err := NewTorrentClient(TorrentClientParams{DataDir: dir})
+	require.NoError(t, err)
+	defer c.Close()
+
+	download := func(spec TorrentSpec) error {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		d, err := New(sum(content), nil, WithTorrentClient(c), WithTorrent(spec))
+		require.NoError(t, err)
+		defer d.Close()
+		b := new(bytes.Buffer)
+		if err := d.DownloadWASM(ctx, b); err != nil {
+			return err
+		}
+		assert.Equal(t, content, b.Bytes())
+		return nil
+	}
+	require.NoError(t, download(TorrentSpec{Metainfo: metainfoBytes, Peers: []string{peer}}))
+	stored, err := os.ReadFile(filepath.Join(dir, mi.HashInfoBytes().HexString(), "module.wasm"))
+	require.NoError(t, err)
+	assert.Equal(t, content, stored)
+
+	// the stored data is used again without any peer
+	require.NoError(t, download(TorrentSpec{Metainfo: metainfoBytes}))
+	assert.Empty(t, c.client.Torrents())
+}
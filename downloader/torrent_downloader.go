@@ -0,0 +1,190 @@
+package downloader
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/anacrolix/torrent"
+	"github.com/anacrolix/torrent/metainfo"
+)
+
+// maxMetainfoSize limits the size of the .torrent files downloaded from HTTPS
+// URLs.
+const maxMetainfoSize = 4 << 20
+
+// TorrentSpec describes a torrent to download the WASM file from without
+// going through a magnet link, either with its metadata already in hand or
+// with explicit trackers and peers.
+type TorrentSpec struct {
+	// Metainfo is a bencoded .torrent file. The download starts with its
+	// metadata, so it doesn't have to be found through peers or DHT.
+	Metainfo []byte
+	// MetainfoURL is the HTTPS URL of a .torrent file, downloaded when
+	// Metainfo is empty.
+	MetainfoURL string
+	// InfoHash is the hex encoded info hash of the torrent. It's required
+	// without metainfo, and must match it otherwise.
+	InfoHash string
+	// Trackers are announce URLs added to the ones of the metainfo.
+	Trackers []string
+	// Peers are "host:port" addresses of peers to connect to right away.
+	Peers []string
+	// WebSeeds are BEP 19 HTTP web seeds added to the ones of the metainfo.
+	WebSeeds []string
+}
+
+// WithTorrent adds a torrent as a source, tried after the URLs. Its progress
+// and metrics are reported for a "torrent:<info hash>" URL, or
+// "torrent:<metainfo URL>" if the info hash isn't known.
+func WithTorrent(spec TorrentSpec) Option {
+	return func(d *downloader) {
+		d.torrents = append(d.torrents, spec)
+	}
+}
+
+// validate checks the spec can be converted without downloading anything,
+// returning the URL naming it.
+func (s TorrentSpec) validate() (string, error) {
+	if len(s.Metainfo) == 0 && s.MetainfoURL != "" {
+		if s.InfoHash != "" {
+			return "torrent:" + strings.ToLower(s.InfoHash), nil
+		}
+		return "torrent:" + s.MetainfoURL, nil
+	}
+	spec, err := s.torrentSpec()
+	if err != nil {
+		return "", err
+	}
+	return "torrent:" + spec.InfoHash.HexString(), nil
+}
+
+// torrentSpec converts the spec into the one of the torrent client, once the
+// metainfo was downloaded if needed.
+func (s TorrentSpec) torrentSpec() (*torrent.TorrentSpec, error) {
+	var spec *torrent.TorrentSpec
+	if len(s.Metainfo) > 0 {
+		var err error
+		if spec, err = parseMetainfo(s.Metainfo); err != nil {
+			return nil, err
+		}
+		if s.InfoHash != "" && !strings.EqualFold(s.InfoHash, spec.InfoHash.HexString()) {
+			return nil, fmt.Errorf("info hash %s doesn't match the metainfo one %s", s.InfoHash, spec.InfoHash.HexString())
+		}
+	} else {
+		var infoHash metainfo.Hash
+		if err := infoHash.FromHexString(s.InfoHash); err != nil {
+			return nil, fmt.Errorf("invalid info hash %q: %w", s.InfoHash, err)
+		}
+		spec = &torrent.TorrentSpec{AddTorrentOpts: torrent.AddTorrentOpts{InfoHash: infoHash}}
+	}
+	if len(s.Trackers) > 0 {
+		spec.Trackers = append(spec.Trackers, s.Trackers)
+	}
+	spec.PeerAddrs = append(spec.PeerAddrs, s.Peers...)
+	spec.Webseeds = append(spec.Webseeds, s.WebSeeds...)
+	return spec, nil
+}
+
+// parseMetainfo parses a bencoded .torrent file.
+func parseMetainfo(b []byte) (*torrent.TorrentSpec, error) {
+	mi, err := metainfo.Load(bytes.NewReader(b))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse metainfo: %w", err)
+	}
+	spec, err := torrent.TorrentSpecFromMetaInfoErr(mi)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse metainfo: %w", err)
+	}
+	return spec, nil
+}
+
+// torrentSources returns the URLs naming the torrents and the source factory
+// downloading them.
+func torrentSources(torrents []TorrentSpec) ([]string, SourceFactory, error) {
+	urls := make([]string, 0, len(torrents))
+	specs := make(map[string]TorrentSpec, len(torrents))
+	for _, spec := range torrents {
+		url, err := spec.validate()
+		if err != nil {
+			return nil, nil, err
+		}
+		if _, ok := specs[url]; ok {
+			return nil, nil, fmt.Errorf("duplicated torrent: %s", url)
+		}
+		urls = append(urls, url)
+		specs[url] = spec
+	}
+	factory := func(_ context.Context, url string, cfg SourceConfig) (WASMDownloader, error) {
+		spec, ok := specs[url]
+		if !ok {
+			return nil, fmt.Errorf("unknown torrent: %s", url)
+		}
+		return newTorrentDownloader(url, spec, cfg), nil
+	}
+	return urls, factory, nil
+}
+
+// isTorrentFileURL reports whether the URL points to a .torrent file.
+func isTorrentFileURL(rawURL string) bool {
+	u, err := url.Parse(rawURL)
+	return err == nil && strings.EqualFold(path.Ext(u.Path), ".torrent")
+}
+
+type torrentDownloader struct {
+	url  string
+	spec TorrentSpec
+	cfg  SourceConfig
+}
+
+// newTorrentDownloader creates a downloader for the torrent spec, named by
+// the URL in spans.
+func newTorrentDownloader(url string, spec TorrentSpec, cfg SourceConfig) WASMDownloader {
+	return &torrentDownloader{url: url, spec: spec, cfg: cfg}
+}
+
+// Close for torrentDownloader does nothing, the torrent client is released
+// after every download.
+func (d *torrentDownloader) Close() error {
+	return nil
+}
+
+// DownloadWASM downloads the .torrent file if needed and then the WASM file
+// it describes.
+func (d *torrentDownloader) DownloadWASM(ctx context.Context, w io.Writer) error {
+	spec := d.spec
+	if len(spec.Metainfo) == 0 && spec.MetainfoURL != "" {
+		// the .torrent file isn't reported as progress nor decompressed
+		metaCtx := withDecoder(withTracker(ctx, nil), nil)
+		buf := new(bytes.Buffer)
+		err := newHTTPSDownloader(d.cfg.HTTPClient, spec.MetainfoURL, d.cfg.Header).DownloadWASM(metaCtx, &limitWriter{w: buf, max: maxMetainfoSize})
+		if err != nil {
+			return fmt.Errorf("failed to download metainfo: %w", err)
+		}
+		spec.Metainfo = buf.Bytes()
+	}
+	torrentSpec, err := spec.torrentSpec()
+	if err != nil {
+		return err
+	}
+
+	client, err := newTorrentClient(d.cfg)
+	if err != nil {
+		return err
+	}
+	downloader := &magnetDownloader{
+		magnetURL:   d.url,
+		spec:        torrentSpec,
+		client:      client,
+		tracer:      d.cfg.Tracer,
+		httpClient:  d.cfg.TorrentHTTPClient,
+		header:      userAgentHeader(d.cfg.Header.Get("User-Agent")),
+		infoTimeout: webSeedInfoTimeout,
+	}
+	defer downloader.Close()
+	return downloader.DownloadWASM(ctx, w)
+}
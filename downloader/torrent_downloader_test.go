@@ -0,0 +1,214 @@
+package downloader
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	events "github.com/anacrolix/chansync/events"
+	"github.com/anacrolix/torrent"
+	"github.com/anacrolix/torrent/bencode"
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	gomock "go.uber.org/mock/gomock"
+)
+
+// newTestSeeder seeds content from a local torrent client without DHT nor
+// trackers, returning the bencoded metainfo and the address of the client.
+func newTestSeeder(t *testing.T, content []byte) ([]byte, string) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "module.wasm"), content, 0o644))
+
+	info := metainfo.Info{PieceLength: 16 * 1024}
+	require.NoError(t, info.BuildFromFilePath(filepath.Join(dir, "module.wasm")))
+	infoBytes, err := bencode.Marshal(info)
+	require.NoError(t, err)
+	mi := &metainfo.MetaInfo{InfoBytes: infoBytes}
+	b := new(bytes.Buffer)
+	require.NoError(t, mi.Write(b))
+
+	cfg := torrent.NewDefaultClientConfig()
+	cfg.DataDir = dir
+	cfg.Seed = true
+	cfg.NoDHT = true
+	cfg.DisableTrackers = true
+	cfg.DisableIPv6 = true
+	cfg.ListenHost = func(string) string { return "127.0.0.1" }
+	cfg.ListenPort = 0
+	client, err := torrent.NewClient(cfg)
+	require.NoError(t, err)
+	t.Cleanup(func() { client.Close() })
+	tor, err := client.AddTorrent(mi)
+	require.NoError(t, err)
+	<-tor.GotInfo()
+	require.NoError(t, tor.VerifyDataContext(context.Background()))
+
+	return b.Bytes(), fmt.Sprintf("127.0.0.1:%d", client.LocalPort())
+}
+
+func TestTorrentSpec(t *testing.T) {
+	content := []byte("wasm")
+	metainfoBytes, _ := newTestSeeder(t, content)
+	mi, err := metainfo.Load(bytes.NewReader(metainfoBytes))
+	require.NoError(t, err)
+	infoHash := mi.HashInfoBytes().HexString()
+
+	var tests = []struct {
+		name   string
+		spec   TorrentSpec
+		assert func(t *testing.T, spec *torrent.TorrentSpec, err error)
+	}{
+		{
+			name: "it should use the metadata of the metainfo",
+			spec: TorrentSpec{Metainfo: metainfoBytes, Trackers: []string{"udp://tracker"}, Peers: []string{"127.0.0.1:1"}},
+			assert: func(t *testing.T, spec *torrent.TorrentSpec, err error) {
+				require.NoError(t, err)
+				assert.Equal(t, infoHash, spec.InfoHash.HexString())
+				assert.Equal(t, []byte(mi.InfoBytes), spec.InfoBytes)
+				assert.Contains(t, spec.Trackers, []string{"udp://tracker"})
+				assert.Equal(t, []string{"127.0.0.1:1"}, spec.PeerAddrs)
+			},
+		},
+		{
+			name: "it should accept a bare info hash",
+			spec: TorrentSpec{InfoHash: infoHash, Peers: []string{"127.0.0.1:1"}},
+			assert: func(t *testing.T, spec *torrent.TorrentSpec, err error) {
+				require.NoError(t, err)
+				assert.Equal(t, infoHash, spec.InfoHash.HexString())
+				assert.Empty(t, spec.InfoBytes)
+				assert.Equal(t, []string{"127.0.0.1:1"}, spec.PeerAddrs)
+			},
+		},
+		{
+			name: "it should reject an info hash not matching the metainfo",
+			spec: TorrentSpec{Metainfo: metainfoBytes, InfoHash: "0000000000000000000000000000000000000000"},
+			assert: func(t *testing.T, spec *torrent.TorrentSpec, err error) {
+				assert.ErrorContains(t, err, "doesn't match")
+			},
+		},
+		{
+			name: "it should reject an invalid info hash",
+			spec: TorrentSpec{InfoHash: "invalid"},
+			assert: func(t *testing.T, spec *torrent.TorrentSpec, err error) {
+				assert.ErrorContains(t, err, "invalid info hash")
+			},
+		},
+		{
+			name: "it should reject invalid metainfo",
+			spec: TorrentSpec{Metainfo: []byte("invalid")},
+			assert: func(t *testing.T, spec *torrent.TorrentSpec, err error) {
+				assert.ErrorContains(t, err, "failed to parse metainfo")
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			spec, err := tt.spec.torrentSpec()
+			tt.assert(t, spec, err)
+		})
+	}
+}
+
+func TestTorrentDownloadWASMAddsSpec(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	torrentClient := NewMocktorrentClient(ctrl)
+	torrentInfo := NewMocktorrentInfo(ctrl)
+	torrentReader := NewMockReader(ctrl)
+	spec := &torrent.TorrentSpec{PeerAddrs: []string{"127.0.0.1:1"}}
+	torrentClient.EXPECT().AddTorrentSpec(spec).Return(torrentInfo, nil)
+	done := make(chan struct{})
+	close(done)
+	torrentInfo.EXPECT().GotInfo().Return(events.Done(done))
+	torrentInfo.EXPECT().NewReader().Return(torrentReader)
+	torrentReader.EXPECT().Read(gomock.Any()).DoAndReturn(func(p []byte) (int, error) {
+		return copy(p, "wasm"), io.EOF
+	})
+	torrentReader.EXPECT().SetContext(gomock.Any())
+	torrentReader.EXPECT().Close().Return(nil)
+
+	d := &magnetDownloader{magnetURL: "torrent:test", spec: spec, client: torrentClient}
+	b := new(bytes.Buffer)
+	require.NoError(t, d.DownloadWASM(context.Background(), b))
+	assert.Equal(t, "wasm", b.String())
+}
+
+func TestDownloadWASMFromTorrents(t *testing.T) {
+	content := bytes.Repeat([]byte("wasm"), 16*1024)
+	metainfoBytes, peer := newTestSeeder(t, content)
+	mi, err := metainfo.Load(bytes.NewReader(metainfoBytes))
+	require.NoError(t, err)
+	infoHash := mi.HashInfoBytes().HexString()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/module.wasm" {
+			w.Write(content)
+			return
+		}
+		w.Write(metainfoBytes)
+	}))
+	defer srv.Close()
+
+	var tests = []struct {
+		name       string
+		spec       TorrentSpec
+		wantSource string
+	}{
+		{
+			name:       "it should download from a metainfo blob and peers",
+			spec:       TorrentSpec{Metainfo: metainfoBytes, Peers: []string{peer}},
+			wantSource: "torrent:" + infoHash,
+		},
+		{
+			name:       "it should download from an info hash and peers",
+			spec:       TorrentSpec{InfoHash: infoHash, Peers: []string{peer}},
+			wantSource: "torrent:" + infoHash,
+		},
+		{
+			name:       "it should download from a .torrent URL and peers",
+			spec:       TorrentSpec{MetainfoURL: srv.URL + "/module.torrent", Peers: []string{peer}},
+			wantSource: "torrent:" + srv.URL + "/module.torrent",
+		},
+		{
+			name:       "it should download from web seeds without peers",
+			spec:       TorrentSpec{Metainfo: metainfoBytes, WebSeeds: []string{srv.URL + "/module.wasm"}},
+			wantSource: "torrent:" + infoHash,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+			var sources []string
+			d, err := New(sum(content), nil,
+				WithHTTPClient(srv.Client()),
+				WithProgress(func(p Progress) { sources = append(sources, p.Source) }),
+				WithTorrent(tt.spec))
+			require.NoError(t, err)
+			b := new(bytes.Buffer)
+			require.NoError(t, d.DownloadWASM(ctx, b))
+			assert.Equal(t, content, b.Bytes())
+			require.NotEmpty(t, sources)
+			assert.Equal(t, tt.wantSource, sources[0])
+		})
+	}
+}
+
+func TestTorrentFileURL(t *testing.T) {
+	assert.True(t, isTorrentFileURL("https://example.com/module.torrent?v=1"))
+	assert.False(t, isTorrentFileURL("https://example.com/module.wasm"))
+
+	factory, err := (&downloader{sources: map[string]SourceFactory{}}).source("https://example.com/module.TORRENT")
+	require.NoError(t, err)
+	d, err := factory(context.Background(), "https://example.com/module.TORRENT", SourceConfig{})
+	require.NoError(t, err)
+	require.IsType(t, &torrentDownloader{}, d)
+	assert.Equal(t, "https://example.com/module.TORRENT", d.(*torrentDownloader).spec.MetainfoURL)
+}
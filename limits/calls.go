@@ -0,0 +1,132 @@
+package limits
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/experimental"
+)
+
+// callWatchdogKey is the context key of the callWatchdog of a connection.
+type callWatchdogKey struct{}
+
+// callListeners is notified when the module of a connection is called and
+// returns, and when it calls a host function and gets back control. The
+// compiled modules are cached and shared by the connections, so it's shared
+// too, and finds the watchdog of the connection in the context of the calls.
+type callListeners struct{}
+
+// NewFunctionListener listens to the host functions and the exported functions
+// of the modules only, so the calls between the functions of a module don't
+// slow it down.
+func (callListeners) NewFunctionListener(def api.FunctionDefinition) experimental.FunctionListener {
+	if def.GoFunction() == nil && len(def.ExportNames()) == 0 {
+		return nil
+	}
+	return callListeners{}
+}
+
+func (callListeners) Before(ctx context.Context, _ api.Module, def api.FunctionDefinition, _ []uint64, _ experimental.StackIterator) {
+	if w, ok := ctx.Value(callWatchdogKey{}).(*callWatchdog); ok {
+		w.enter(def.GoFunction() != nil)
+	}
+}
+
+func (callListeners) After(ctx context.Context, _ api.Module, _ api.FunctionDefinition, _ []uint64) {
+	if w, ok := ctx.Value(callWatchdogKey{}).(*callWatchdog); ok {
+		w.exit()
+	}
+}
+
+func (callListeners) Abort(ctx context.Context, _ api.Module, _ api.FunctionDefinition, _ error) {
+	if w, ok := ctx.Value(callWatchdogKey{}).(*callWatchdog); ok {
+		w.exit()
+	}
+}
+
+// callWatchdog cancels the context of a module running for longer than the
+// timeout without returning to the host, either by returning from the call or
+// by calling a host function, such as the ones polling the connections.
+type callWatchdog struct {
+	timeout time.Duration
+	cancel  context.CancelCauseFunc
+
+	mu sync.Mutex
+	// host holds whether every function of the stack is a host function
+	host  []bool
+	timer *time.Timer
+	// runs counts the times the module started running, so a timer firing
+	// after the module returned is ignored
+	runs int
+}
+
+// withCallWatchdog returns a context canceled with ErrCallTimeoutExceeded once
+// the module compiled and run with it runs for longer than the timeout
+// without returning to the host.
+func withCallWatchdog(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancelCause(ctx)
+	w := &callWatchdog{timeout: timeout, cancel: cancel}
+	ctx = context.WithValue(ctx, callWatchdogKey{}, w)
+	ctx = experimental.WithFunctionListenerFactory(ctx, callListeners{})
+	return ctx, func() {
+		w.stop()
+		cancel(context.Canceled)
+	}
+}
+
+func (w *callWatchdog) enter(host bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	wasRunning := w.running()
+	w.host = append(w.host, host)
+	w.update(wasRunning)
+}
+
+func (w *callWatchdog) exit() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(w.host) == 0 {
+		return
+	}
+	wasRunning := w.running()
+	w.host = w.host[:len(w.host)-1]
+	w.update(wasRunning)
+}
+
+// running reports whether the module is running, with mu held.
+func (w *callWatchdog) running() bool {
+	return len(w.host) > 0 && !w.host[len(w.host)-1]
+}
+
+// update starts or stops the timer when the module starts or stops running,
+// with mu held.
+func (w *callWatchdog) update(wasRunning bool) {
+	running := w.running()
+	switch {
+	case running && !wasRunning:
+		w.runs++
+		run := w.runs
+		w.timer = time.AfterFunc(w.timeout, func() {
+			w.mu.Lock()
+			defer w.mu.Unlock()
+			if w.runs == run && w.running() {
+				w.cancel(ErrCallTimeoutExceeded)
+			}
+		})
+	case !running && wasRunning:
+		w.timer.Stop()
+		w.timer = nil
+	}
+}
+
+func (w *callWatchdog) stop() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.timer != nil {
+		w.timer.Stop()
+		w.timer = nil
+	}
+	w.runs++
+}
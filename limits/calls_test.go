@@ -0,0 +1,88 @@
+package limits
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tetratelabs/wazero"
+)
+
+var (
+	// spinWASM exports a "spin" function looping forever.
+	spinWASM = []byte{
+		0x00, 'a', 's', 'm', 0x01, 0x00, 0x00, 0x00,
+		0x01, 0x04, 0x01, 0x60, 0x00, 0x00,
+		0x03, 0x02, 0x01, 0x00,
+		0x07, 0x08, 0x01, 0x04, 's', 'p', 'i', 'n', 0x00, 0x00,
+		0x0a, 0x09, 0x01, 0x07, 0x00, 0x03, 0x40, 0x0c, 0x00, 0x0b, 0x0b,
+	}
+	// sleepWASM exports a "run" function calling the "sleep" host function of
+	// the "env" module.
+	sleepWASM = []byte{
+		0x00, 'a', 's', 'm', 0x01, 0x00, 0x00, 0x00,
+		0x01, 0x04, 0x01, 0x60, 0x00, 0x00,
+		0x02, 0x0d, 0x01, 0x03, 'e', 'n', 'v', 0x05, 's', 'l', 'e', 'e', 'p', 0x00, 0x00,
+		0x03, 0x02, 0x01, 0x00,
+		0x07, 0x07, 0x01, 0x03, 'r', 'u', 'n', 0x00, 0x01,
+		0x0a, 0x06, 0x01, 0x04, 0x00, 0x10, 0x00, 0x0b,
+	}
+)
+
+// call instantiates the WASM module and calls its exported function, both
+// with the context of the budget, as the WATER core does.
+func call(t *testing.T, budget *Budget, wasm []byte, name string) error {
+	ctx := budget.Context()
+	r := wazero.NewRuntimeWithConfig(ctx, wazero.NewRuntimeConfig().WithCloseOnContextDone(true))
+	defer r.Close(context.Background())
+
+	_, err := r.NewHostModuleBuilder("env").
+		NewFunctionBuilder().
+		WithFunc(func(context.Context) { time.Sleep(200 * time.Millisecond) }).
+		Export("sleep").
+		Instantiate(ctx)
+	require.NoError(t, err)
+	mod, err := r.Instantiate(ctx, wasm)
+	require.NoError(t, err)
+	_, err = mod.ExportedFunction(name).Call(ctx)
+	return err
+}
+
+func TestCallTimeout(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("it should interrupt a module running for longer than the timeout", func(t *testing.T) {
+		budget := Limits{CallTimeout: 50 * time.Millisecond}.StartBudget(ctx, "test")
+		defer budget.Stop()
+
+		start := time.Now()
+		err := call(t, budget, spinWASM, "spin")
+		require.Error(t, err)
+		assert.Less(t, time.Since(start), 5*time.Second)
+		assert.ErrorIs(t, budget.Err(err), ErrCallTimeoutExceeded)
+	})
+
+	t.Run("it should not count the time spent in host functions", func(t *testing.T) {
+		budget := Limits{CallTimeout: 50 * time.Millisecond}.StartBudget(ctx, "test")
+		defer budget.Stop()
+
+		assert.NoError(t, call(t, budget, sleepWASM, "run"))
+		assert.NoError(t, budget.Context().Err())
+	})
+
+	t.Run("it should close wrapped connections once the timeout is exceeded", func(t *testing.T) {
+		budget := Limits{CallTimeout: 50 * time.Millisecond}.StartBudget(ctx, "test")
+		d := &pipeDialer{}
+		conn, err := d.DialContext(ctx, "tcp", "")
+		require.NoError(t, err)
+		defer d.server.Close()
+		conn = budget.WrapConn(conn)
+
+		require.Error(t, call(t, budget, spinWASM, "spin"))
+		_, err = conn.Read(make([]byte, 1))
+		assert.ErrorIs(t, err, ErrCallTimeoutExceeded)
+		assert.ErrorIs(t, conn.Close(), ErrCallTimeoutExceeded)
+	})
+}
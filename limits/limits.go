@@ -0,0 +1,261 @@
+// Package limits bounds the resources a WASM transport can use, so a buggy
+// or malicious module can't take down the host process.
+package limits
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/refraction-networking/water"
+)
+
+var (
+	// ErrMemoryLimitExceeded is returned when a WASM module requires more
+	// linear memory than allowed by Limits.MaxMemoryPages.
+	ErrMemoryLimitExceeded = errors.New("WASM memory limit exceeded")
+	// ErrCallTimeoutExceeded is returned when the WASM module of a connection
+	// runs for longer than Limits.CallTimeout without returning to the host.
+	ErrCallTimeoutExceeded = errors.New("WASM call timeout exceeded")
+	// ErrConnectionLifetimeExceeded is returned when a connection outlives
+	// Limits.ConnectionLifetime.
+	ErrConnectionLifetimeExceeded = errors.New("connection lifetime exceeded")
+)
+
+// LimitError reports which limit was hit by which transport. It wraps one of
+// ErrMemoryLimitExceeded, ErrCallTimeoutExceeded or
+// ErrConnectionLifetimeExceeded, so callers can use errors.Is for checking
+// the limit.
+type LimitError struct {
+	// Err is the sentinel error for the limit that was hit.
+	Err error
+	// Transport is the name of the transport that hit the limit.
+	Transport string
+	// Detail describes the limit and the value that exceeded it.
+	Detail string
+}
+
+func (e *LimitError) Error() string {
+	return fmt.Sprintf("%s: %v: %s", e.Transport, e.Err, e.Detail)
+}
+
+func (e *LimitError) Unwrap() error {
+	return e.Err
+}
+
+// Limits contains the resource limits applied to a WASM transport. The zero
+// value means no limits.
+type Limits struct {
+	// MaxMemoryPages is the maximum number of 64 KiB linear memory pages a
+	// WASM instance can grow to. Zero means no limit.
+	MaxMemoryPages uint32
+	// CallTimeout is the maximum time the WASM module of a connection can run
+	// at once, from the moment it's called or a host function it called
+	// returns, until it returns or calls a host function again. A healthy
+	// module only runs for short bursts between polling and reading or
+	// writing its connections, while a module spinning in a loop never
+	// returns. The time is measured on the wall clock, so it must leave room
+	// for the scheduling delays of a loaded host. Once exceeded, the module is
+	// interrupted and the connection is closed, Read and Write returning a
+	// LimitError. Zero means no limit.
+	CallTimeout time.Duration
+	// ConnectionLifetime is the maximum lifetime of a connection, starting
+	// with its dial or, for accepted connections, its WASM handshake. Healthy
+	// connections are closed too once open for that long, so it must be
+	// longer than the longest expected tunnel. Once exceeded, the module is
+	// interrupted and the connection is closed, Read and Write returning a
+	// LimitError. Zero means no limit.
+	ConnectionLifetime time.Duration
+}
+
+// LimitMemory returns a copy of the WASM module with the declared maximum of
+// its memories capped to MaxMemoryPages. The runtime refuses to grow the
+// memory above the declared maximum, so allocations above the cap fail inside
+// the module. If the module requires more initial memory than allowed it
+// returns a LimitError.
+func (l Limits) LimitMemory(transport string, wasm []byte) ([]byte, error) {
+	if l.MaxMemoryPages == 0 {
+		return wasm, nil
+	}
+	return capMemoryPages(transport, wasm, l.MaxMemoryPages)
+}
+
+// WrapDialer returns a water.Dialer that applies the call timeout and the
+// connection lifetime to every dialed connection. If there's neither the
+// dialer is returned as is.
+func (l Limits) WrapDialer(ctx context.Context, transport string, dialer water.Dialer) water.Dialer {
+	if !l.timed() {
+		return dialer
+	}
+	return &budgetDialer{Dialer: dialer, ctx: ctx, transport: transport, limits: l}
+}
+
+// timed reports whether the connections have a call timeout or a lifetime.
+func (l Limits) timed() bool {
+	return l.CallTimeout > 0 || l.ConnectionLifetime > 0
+}
+
+// Budget holds the call timeout and the lifetime of a single connection,
+// started by Limits.StartBudget.
+type Budget struct {
+	ctx       context.Context
+	cancel    context.CancelFunc
+	transport string
+	limits    Limits
+}
+
+// StartBudget starts the budget of a connection about to be accepted or
+// dialed. The context returned by Budget.Context must be used for the WASM
+// module of the connection, so the module is interrupted once it exceeds the
+// call timeout or the lifetime. Without either, the context is ctx.
+func (l Limits) StartBudget(ctx context.Context, transport string) *Budget {
+	b := &Budget{ctx: ctx, cancel: func() {}, transport: transport, limits: l}
+	if l.ConnectionLifetime > 0 {
+		var cancel context.CancelFunc
+		b.ctx, cancel = context.WithTimeoutCause(b.ctx, l.ConnectionLifetime, ErrConnectionLifetimeExceeded)
+		b.cancel = cancel
+	}
+	if l.CallTimeout > 0 {
+		var cancel context.CancelFunc
+		b.ctx, cancel = withCallWatchdog(b.ctx, l.CallTimeout)
+		cancelLifetime := b.cancel
+		b.cancel = func() {
+			cancel()
+			cancelLifetime()
+		}
+	}
+	return b
+}
+
+// Context returns the context canceled once the budget is exceeded or
+// stopped.
+func (b *Budget) Context() context.Context {
+	return b.ctx
+}
+
+// Stop stops the budget of a connection that failed or was closed, canceling
+// its context.
+func (b *Budget) Stop() {
+	b.cancel()
+}
+
+// Err returns a LimitError if err happened because the budget was exceeded,
+// or err otherwise.
+func (b *Budget) Err(err error) error {
+	if err == nil {
+		return nil
+	}
+	if limitErr := b.limitError("connection took longer than %s to set up"); limitErr != nil {
+		return limitErr
+	}
+	return err
+}
+
+// WrapConn returns a water.Conn closed once the budget is exceeded, whose
+// Close stops the budget. Without a budget, the connection is returned as is.
+func (b *Budget) WrapConn(conn water.Conn) water.Conn {
+	if !b.limits.timed() {
+		return conn
+	}
+	c := &budgetConn{Conn: conn, budget: b}
+	c.stop = context.AfterFunc(b.ctx, func() {
+		c.Conn.Close()
+	})
+	return c
+}
+
+// limitError returns a LimitError if the budget was exceeded, or nil. The
+// detail is used for an exceeded lifetime.
+func (b *Budget) limitError(lifetimeDetail string) error {
+	switch cause := context.Cause(b.ctx); {
+	case errors.Is(cause, ErrCallTimeoutExceeded):
+		return &LimitError{
+			Err:       ErrCallTimeoutExceeded,
+			Transport: b.transport,
+			Detail:    fmt.Sprintf("WASM module ran for longer than %s without returning", b.limits.CallTimeout),
+		}
+	case errors.Is(cause, ErrConnectionLifetimeExceeded):
+		return &LimitError{
+			Err:       ErrConnectionLifetimeExceeded,
+			Transport: b.transport,
+			Detail:    fmt.Sprintf(lifetimeDetail, b.limits.ConnectionLifetime),
+		}
+	default:
+		return nil
+	}
+}
+
+type budgetDialer struct {
+	water.Dialer
+	ctx       context.Context
+	transport string
+	limits    Limits
+}
+
+// Dial dials using the context given when the dialer was created.
+func (d *budgetDialer) Dial(network, address string) (water.Conn, error) {
+	return d.DialContext(d.ctx, network, address)
+}
+
+// DialContext dials with a context bounded by the budget. The context also
+// bounds every call into the WASM module of the connection.
+func (d *budgetDialer) DialContext(ctx context.Context, network, address string) (water.Conn, error) {
+	budget := d.limits.StartBudget(ctx, d.transport)
+	conn, err := d.Dialer.DialContext(budget.Context(), network, address)
+	if err != nil {
+		budget.Stop()
+		return nil, budget.Err(err)
+	}
+	return budget.WrapConn(conn), nil
+}
+
+// budgetConn closes the wrapped connection once the budget is exceeded.
+type budgetConn struct {
+	water.Conn
+	budget *Budget
+	stop   func() bool
+}
+
+func (c *budgetConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if err != nil {
+		if limitErr := c.limitError(); limitErr != nil {
+			return n, limitErr
+		}
+	}
+	return n, err
+}
+
+func (c *budgetConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if err != nil {
+		if limitErr := c.limitError(); limitErr != nil {
+			return n, limitErr
+		}
+	}
+	return n, err
+}
+
+// Close stops the budget and closes the connection. If the connection was
+// already closed because the budget was exceeded, it returns a LimitError.
+func (c *budgetConn) Close() error {
+	if !c.stop() {
+		if limitErr := c.limitError(); limitErr != nil {
+			return limitErr
+		}
+	}
+	err := c.Conn.Close()
+	c.budget.Stop()
+	return err
+}
+
+// NetConn returns the underlying connection.
+func (c *budgetConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+func (c *budgetConn) limitError() error {
+	return c.budget.limitError("connection open for longer than %s")
+}
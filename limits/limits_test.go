@@ -0,0 +1,209 @@
+package limits
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/refraction-networking/water"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// wasmWithMemory builds a minimal WASM module containing a single memory
+// with the given limits, followed by a custom section.
+func wasmWithMemory(minPages uint64, maxPages *uint64) []byte {
+	memory := []byte{0x01}
+	if maxPages == nil {
+		memory = append(memory, 0x00)
+		memory = binary.AppendUvarint(memory, minPages)
+	} else {
+		memory = append(memory, 0x01)
+		memory = binary.AppendUvarint(memory, minPages)
+		memory = binary.AppendUvarint(memory, *maxPages)
+	}
+
+	wasm := []byte{0x00, 'a', 's', 'm', 0x01, 0x00, 0x00, 0x00}
+	wasm = append(wasm, memorySectionID)
+	wasm = binary.AppendUvarint(wasm, uint64(len(memory)))
+	wasm = append(wasm, memory...)
+	wasm = append(wasm, 0x00, 0x05, 0x04, 'n', 'a', 'm', 'e')
+	return wasm
+}
+
+func TestLimitMemory(t *testing.T) {
+	declaredMax := uint64(1000)
+	smallMax := uint64(4)
+	cappedMax := uint64(16)
+	var tests = []struct {
+		name   string
+		limits Limits
+		wasm   []byte
+		assert func(*testing.T, []byte, error)
+	}{
+		{
+			name: "it should return the module as is when there's no limit",
+			wasm: wasmWithMemory(2, nil),
+			assert: func(t *testing.T, wasm []byte, err error) {
+				require.NoError(t, err)
+				assert.Equal(t, wasmWithMemory(2, nil), wasm)
+			},
+		},
+		{
+			name:   "it should declare a maximum when the module doesn't have one",
+			limits: Limits{MaxMemoryPages: 16},
+			wasm:   wasmWithMemory(2, nil),
+			assert: func(t *testing.T, wasm []byte, err error) {
+				require.NoError(t, err)
+				assert.Equal(t, wasmWithMemory(2, &cappedMax), wasm)
+			},
+		},
+		{
+			name:   "it should lower the declared maximum to the limit",
+			limits: Limits{MaxMemoryPages: 16},
+			wasm:   wasmWithMemory(2, &declaredMax),
+			assert: func(t *testing.T, wasm []byte, err error) {
+				require.NoError(t, err)
+				assert.Equal(t, wasmWithMemory(2, &cappedMax), wasm)
+			},
+		},
+		{
+			name:   "it should keep a declared maximum lower than the limit",
+			limits: Limits{MaxMemoryPages: 16},
+			wasm:   wasmWithMemory(2, &smallMax),
+			assert: func(t *testing.T, wasm []byte, err error) {
+				require.NoError(t, err)
+				assert.Equal(t, wasmWithMemory(2, &smallMax), wasm)
+			},
+		},
+		{
+			name:   "it should return a limit error when the initial memory is above the limit",
+			limits: Limits{MaxMemoryPages: 1},
+			wasm:   wasmWithMemory(2, nil),
+			assert: func(t *testing.T, wasm []byte, err error) {
+				assert.ErrorIs(t, err, ErrMemoryLimitExceeded)
+				var limitErr *LimitError
+				require.ErrorAs(t, err, &limitErr)
+				assert.Equal(t, "test", limitErr.Transport)
+			},
+		},
+		{
+			name:   "it should return an error for invalid modules",
+			limits: Limits{MaxMemoryPages: 16},
+			wasm:   []byte("not wasm"),
+			assert: func(t *testing.T, wasm []byte, err error) {
+				assert.Error(t, err)
+				assert.Nil(t, wasm)
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			wasm, err := tt.limits.LimitMemory("test", tt.wasm)
+			tt.assert(t, wasm, err)
+		})
+	}
+}
+
+// netConn adapts a plain net.Conn to water.Conn.
+type netConn struct {
+	net.Conn
+	water.UnimplementedConn
+}
+
+type pipeDialer struct {
+	water.UnimplementedDialer
+	server net.Conn
+	block  bool
+}
+
+func (d *pipeDialer) DialContext(ctx context.Context, _, _ string) (water.Conn, error) {
+	if d.block {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	client, server := net.Pipe()
+	d.server = server
+	return &netConn{Conn: client}, nil
+}
+
+func TestConnectionLifetime(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("it should close the connection when the lifetime is exceeded", func(t *testing.T) {
+		d := &pipeDialer{}
+		dialer := Limits{ConnectionLifetime: 50 * time.Millisecond}.WrapDialer(ctx, "test", d)
+		conn, err := dialer.DialContext(ctx, "tcp", "")
+		require.NoError(t, err)
+		defer d.server.Close()
+
+		_, err = conn.Read(make([]byte, 1))
+		assert.ErrorIs(t, err, ErrConnectionLifetimeExceeded)
+		assert.ErrorIs(t, conn.Close(), ErrConnectionLifetimeExceeded)
+	})
+
+	t.Run("it should return a limit error when the dial exceeds the lifetime", func(t *testing.T) {
+		dialer := Limits{ConnectionLifetime: 50 * time.Millisecond}.WrapDialer(ctx, "test", &pipeDialer{block: true})
+		_, err := dialer.DialContext(ctx, "tcp", "")
+		assert.ErrorIs(t, err, ErrConnectionLifetimeExceeded)
+	})
+
+	t.Run("it should keep the connection open within the lifetime", func(t *testing.T) {
+		d := &pipeDialer{}
+		dialer := Limits{ConnectionLifetime: time.Minute}.WrapDialer(ctx, "test", d)
+		conn, err := dialer.DialContext(ctx, "tcp", "")
+		require.NoError(t, err)
+
+		go d.server.Write([]byte("hello"))
+		b := make([]byte, 5)
+		_, err = io.ReadFull(conn, b)
+		require.NoError(t, err)
+		assert.Equal(t, "hello", string(b))
+		assert.NoError(t, conn.Close())
+		d.server.Close()
+	})
+
+	t.Run("it should not wrap the dialer without a call timeout or lifetime", func(t *testing.T) {
+		d := &pipeDialer{}
+		assert.Same(t, d, Limits{}.WrapDialer(ctx, "test", d).(*pipeDialer))
+	})
+}
+
+func TestStartBudget(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("it should cancel the context once the budget is exceeded", func(t *testing.T) {
+		budget := Limits{ConnectionLifetime: 50 * time.Millisecond}.StartBudget(ctx, "test")
+		defer budget.Stop()
+		<-budget.Context().Done()
+		assert.ErrorIs(t, context.Cause(budget.Context()), ErrConnectionLifetimeExceeded)
+		assert.ErrorIs(t, budget.Err(io.EOF), ErrConnectionLifetimeExceeded)
+	})
+
+	t.Run("it should keep errors of stopped budgets", func(t *testing.T) {
+		budget := Limits{ConnectionLifetime: time.Minute}.StartBudget(ctx, "test")
+		budget.Stop()
+		assert.ErrorIs(t, budget.Context().Err(), context.Canceled)
+		assert.Equal(t, io.EOF, budget.Err(io.EOF))
+	})
+
+	t.Run("it should close wrapped connections once the budget is exceeded", func(t *testing.T) {
+		client, server := net.Pipe()
+		defer server.Close()
+		budget := Limits{ConnectionLifetime: 50 * time.Millisecond}.StartBudget(ctx, "test")
+		conn := budget.WrapConn(&netConn{Conn: client})
+		_, err := conn.Read(make([]byte, 1))
+		assert.ErrorIs(t, err, ErrConnectionLifetimeExceeded)
+	})
+
+	t.Run("it should use the context and connection as is without a budget", func(t *testing.T) {
+		budget := Limits{}.StartBudget(ctx, "test")
+		defer budget.Stop()
+		assert.Equal(t, ctx, budget.Context())
+		conn := &netConn{}
+		assert.Same(t, conn, budget.WrapConn(conn).(*netConn))
+	})
+}
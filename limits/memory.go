@@ -0,0 +1,104 @@
+package limits
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+const (
+	wasmHeaderSize      = 8
+	memorySectionID     = 5
+	limitsHasMaxFlag    = 0x01
+	limitsMemory64Flag  = 0x04
+	maxWASM32MemoryPage = 65536
+)
+
+var wasmMagic = []byte{0x00, 'a', 's', 'm'}
+
+// capMemoryPages rewrites the memory section of the WASM binary so every
+// memory declares a maximum of at most maxPages. Other sections are copied as
+// they are.
+func capMemoryPages(transport string, wasm []byte, maxPages uint32) ([]byte, error) {
+	if len(wasm) < wasmHeaderSize || !bytes.Equal(wasm[:4], wasmMagic) {
+		return nil, errors.New("invalid WASM module: missing magic header")
+	}
+
+	out := bytes.NewBuffer(make([]byte, 0, len(wasm)))
+	out.Write(wasm[:wasmHeaderSize])
+	r := bytes.NewReader(wasm[wasmHeaderSize:])
+	for r.Len() > 0 {
+		id, err := r.ReadByte()
+		if err != nil {
+			return nil, fmt.Errorf("invalid WASM module: %w", err)
+		}
+		size, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, fmt.Errorf("invalid WASM module: reading section size: %w", err)
+		}
+		if size > uint64(r.Len()) {
+			return nil, fmt.Errorf("invalid WASM module: section %d is truncated", id)
+		}
+		payload := make([]byte, size)
+		if _, err = r.Read(payload); err != nil {
+			return nil, fmt.Errorf("invalid WASM module: %w", err)
+		}
+
+		if id == memorySectionID {
+			if payload, err = capMemorySection(transport, payload, maxPages); err != nil {
+				return nil, err
+			}
+		}
+
+		out.WriteByte(id)
+		out.Write(binary.AppendUvarint(nil, uint64(len(payload))))
+		out.Write(payload)
+	}
+	return out.Bytes(), nil
+}
+
+func capMemorySection(transport string, payload []byte, maxPages uint32) ([]byte, error) {
+	r := bytes.NewReader(payload)
+	count, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, fmt.Errorf("invalid WASM memory section: %w", err)
+	}
+
+	out := binary.AppendUvarint(nil, count)
+	for i := uint64(0); i < count; i++ {
+		flags, err := r.ReadByte()
+		if err != nil {
+			return nil, fmt.Errorf("invalid WASM memory section: %w", err)
+		}
+		if flags&limitsMemory64Flag != 0 {
+			return nil, errors.New("unsupported WASM module: 64-bit memories can't be limited")
+		}
+		minPages, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, fmt.Errorf("invalid WASM memory section: %w", err)
+		}
+		declaredMax := uint64(maxWASM32MemoryPage)
+		if flags&limitsHasMaxFlag != 0 {
+			if declaredMax, err = binary.ReadUvarint(r); err != nil {
+				return nil, fmt.Errorf("invalid WASM memory section: %w", err)
+			}
+		}
+
+		if minPages > uint64(maxPages) {
+			return nil, &LimitError{
+				Err:       ErrMemoryLimitExceeded,
+				Transport: transport,
+				Detail:    fmt.Sprintf("module requires %d initial pages but the limit is %d pages", minPages, maxPages),
+			}
+		}
+
+		out = append(out, flags|limitsHasMaxFlag)
+		out = binary.AppendUvarint(out, minPages)
+		out = binary.AppendUvarint(out, min(declaredMax, uint64(maxPages)))
+	}
+	if r.Len() > 0 {
+		return nil, errors.New("invalid WASM memory section: trailing bytes")
+	}
+	return out, nil
+}
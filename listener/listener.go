@@ -5,11 +5,14 @@ import (
 	"context"
 	"log/slog"
 	"net"
+	"sync"
 
 	"github.com/getlantern/golog"
+	"github.com/getlantern/lantern-water/limits"
 	"github.com/getlantern/lantern-water/logger"
+	"github.com/getlantern/lantern-water/metrics"
 	"github.com/refraction-networking/water"
-	_ "github.com/refraction-networking/water/transport/v1"
+	v1 "github.com/refraction-networking/water/transport/v1"
 )
 
 // ListenerParams contain arguments/parameters used for creating a new WATER listener
@@ -27,27 +30,190 @@ type ListenerParams struct {
 	Address string
 	// WASM must contain the WASM data used by the WATER listener
 	WASM []byte
+	// Limits are optional resource limits applied to the WASM module and to
+	// every accepted connection
+	Limits limits.Limits
+	// Metrics is an optional recorder receiving the accepted connections,
+	// active connections and transferred bytes.
+	Metrics metrics.Recorder
 }
 
 // NewWATERListener creates a WATER listener
 // Currently water doesn't support customized TCP connections and we need to listen and receive requests directly from the WATER listener
+// Every accepted connection gets an ID, retrievable with logger.ConnID, that
+// is added to the logs of the connection along with its addresses.
 func NewWATERListener(ctx context.Context, params ListenerParams) (net.Listener, error) {
+	wasm, err := params.Limits.LimitMemory(params.Transport, params.WASM)
+	if err != nil {
+		return nil, err
+	}
+
 	cfg := &water.Config{
-		TransportModuleBin: params.WASM,
+		TransportModuleBin: wasm,
+	}
+
+	base := params.BaseListener
+	if base == nil {
+		if base, err = net.Listen("tcp", params.Address); err != nil {
+			return nil, err
+		}
 	}
+	cfg.NetworkListener = base
 
+	// make sure the WASM module exports a supported listener
+	if _, err = water.NewListenerWithContext(ctx, cfg); err != nil {
+		base.Close()
+		return nil, err
+	}
+
+	l := &connListener{
+		Listener:  base,
+		ctx:       ctx,
+		config:    cfg,
+		transport: params.Transport,
+		limits:    params.Limits,
+		metrics:   metrics.OrNop(params.Metrics),
+		conns:     make(chan net.Conn),
+		done:      make(chan struct{}),
+		closed:    make(chan struct{}),
+	}
 	if params.Logger != nil {
-		cfg.OverrideLogger = slog.New(logger.NewLogHandler(params.Logger, params.Transport))
+		l.handler = logger.NewLogHandler(params.Logger, params.Transport)
 	}
+	return l, nil
+}
+
+// connListener accepts connections from the base listener and passes each
+// one through a water listener created for it, so the WASM runtime logs made
+// on behalf of the connection carry its ID and addresses, and the call
+// timeout and lifetime of the connection bound its WASM module. The WATER
+// handshakes run concurrently, so a slow client doesn't delay the others, and
+// a failed handshake is only logged and counted, as it only concerns its own
+// connection.
+type connListener struct {
+	net.Listener
+	ctx       context.Context
+	config    *water.Config
+	handler   slog.Handler
+	transport string
+	limits    limits.Limits
+	metrics   metrics.Recorder
 
-	if params.BaseListener != nil {
-		cfg.NetworkListener = params.BaseListener
+	start     sync.Once
+	conns     chan net.Conn
+	done      chan struct{} // closed when the base listener fails, with err
+	err       error
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+// Accept returns the next connection whose WATER handshake succeeded. It only
+// fails once the base listener fails or the listener is closed.
+func (l *connListener) Accept() (net.Conn, error) {
+	l.start.Do(func() {
+		go l.acceptLoop()
+	})
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, l.err
+	case <-l.closed:
+		return nil, net.ErrClosed
 	}
+}
 
-	waterListener, err := cfg.ListenContext(ctx, "tcp", params.Address)
+// Close closes the base listener and the connections whose WATER handshake
+// is still running.
+func (l *connListener) Close() error {
+	err := net.ErrClosed
+	l.closeOnce.Do(func() {
+		close(l.closed)
+		err = l.Listener.Close()
+	})
+	return err
+}
+
+func (l *connListener) acceptLoop() {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			l.err = err
+			close(l.done)
+			return
+		}
+		go l.handshake(conn)
+	}
+}
+
+// handshake runs the WATER handshake of the connection and hands it to
+// Accept.
+func (l *connListener) handshake(conn net.Conn) {
+	connCtx := logger.NewConnContext()
+	connCtx.SetLocalAddr(conn.LocalAddr().String())
+	connCtx.SetRemoteAddr(conn.RemoteAddr().String())
+
+	handler := l.handler
+	if handler == nil {
+		handler = slog.Default().Handler()
+	}
+	log := slog.New(connCtx.Handler(handler))
+	cfg := l.config.Clone()
+	cfg.OverrideLogger = log
+	cfg.NetworkListener = &singleConnListener{conn: conn, addr: l.Listener.Addr()}
+
+	labels := metrics.Labels{metrics.LabelTransport: l.transport}
+	budget := l.limits.StartBudget(l.ctx, l.transport)
+	waterConn, err := l.acceptWATER(budget, cfg)
+	if err != nil {
+		conn.Close()
+		budget.Stop()
+		l.metrics.Add(metrics.AcceptErrors, 1, labels)
+		log.Error("failed to accept WATER connection", slog.Any("err", budget.Err(err)))
+		return
+	}
+	l.metrics.Add(metrics.Accepts, 1, labels)
+	waterConn = budget.WrapConn(waterConn)
+	waterConn = metrics.WrapConn(waterConn, l.metrics, l.transport, metrics.DirectionAccept)
+
+	select {
+	case l.conns <- logger.WrapConn(waterConn, connCtx):
+	case <-l.closed:
+		waterConn.Close()
+	}
+}
+
+func (l *connListener) acceptWATER(budget *limits.Budget, cfg *water.Config) (water.Conn, error) {
+	waterListener, err := v1.NewListenerWithContext(budget.Context(), cfg)
 	if err != nil {
 		return nil, err
 	}
+	return waterListener.AcceptWATER()
+}
+
+// singleConnListener is a net.Listener returning a single, already accepted,
+// connection.
+type singleConnListener struct {
+	mu   sync.Mutex
+	conn net.Conn
+	addr net.Addr
+}
+
+func (l *singleConnListener) Accept() (net.Conn, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.conn == nil {
+		return nil, net.ErrClosed
+	}
+	conn := l.conn
+	l.conn = nil
+	return conn, nil
+}
+
+func (l *singleConnListener) Close() error {
+	return nil
+}
 
-	return waterListener, nil
+func (l *singleConnListener) Addr() net.Addr {
+	return l.addr
 }
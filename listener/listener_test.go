@@ -7,8 +7,11 @@ import (
 	"io"
 	"net"
 	"testing"
+	"time"
 
 	"github.com/getlantern/golog"
+	"github.com/getlantern/lantern-water/limits"
+	"github.com/getlantern/lantern-water/metrics"
 	"github.com/refraction-networking/water"
 	_ "github.com/refraction-networking/water/transport/v1"
 	"github.com/stretchr/testify/assert"
@@ -93,3 +96,81 @@ func TestWATERListener(t *testing.T) {
 	assert.Equal(t, len(expectedResponse), n)
 	assert.Equal(t, expectedResponse, string(buf[:n]))
 }
+
+func TestWATERListenerConnectionLifetime(t *testing.T) {
+	wasm, err := testData.ReadFile("testdata/reverse_v1.wasm")
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	ll, err := NewWATERListener(ctx, ListenerParams{
+		Transport: "reverse_v1",
+		Address:   "127.0.0.1:0",
+		WASM:      wasm,
+		Limits:    limits.Limits{ConnectionLifetime: 200 * time.Millisecond},
+	})
+	require.NoError(t, err)
+	defer ll.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := ll.Accept()
+		if err == nil {
+			accepted <- conn
+		}
+	}()
+
+	dialer, err := water.NewDialerWithContext(ctx, &water.Config{TransportModuleBin: wasm})
+	require.NoError(t, err)
+	conn, err := dialer.DialContext(ctx, "tcp", ll.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	var serverConn net.Conn
+	select {
+	case serverConn = <-accepted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out accepting the connection")
+	}
+	start := time.Now()
+	_, err = serverConn.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, limits.ErrConnectionLifetimeExceeded)
+	assert.Less(t, time.Since(start), 5*time.Second)
+	assert.ErrorIs(t, serverConn.Close(), limits.ErrConnectionLifetimeExceeded)
+}
+
+func TestWATERListenerHandshakeFailures(t *testing.T) {
+	wasm, err := testData.ReadFile("testdata/reverse_v1.wasm")
+	require.NoError(t, err)
+	recorder := metrics.NewExpvarRecorder()
+	ll, err := NewWATERListener(context.Background(), ListenerParams{
+		Transport: "reverse_v1",
+		Address:   "127.0.0.1:0",
+		WASM:      wasm,
+		Metrics:   recorder,
+	})
+	require.NoError(t, err)
+	// every WATER handshake fails with an invalid module
+	ll.(*connListener).config.TransportModuleBin = []byte("invalid")
+
+	errs := make(chan error, 1)
+	go func() {
+		_, err := ll.Accept()
+		errs <- err
+	}()
+	for range 2 {
+		conn, err := net.Dial("tcp", ll.Addr().String())
+		require.NoError(t, err)
+		defer conn.Close()
+	}
+	labels := metrics.Labels{metrics.LabelTransport: "reverse_v1"}
+	assert.Eventually(t, func() bool {
+		return recorder.Value(metrics.AcceptErrors, labels) == 2
+	}, 5*time.Second, 10*time.Millisecond)
+
+	select {
+	case err := <-errs:
+		t.Fatalf("accept returned the error of a connection: %v", err)
+	default:
+	}
+	require.NoError(t, ll.Close())
+	assert.ErrorIs(t, <-errs, net.ErrClosed)
+}
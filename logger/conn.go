@@ -0,0 +1,152 @@
+package logger
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"net"
+	"sync"
+
+	"github.com/refraction-networking/water"
+)
+
+// Keys of the attributes added to the logs of a connection.
+const (
+	ConnIDKey     = "conn_id"
+	LocalAddrKey  = "local_addr"
+	RemoteAddrKey = "remote_addr"
+)
+
+// ConnContext identifies a dialed or accepted connection in logs. The
+// addresses can be set once they're known, they're added to every log made
+// after that.
+type ConnContext struct {
+	id string
+
+	mu         sync.RWMutex
+	localAddr  string
+	remoteAddr string
+}
+
+// NewConnContext returns a ConnContext with a new random connection ID.
+func NewConnContext() *ConnContext {
+	id := make([]byte, 8)
+	rand.Read(id)
+	return &ConnContext{id: hex.EncodeToString(id)}
+}
+
+// ID returns the connection ID.
+func (c *ConnContext) ID() string {
+	return c.id
+}
+
+// SetLocalAddr sets the local address of the connection.
+func (c *ConnContext) SetLocalAddr(addr string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.localAddr = addr
+}
+
+// SetRemoteAddr sets the remote address of the connection.
+func (c *ConnContext) SetRemoteAddr(addr string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.remoteAddr = addr
+}
+
+// Attrs returns the connection ID and the known addresses as log attributes.
+func (c *ConnContext) Attrs() []slog.Attr {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	attrs := []slog.Attr{slog.String(ConnIDKey, c.id)}
+	if c.localAddr != "" {
+		attrs = append(attrs, slog.String(LocalAddrKey, c.localAddr))
+	}
+	if c.remoteAddr != "" {
+		attrs = append(attrs, slog.String(RemoteAddrKey, c.remoteAddr))
+	}
+	return attrs
+}
+
+// Handler returns a slog.Handler adding the connection attributes to every
+// record handled by h.
+func (c *ConnContext) Handler(h slog.Handler) slog.Handler {
+	return &connHandler{conn: c, handler: h}
+}
+
+// connHandler adds the connection attributes when handling each record, so
+// addresses set after the handler was created are included.
+type connHandler struct {
+	conn    *ConnContext
+	handler slog.Handler
+	// derive replays the WithAttrs and WithGroup calls made on this handler
+	// after the connection attributes were added, so these are never
+	// qualified by groups
+	derive []func(slog.Handler) slog.Handler
+}
+
+func (h *connHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.handler.Enabled(ctx, level)
+}
+
+func (h *connHandler) Handle(ctx context.Context, record slog.Record) error {
+	handler := h.handler.WithAttrs(h.conn.Attrs())
+	for _, derive := range h.derive {
+		handler = derive(handler)
+	}
+	return handler.Handle(ctx, record)
+}
+
+func (h *connHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return h.with(func(handler slog.Handler) slog.Handler { return handler.WithAttrs(attrs) })
+}
+
+func (h *connHandler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+	return h.with(func(handler slog.Handler) slog.Handler { return handler.WithGroup(name) })
+}
+
+func (h *connHandler) with(derive func(slog.Handler) slog.Handler) slog.Handler {
+	clone := *h
+	clone.derive = append(h.derive[:len(h.derive):len(h.derive)], derive)
+	return &clone
+}
+
+// WrapConn returns a water.Conn exposing the connection ID of c, which can be
+// retrieved with ConnID.
+func WrapConn(conn water.Conn, c *ConnContext) water.Conn {
+	return &idConn{Conn: conn, ctx: c}
+}
+
+type idConn struct {
+	water.Conn
+	ctx *ConnContext
+}
+
+// ConnID returns the connection ID.
+func (c *idConn) ConnID() string {
+	return c.ctx.ID()
+}
+
+// NetConn returns the underlying connection.
+func (c *idConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// ConnID returns the ID of a connection returned by the WATER dialer or
+// listener. Wrapped connections exposing NetConn are unwrapped.
+func ConnID(conn net.Conn) (string, bool) {
+	for {
+		if c, ok := conn.(interface{ ConnID() string }); ok {
+			return c.ConnID(), true
+		}
+		wrapped, ok := conn.(interface{ NetConn() net.Conn })
+		if !ok {
+			return "", false
+		}
+		conn = wrapped.NetConn()
+	}
+}
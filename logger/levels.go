@@ -0,0 +1,63 @@
+package logger
+
+import (
+	"log/slog"
+	"sort"
+)
+
+// Output is the golog.Logger method used for writing a record.
+type Output int
+
+const (
+	// OutputDebug writes records with golog.Logger.Debug.
+	OutputDebug Output = iota
+	// OutputError writes records with golog.Logger.Error.
+	OutputError
+	// OutputTrace writes records with golog.Logger.Trace, so they're only
+	// visible when tracing is enabled for the logger.
+	OutputTrace
+)
+
+// LevelTrace is a slog level below Debug, mapped to golog's trace mode by
+// default.
+const LevelTrace = slog.LevelDebug - 4
+
+// DefaultLevels is the level mapping used when HandlerOptions.Levels is nil:
+// trace records go to golog.Logger.Trace, debug and info records to
+// golog.Logger.Debug and warnings and errors to golog.Logger.Error.
+var DefaultLevels = map[slog.Level]Output{
+	LevelTrace:      OutputTrace,
+	slog.LevelDebug: OutputDebug,
+	slog.LevelWarn:  OutputError,
+}
+
+// levelOutput is an entry of the level mapping, sorted by level.
+type levelOutput struct {
+	level  slog.Level
+	output Output
+}
+
+func newLevelOutputs(levels map[slog.Level]Output) []levelOutput {
+	if len(levels) == 0 {
+		levels = DefaultLevels
+	}
+	outputs := make([]levelOutput, 0, len(levels))
+	for level, output := range levels {
+		outputs = append(outputs, levelOutput{level: level, output: output})
+	}
+	sort.Slice(outputs, func(i, j int) bool { return outputs[i].level < outputs[j].level })
+	return outputs
+}
+
+// outputFor returns the output mapped to the highest level not greater than
+// the given level.
+func outputFor(levels []levelOutput, level slog.Level) Output {
+	output := levels[0].output
+	for _, l := range levels {
+		if l.level > level {
+			break
+		}
+		output = l.output
+	}
+	return output
+}
@@ -3,31 +3,77 @@ package logger
 
 import (
 	"context"
-	"fmt"
 	"log/slog"
+	"strconv"
 	"strings"
+	"time"
+	"unicode"
 
 	"github.com/getlantern/golog"
 )
 
 // slogHandler is a Handler that implements the slog.Handler interface
 // and writes log records to a golog.Logger.
+//
+// Handlers are immutable: WithAttrs and WithGroup return modified copies, so
+// loggers derived from the same parent never affect each other. Attributes
+// are rendered as key=value pairs and keys inside groups are qualified by the
+// group names separated by dots, e.g. "g.a=1".
 type slogHandler struct {
-	logger   golog.Logger
-	prefix   string
-	minLevel slog.Level
-	opts     slog.HandlerOptions
-	attrs    string
-	groups   []string
+	logger golog.Logger
+	prefix string
+	opts   slog.HandlerOptions
+	levels []levelOutput
+	// structured sends records to golog as structured values instead of
+	// key=value text
+	structured bool
+	// attrs holds the attributes added by WithAttrs, already rendered
+	attrs string
+	// fields holds the attributes added by WithAttrs in structured mode
+	fields []groupedAttr
+	// groups qualify the keys of the attributes added after WithGroup
+	groups []string
+}
+
+// HandlerOptions are the options for a handler created by
+// NewLogHandlerWithOptions.
+type HandlerOptions struct {
+	slog.HandlerOptions
+	// Levels maps slog levels to the golog output used for them. A record
+	// is written with the output of the highest mapped level not greater
+	// than its own level, so custom intermediate levels like
+	// slog.LevelWarn+2 use the output of slog.LevelWarn. Records below every
+	// mapped level use the output of the lowest one. If nil, DefaultLevels
+	// is used.
+	Levels map[slog.Level]Output
+	// Structured sends every record to golog as a Record whose fields are
+	// available to golog outputs as values, instead of a single key=value
+	// string. The handler prefix is kept in the TransportKey field.
+	Structured bool
 }
 
 // NewLogHandler returns a new slog.Handler that writes log records to the given golog.Logger.
 func NewLogHandler(logger golog.Logger, prefix string) *slogHandler {
-	return &slogHandler{logger: logger, prefix: prefix}
+	return NewLogHandlerWithOptions(logger, prefix, HandlerOptions{})
+}
+
+// NewLogHandlerWithOptions returns a new slog.Handler that writes log records
+// to the given golog.Logger, using opts for filtering records and choosing the
+// golog output of each level.
+func NewLogHandlerWithOptions(logger golog.Logger, prefix string, opts HandlerOptions) *slogHandler {
+	return &slogHandler{
+		logger:     logger,
+		prefix:     prefix,
+		opts:       opts.HandlerOptions,
+		levels:     newLevelOutputs(opts.Levels),
+		structured: opts.Structured,
+	}
 }
 
 // Enabled reports whether the handler handles records at the given level.
-// The handler ignores records whose level is lower.
+// The handler ignores records whose level is lower than HandlerOptions.Level,
+// or slog.LevelDebug if it isn't set. Records mapped to OutputTrace are only
+// handled when tracing is enabled for the golog.Logger.
 // It is called early, before any arguments are processed,
 // to save effort if the log event should be discarded.
 // If called from a Logger method, the first argument is the context
@@ -36,6 +82,15 @@ func NewLogHandler(logger golog.Logger, prefix string) *slogHandler {
 // The context is passed so Enabled can use its values
 // to make a decision.
 func (h *slogHandler) Enabled(_ context.Context, level slog.Level) bool {
+	if outputFor(h.levels, level) == OutputTrace {
+		if !h.logger.IsTraceEnabled() {
+			return false
+		}
+		// trace records are controlled by golog unless a level is set
+		if h.opts.Level == nil {
+			return true
+		}
+	}
 	minLevel := slog.LevelDebug
 	if h.opts.Level != nil {
 		minLevel = h.opts.Level.Level()
@@ -65,76 +120,127 @@ func (h *slogHandler) Handle(ctx context.Context, record slog.Record) error {
 		return nil
 	}
 
+	var arg interface{}
+	if h.structured {
+		arg = h.structuredRecord(record)
+	} else {
+		arg = h.textRecord(record)
+	}
+
+	switch outputFor(h.levels, record.Level) {
+	case OutputTrace:
+		h.logger.Trace(arg)
+	case OutputError:
+		// golog returns the logged error, it isn't a failure
+		_ = h.logger.Error(arg)
+	default:
+		h.logger.Debug(arg)
+	}
+	return nil
+}
+
+// textRecord renders the record as "LEVEL prefix: message key=value ...".
+// The time is left out, as golog timestamps the messages itself.
+func (h *slogHandler) textRecord(record slog.Record) string {
 	messageBuilder := new(strings.Builder)
-	messageBuilder.WriteString(record.Level.String())
-	messageBuilder.WriteString(" ")
+	if level := h.replaceAttr(nil, slog.Any(slog.LevelKey, record.Level)); level.Key != "" {
+		messageBuilder.WriteString(level.Value.String())
+		messageBuilder.WriteString(" ")
+	}
 	messageBuilder.WriteString(h.prefix)
 	messageBuilder.WriteString(": ")
-	messageBuilder.WriteString(record.Message)
-	messageBuilder.WriteString(" ")
+	if msg := h.replaceAttr(nil, slog.String(slog.MessageKey, record.Message)); msg.Key != "" {
+		messageBuilder.WriteString(msg.Value.String())
+	}
+	messageBuilder.WriteString(h.attrs)
 	record.Attrs(func(attr slog.Attr) bool {
-		messageBuilder.WriteString(attr.Key)
-		messageBuilder.WriteString("=")
-		messageBuilder.WriteString(attr.Value.String())
-		messageBuilder.WriteString(" ")
+		h.appendAttr(messageBuilder, h.groups, attr)
 		return true
 	})
+	return messageBuilder.String()
+}
 
-	messageBuilder.WriteString(h.attrs)
-	message := messageBuilder.String()
-
-	switch record.Level {
-	case slog.LevelDebug, slog.LevelInfo, slog.LevelWarn:
-		h.logger.Debug(message)
-	case slog.LevelError:
-		err := h.logger.Error(message)
-		if err != nil {
-			return err
-		}
-	default:
-		return fmt.Errorf("unsupported log level: %v", record.Level)
+// replaceAttr resolves the attribute value and applies
+// HandlerOptions.ReplaceAttr to it, unless it's a group.
+func (h *slogHandler) replaceAttr(groups []string, attr slog.Attr) slog.Attr {
+	attr.Value = attr.Value.Resolve()
+	if h.opts.ReplaceAttr != nil && attr.Value.Kind() != slog.KindGroup {
+		attr = h.opts.ReplaceAttr(groups, attr)
+		attr.Value = attr.Value.Resolve()
 	}
-	return nil
+	return attr
 }
 
 // WithAttrs returns a new Handler whose attributes consist of
 // both the receiver's attributes and the arguments.
 // The Handler owns the slice: it may retain, modify or discard it.
 func (h *slogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
-	h.attrs = parseAttrs(attrs)
-	return h
-}
-
-func parseAttrs(attrs []slog.Attr) string {
+	if len(attrs) == 0 {
+		return h
+	}
+	clone := *h
+	if h.structured {
+		clone.fields = make([]groupedAttr, len(h.fields), len(h.fields)+len(attrs))
+		copy(clone.fields, h.fields)
+		for _, attr := range attrs {
+			clone.fields = append(clone.fields, groupedAttr{groups: h.groups, attr: attr})
+		}
+		return &clone
+	}
 	attrsBuilder := new(strings.Builder)
+	attrsBuilder.WriteString(h.attrs)
 	for _, attr := range attrs {
-		attrsBuilder.WriteString(attr.Key)
-		attrsBuilder.WriteString(":")
-		switch attr.Value.Kind() {
-		case slog.KindString, slog.KindAny:
-			attrsBuilder.WriteString(attr.Value.String())
-		case slog.KindInt64:
-			fmt.Fprintf(attrsBuilder, "%d", attr.Value.Int64())
-		case slog.KindUint64:
-			fmt.Fprintf(attrsBuilder, "%d", attr.Value.Uint64())
-		case slog.KindFloat64:
-			fmt.Fprintf(attrsBuilder, "%f", attr.Value.Float64())
-		case slog.KindBool:
-			fmt.Fprintf(attrsBuilder, "%t", attr.Value.Bool())
-		case slog.KindTime:
-			attrsBuilder.WriteString(attr.Value.Time().String())
-		case slog.KindDuration:
-			attrsBuilder.WriteString(attr.Value.Duration().String())
-		case slog.KindLogValuer:
-			attrsBuilder.WriteString(attr.Value.LogValuer().LogValue().String())
-		case slog.KindGroup:
-			attrsBuilder.WriteString("{")
-			attrsBuilder.WriteString(parseAttrs(attr.Value.Group()))
-			attrsBuilder.WriteString("}")
+		h.appendAttr(attrsBuilder, h.groups, attr)
+	}
+	clone.attrs = attrsBuilder.String()
+	return &clone
+}
+
+// appendAttr writes the attribute as " key=value", qualifying the key with
+// the given groups separated by dots. Group attributes are flattened,
+// extending the groups with the group key unless it's empty.
+func (h *slogHandler) appendAttr(b *strings.Builder, groups []string, attr slog.Attr) {
+	attr = h.replaceAttr(groups, attr)
+	if attr.Equal(slog.Attr{}) || attr.Key == "" && attr.Value.Kind() != slog.KindGroup {
+		return
+	}
+	if attr.Value.Kind() == slog.KindGroup {
+		if attr.Key != "" {
+			groups = append(groups[:len(groups):len(groups)], attr.Key)
 		}
-		attrsBuilder.WriteString(" ")
+		for _, groupAttr := range attr.Value.Group() {
+			h.appendAttr(b, groups, groupAttr)
+		}
+		return
+	}
+	b.WriteString(" ")
+	b.WriteString(quoteIfNeeded(strings.Join(append(groups[:len(groups):len(groups)], attr.Key), ".")))
+	b.WriteString("=")
+	b.WriteString(quoteIfNeeded(formatValue(attr.Value)))
+}
+
+func formatValue(v slog.Value) string {
+	switch v.Kind() {
+	case slog.KindTime:
+		return v.Time().Format(time.RFC3339Nano)
+	case slog.KindFloat64:
+		return strconv.FormatFloat(v.Float64(), 'g', -1, 64)
+	default:
+		return v.String()
 	}
-	return attrsBuilder.String()
+}
+
+// quoteIfNeeded quotes strings that would be ambiguous in key=value output.
+func quoteIfNeeded(s string) string {
+	if s == "" {
+		return `""`
+	}
+	for _, r := range s {
+		if r == '=' || r == '"' || unicode.IsSpace(r) || !unicode.IsPrint(r) {
+			return strconv.Quote(s)
+		}
+	}
+	return s
 }
 
 // WithGroup returns a new Handler with the given group appended to
@@ -157,6 +263,10 @@ func parseAttrs(attrs []slog.Attr) string {
 //
 // If the name is empty, WithGroup returns the receiver.
 func (h *slogHandler) WithGroup(name string) slog.Handler {
-	// TODO: Implement WithGroup
-	return h
+	if name == "" {
+		return h
+	}
+	clone := *h
+	clone.groups = append(h.groups[:len(h.groups):len(h.groups)], name)
+	return &clone
 }
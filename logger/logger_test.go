@@ -0,0 +1,424 @@
+package logger
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"testing/slogtest"
+
+	"github.com/getlantern/golog"
+	"github.com/refraction-networking/water"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// captureOutput is a golog.Output keeping the messages written by loggers.
+type captureOutput struct {
+	mu      sync.Mutex
+	entries []entry
+}
+
+type entry struct {
+	severity string
+	message  string
+	values   map[string]interface{}
+}
+
+func (o *captureOutput) Debug(prefix string, skipFrames int, printStack bool, severity string, arg interface{}, values map[string]interface{}) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.entries = append(o.entries, entry{severity: severity, message: fmt.Sprint(arg), values: values})
+}
+
+func (o *captureOutput) Error(prefix string, skipFrames int, printStack bool, severity string, arg interface{}, values map[string]interface{}) {
+	o.Debug(prefix, skipFrames, printStack, severity, arg, values)
+}
+
+func (o *captureOutput) reset() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.entries = nil
+}
+
+func (o *captureOutput) lastEntry() entry {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if len(o.entries) == 0 {
+		return entry{}
+	}
+	return o.entries[len(o.entries)-1]
+}
+
+func (o *captureOutput) last() string {
+	return o.lastEntry().message
+}
+
+// traceLogger is a golog.Logger with tracing forced on or off.
+type traceLogger struct {
+	golog.Logger
+	traceOn bool
+	traced  []interface{}
+}
+
+func (l *traceLogger) IsTraceEnabled() bool {
+	return l.traceOn
+}
+
+func (l *traceLogger) Trace(arg interface{}) {
+	if l.traceOn {
+		l.traced = append(l.traced, arg)
+	}
+}
+
+func captureLogs(t *testing.T) *captureOutput {
+	out := new(captureOutput)
+	t.Cleanup(golog.SetOutput(out))
+	return out
+}
+
+// parseMessage parses a message with the format "LEVEL prefix: msg key=value ..."
+// into a map, nesting the keys qualified by groups.
+func parseMessage(t *testing.T, message string) map[string]any {
+	head, rest, ok := strings.Cut(message, ": ")
+	require.True(t, ok, "missing prefix in %q", message)
+	level, _, _ := strings.Cut(head, " ")
+	msg, rest, _ := strings.Cut(rest, " ")
+
+	m := map[string]any{slog.LevelKey: level, slog.MessageKey: msg}
+	for _, field := range strings.Fields(rest) {
+		key, value, ok := strings.Cut(field, "=")
+		require.True(t, ok, "invalid field %q in %q", field, message)
+		if unquoted, err := strconv.Unquote(value); err == nil {
+			value = unquoted
+		}
+		keys := strings.Split(key, ".")
+		group := m
+		for _, k := range keys[:len(keys)-1] {
+			sub, ok := group[k].(map[string]any)
+			if !ok {
+				sub = map[string]any{}
+				group[k] = sub
+			}
+			group = sub
+		}
+		group[keys[len(keys)-1]] = value
+	}
+	return m
+}
+
+func TestSlogHandler(t *testing.T) {
+	out := captureLogs(t)
+	slogtest.Run(t, func(t *testing.T) slog.Handler {
+		out.reset()
+		return NewLogHandler(golog.LoggerFor("test"), "test")
+	}, func(t *testing.T) map[string]any {
+		m := parseMessage(t, out.last())
+		// the text records leave the time to golog, which timestamps them
+		assert.NotContains(t, m, slog.TimeKey)
+		if !strings.HasSuffix(t.Name(), "/zero-time") {
+			m[slog.TimeKey] = "golog"
+		}
+		return m
+	})
+}
+
+func TestStructuredSlogHandler(t *testing.T) {
+	out := captureLogs(t)
+	slogtest.Run(t, func(t *testing.T) slog.Handler {
+		out.reset()
+		return NewLogHandlerWithOptions(golog.LoggerFor("test"), "test", HandlerOptions{Structured: true})
+	}, func(t *testing.T) map[string]any {
+		e := out.lastEntry()
+		m := map[string]any{slog.MessageKey: e.message}
+		for k, v := range e.values {
+			m[k] = v
+		}
+		return m
+	})
+}
+
+func TestStructuredFields(t *testing.T) {
+	out := captureLogs(t)
+	redact := func(groups []string, a slog.Attr) slog.Attr {
+		if a.Key == "password" {
+			return slog.String(a.Key, "REDACTED")
+		}
+		return a
+	}
+	logger := slog.New(NewLogHandlerWithOptions(golog.LoggerFor("test"), "reverse_v1", HandlerOptions{
+		HandlerOptions: slog.HandlerOptions{ReplaceAttr: redact},
+		Structured:     true,
+	}))
+
+	t.Run("it should send attributes as fields", func(t *testing.T) {
+		out.reset()
+		logger.With("conn", 1).WithGroup("g").Warn("hello", "err", errors.New("failed"), "password", "secret")
+		e := out.lastEntry()
+		assert.Equal(t, "hello", e.message)
+		assert.Equal(t, "ERROR", e.severity)
+		assert.Equal(t, "reverse_v1", e.values[TransportKey])
+		assert.Equal(t, "WARN", e.values[slog.LevelKey])
+		assert.Equal(t, int64(1), e.values["conn"])
+		assert.Equal(t, map[string]interface{}{"err": "failed", "password": "REDACTED"}, e.values["g"])
+	})
+
+	t.Run("it should encode fields with golog JSON output", func(t *testing.T) {
+		buf := new(bytes.Buffer)
+		reset := golog.SetOutput(golog.JsonOutput(buf, buf))
+		defer reset()
+		logger.Info("hello", "password", "secret", "a", 1)
+
+		var event map[string]interface{}
+		require.NoError(t, json.Unmarshal(buf.Bytes(), &event))
+		assert.Equal(t, "hello", event["msg"])
+		assert.Equal(t, map[string]interface{}{
+			TransportKey:  "reverse_v1",
+			slog.LevelKey: "INFO",
+			slog.TimeKey:  event["context"].(map[string]interface{})[slog.TimeKey],
+			"password":    "REDACTED",
+			"a":           float64(1),
+		}, event["context"])
+	})
+
+	t.Run("it should apply ReplaceAttr in text mode", func(t *testing.T) {
+		out.reset()
+		dropTime := func(groups []string, a slog.Attr) slog.Attr {
+			if a.Key == slog.TimeKey && len(groups) == 0 {
+				return slog.Attr{}
+			}
+			return redact(groups, a)
+		}
+		text := slog.New(NewLogHandlerWithOptions(golog.LoggerFor("test"), "reverse_v1", HandlerOptions{
+			HandlerOptions: slog.HandlerOptions{ReplaceAttr: dropTime},
+		}))
+		text.Info("hello", "password", "secret")
+		assert.Equal(t, "INFO reverse_v1: hello password=REDACTED", out.last())
+	})
+}
+
+func TestSlogHandlerIsImmutable(t *testing.T) {
+	out := captureLogs(t)
+	parent := slog.New(NewLogHandler(golog.LoggerFor("test"), "transport"))
+
+	var tests = []struct {
+		name   string
+		log    func()
+		assert func(t *testing.T, message string)
+	}{
+		{
+			name: "it should append attributes from chained With calls",
+			log:  func() { parent.With("a", 1).With("b", 2).Info("hello") },
+			assert: func(t *testing.T, message string) {
+				assert.Contains(t, message, " a=1")
+				assert.Contains(t, message, " b=2")
+			},
+		},
+		{
+			name: "it should not share attributes between sibling loggers",
+			log: func() {
+				parent.With("sibling", "first")
+				parent.With("other", "second").Info("hello")
+			},
+			assert: func(t *testing.T, message string) {
+				assert.NotContains(t, message, "sibling")
+				assert.Contains(t, message, " other=second")
+			},
+		},
+		{
+			name: "it should not modify the parent logger",
+			log: func() {
+				parent.With("a", 1).WithGroup("g")
+				parent.Info("hello", "b", 2)
+			},
+			assert: func(t *testing.T, message string) {
+				assert.NotContains(t, message, "a=1")
+				assert.Contains(t, message, " b=2")
+				assert.NotContains(t, message, "g.")
+			},
+		},
+		{
+			name: "it should qualify keys with nested groups",
+			log: func() {
+				parent.WithGroup("g").With("a", 1).WithGroup("h").Info("hello", slog.Group("i", "b", 2))
+			},
+			assert: func(t *testing.T, message string) {
+				assert.Contains(t, message, " g.a=1")
+				assert.Contains(t, message, " g.h.i.b=2")
+			},
+		},
+		{
+			name: "it should quote values with spaces",
+			log:  func() { parent.Info("hello", "err", "connection reset by peer") },
+			assert: func(t *testing.T, message string) {
+				assert.Contains(t, message, ` err="connection reset by peer"`)
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out.reset()
+			tt.log()
+			tt.assert(t, out.last())
+		})
+	}
+}
+
+func TestLevelMapping(t *testing.T) {
+	out := captureLogs(t)
+	ctx := context.Background()
+
+	var tests = []struct {
+		name   string
+		opts   HandlerOptions
+		level  slog.Level
+		assert func(t *testing.T, e entry)
+	}{
+		{
+			name:  "it should write info records as debug",
+			level: slog.LevelInfo,
+			assert: func(t *testing.T, e entry) {
+				assert.Equal(t, "DEBUG", e.severity)
+				assert.Contains(t, e.message, "INFO test: hello")
+			},
+		},
+		{
+			name:  "it should write warnings as errors",
+			level: slog.LevelWarn,
+			assert: func(t *testing.T, e entry) {
+				assert.Equal(t, "ERROR", e.severity)
+				assert.Contains(t, e.message, "WARN test: hello")
+			},
+		},
+		{
+			name:  "it should map custom levels to the closest lower level",
+			level: slog.LevelWarn + 2,
+			assert: func(t *testing.T, e entry) {
+				assert.Equal(t, "ERROR", e.severity)
+				assert.Contains(t, e.message, "WARN+2 test: hello")
+			},
+		},
+		{
+			name:  "it should map custom levels below the lowest level to its output",
+			opts:  HandlerOptions{HandlerOptions: slog.HandlerOptions{Level: slog.LevelDebug - 8}, Levels: map[slog.Level]Output{slog.LevelDebug: OutputDebug}},
+			level: slog.LevelDebug - 8,
+			assert: func(t *testing.T, e entry) {
+				assert.Equal(t, "DEBUG", e.severity)
+			},
+		},
+		{
+			name:  "it should use the configured mapping",
+			opts:  HandlerOptions{Levels: map[slog.Level]Output{slog.LevelDebug: OutputDebug, slog.LevelError: OutputError}},
+			level: slog.LevelWarn,
+			assert: func(t *testing.T, e entry) {
+				assert.Equal(t, "DEBUG", e.severity)
+			},
+		},
+		{
+			name:  "it should ignore records below the configured level",
+			opts:  HandlerOptions{HandlerOptions: slog.HandlerOptions{Level: slog.LevelWarn}},
+			level: slog.LevelInfo,
+			assert: func(t *testing.T, e entry) {
+				assert.Empty(t, e.message)
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out.reset()
+			logger := slog.New(NewLogHandlerWithOptions(golog.LoggerFor("test"), "test", tt.opts))
+			logger.Log(ctx, tt.level, "hello")
+			tt.assert(t, out.lastEntry())
+		})
+	}
+
+	t.Run("it should write trace records only when tracing is enabled", func(t *testing.T) {
+		out.reset()
+		disabled := &traceLogger{Logger: golog.LoggerFor("test")}
+		h := NewLogHandler(disabled, "test")
+		assert.False(t, h.Enabled(ctx, LevelTrace))
+		slog.New(h).Log(ctx, LevelTrace, "hello")
+		assert.Empty(t, disabled.traced)
+
+		enabled := &traceLogger{Logger: golog.LoggerFor("test"), traceOn: true}
+		h = NewLogHandler(enabled, "test")
+		assert.True(t, h.Enabled(ctx, LevelTrace))
+		slog.New(h).Log(ctx, LevelTrace, "hello")
+		require.Len(t, enabled.traced, 1)
+		assert.Contains(t, enabled.traced[0], "DEBUG-4 test: hello")
+		assert.Empty(t, out.lastEntry().message)
+	})
+}
+
+func TestConnContext(t *testing.T) {
+	out := captureLogs(t)
+	connCtx := NewConnContext()
+	assert.Len(t, connCtx.ID(), 16)
+	assert.NotEqual(t, connCtx.ID(), NewConnContext().ID())
+
+	log := slog.New(connCtx.Handler(NewLogHandler(golog.LoggerFor("test"), "test")))
+	connCtx.SetRemoteAddr("127.0.0.1:2")
+
+	t.Run("it should add the connection attributes", func(t *testing.T) {
+		out.reset()
+		log.Info("hello")
+		m := parseMessage(t, out.last())
+		assert.Equal(t, connCtx.ID(), m[ConnIDKey])
+		assert.Equal(t, "127.0.0.1:2", m[RemoteAddrKey])
+		assert.NotContains(t, m, LocalAddrKey)
+	})
+
+	t.Run("it should add addresses set after creating the handler", func(t *testing.T) {
+		out.reset()
+		connCtx.SetLocalAddr("127.0.0.1:1")
+		log.Info("hello")
+		m := parseMessage(t, out.last())
+		assert.Equal(t, "127.0.0.1:1", m[LocalAddrKey])
+	})
+
+	t.Run("it should not qualify the connection attributes with groups", func(t *testing.T) {
+		out.reset()
+		log.With("a", 1).WithGroup("g").Info("hello", "b", 2)
+		m := parseMessage(t, out.last())
+		assert.Equal(t, connCtx.ID(), m[ConnIDKey])
+		assert.Equal(t, "1", m["a"])
+		assert.Equal(t, map[string]any{"b": "2"}, m["g"])
+	})
+
+	t.Run("it should retrieve the ID from wrapped connections", func(t *testing.T) {
+		a, b := net.Pipe()
+		defer a.Close()
+		defer b.Close()
+		conn := WrapConn(&struct {
+			net.Conn
+			water.UnimplementedConn
+		}{Conn: a}, connCtx)
+		id, ok := ConnID(conn)
+		assert.True(t, ok)
+		assert.Equal(t, connCtx.ID(), id)
+
+		id, ok = ConnID(&wrappedConn{Conn: conn})
+		assert.True(t, ok)
+		assert.Equal(t, connCtx.ID(), id)
+
+		_, ok = ConnID(a)
+		assert.False(t, ok)
+	})
+}
+
+type wrappedConn struct {
+	net.Conn
+}
+
+func (c *wrappedConn) NetConn() net.Conn {
+	return c.Conn
+}
@@ -0,0 +1,110 @@
+package logger
+
+import (
+	"log/slog"
+
+	"github.com/getlantern/context"
+)
+
+// TransportKey is the field holding the handler prefix, usually the
+// transport name, in structured mode.
+const TransportKey = "transport"
+
+// groupedAttr is an attribute added by WithAttrs along with the groups that
+// were open when it was added.
+type groupedAttr struct {
+	groups []string
+	attr   slog.Attr
+}
+
+// Record is the argument given to golog in structured mode. It prints as the
+// record message and fills golog's context values with the record fields,
+// so golog outputs receive them as a map, e.g. golog.JsonOutput writes them
+// to the "context" object of every event. Attributes inside groups are
+// nested maps.
+type Record struct {
+	Message string
+	Fields  map[string]interface{}
+}
+
+// String returns the record message.
+func (r *Record) String() string {
+	return r.Message
+}
+
+// Error returns the record message. Implementing error keeps golog from
+// replacing the record, and its fields, when logging errors.
+func (r *Record) Error() string {
+	return r.Message
+}
+
+// Fill implements context.Contextual, used by golog for collecting the
+// values of a log argument.
+func (r *Record) Fill(m context.Map) {
+	for k, v := range r.Fields {
+		m[k] = v
+	}
+}
+
+func (h *slogHandler) structuredRecord(record slog.Record) *Record {
+	r := &Record{Fields: map[string]interface{}{TransportKey: h.prefix}}
+	if msg := h.replaceAttr(nil, slog.String(slog.MessageKey, record.Message)); msg.Key != "" {
+		r.Message = msg.Value.String()
+	}
+	h.addField(r.Fields, nil, slog.Any(slog.LevelKey, record.Level))
+	if !record.Time.IsZero() {
+		h.addField(r.Fields, nil, slog.Time(slog.TimeKey, record.Time))
+	}
+	for _, f := range h.fields {
+		h.addField(r.Fields, f.groups, f.attr)
+	}
+	record.Attrs(func(attr slog.Attr) bool {
+		h.addField(r.Fields, h.groups, attr)
+		return true
+	})
+	return r
+}
+
+// addField sets the attribute in the map nested by groups. Group maps are
+// only created once they have a field, so empty groups are ignored.
+func (h *slogHandler) addField(fields map[string]interface{}, groups []string, attr slog.Attr) {
+	attr = h.replaceAttr(groups, attr)
+	if attr.Equal(slog.Attr{}) || attr.Key == "" && attr.Value.Kind() != slog.KindGroup {
+		return
+	}
+	if attr.Value.Kind() == slog.KindGroup {
+		if attr.Key != "" {
+			groups = append(groups[:len(groups):len(groups)], attr.Key)
+		}
+		for _, groupAttr := range attr.Value.Group() {
+			h.addField(fields, groups, groupAttr)
+		}
+		return
+	}
+
+	for _, group := range groups {
+		sub, ok := fields[group].(map[string]interface{})
+		if !ok {
+			sub = map[string]interface{}{}
+			fields[group] = sub
+		}
+		fields = sub
+	}
+	fields[attr.Key] = fieldValue(attr.Value)
+}
+
+// fieldValue converts the value to something golog outputs can encode.
+func fieldValue(v slog.Value) interface{} {
+	switch v.Kind() {
+	case slog.KindDuration:
+		return v.Duration().String()
+	case slog.KindAny:
+		switch a := v.Any().(type) {
+		case error:
+			return a.Error()
+		case slog.Level:
+			return a.String()
+		}
+	}
+	return v.Any()
+}
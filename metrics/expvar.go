@@ -0,0 +1,76 @@
+package metrics
+
+import (
+	"expvar"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ExpvarRecorder is a Recorder keeping the metrics in an expvar.Map, which
+// can be published with expvar.Publish. Every combination of name and labels
+// is a key such as `water_accepts_total{transport="v1"}`. Observations keep
+// their count and sum in keys with the _count and _sum suffixes.
+type ExpvarRecorder struct {
+	m *expvar.Map
+}
+
+// NewExpvarRecorder creates an ExpvarRecorder with an unpublished map.
+func NewExpvarRecorder() *ExpvarRecorder {
+	return &ExpvarRecorder{m: new(expvar.Map)}
+}
+
+// Map returns the map holding the metrics.
+func (r *ExpvarRecorder) Map() *expvar.Map {
+	return r.m
+}
+
+// Add adds delta to the value of the metric.
+func (r *ExpvarRecorder) Add(name string, delta float64, labels Labels) {
+	r.m.AddFloat(key(name, labels), delta)
+}
+
+// Observe adds the value to the sum of the metric and increments its count.
+func (r *ExpvarRecorder) Observe(name string, value float64, labels Labels) {
+	r.m.AddFloat(key(name+"_sum", labels), value)
+	r.m.Add(key(name+"_count", labels), 1)
+}
+
+// Value returns the current value of the metric, or zero if it was never
+// recorded.
+func (r *ExpvarRecorder) Value(name string, labels Labels) float64 {
+	switch v := r.m.Get(key(name, labels)).(type) {
+	case *expvar.Float:
+		return v.Value()
+	case *expvar.Int:
+		return float64(v.Value())
+	default:
+		return 0
+	}
+}
+
+// key formats the metric name and its labels sorted by name.
+func key(name string, labels Labels) string {
+	if len(labels) == 0 {
+		return name
+	}
+	names := make([]string, 0, len(labels))
+	for k := range labels {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	b := new(strings.Builder)
+	b.WriteString(name)
+	b.WriteString("{")
+	for i, k := range names {
+		if i > 0 {
+			b.WriteString(",")
+		}
+		b.WriteString(k)
+		b.WriteString("=")
+		b.WriteString(strconv.Quote(labels[k]))
+	}
+	b.WriteString("}")
+	return b.String()
+}
@@ -0,0 +1,166 @@
+// Package metrics defines the metrics reported by the lantern-water packages.
+// It doesn't depend on any metrics library: implement Recorder for feeding the
+// values into Prometheus or any other system, or use the ExpvarRecorder for
+// publishing them with expvar.
+package metrics
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/refraction-networking/water"
+)
+
+// Names of the reported metrics. Counters end with _total and are only
+// increased, gauges go up and down and the remaining ones are observations.
+const (
+	// DialDuration observes the seconds taken by every dial, labeled by
+	// transport and result.
+	DialDuration = "water_dial_duration_seconds"
+	// DialErrors counts failed dials, labeled by transport.
+	DialErrors = "water_dial_errors_total"
+	// Accepts counts accepted connections, labeled by transport.
+	Accepts = "water_accepts_total"
+	// AcceptErrors counts connections that failed to be accepted, labeled by
+	// transport.
+	AcceptErrors = "water_accept_errors_total"
+	// ActiveConnections is a gauge of open connections, labeled by transport
+	// and direction.
+	ActiveConnections = "water_active_connections"
+	// BytesSent counts the bytes written to connections, labeled by
+	// transport and direction.
+	BytesSent = "water_bytes_sent_total"
+	// BytesReceived counts the bytes read from connections, labeled by
+	// transport and direction.
+	BytesReceived = "water_bytes_received_total"
+
+	// DownloadDuration observes the seconds taken by every download attempt,
+	// labeled by source and result.
+	DownloadDuration = "water_download_duration_seconds"
+	// DownloadBytes counts the downloaded bytes, labeled by source.
+	DownloadBytes = "water_download_bytes_total"
+	// DownloadRetries counts download attempts retried after a retryable
+	// error, labeled by source.
+	DownloadRetries = "water_download_retries_total"
+	// HashFailures counts downloads discarded because of a hash sum mismatch,
+	// labeled by source.
+	HashFailures = "water_hash_failures_total"
+
+	// GetWASMDuration observes the seconds taken by GetWASM, labeled by
+	// transport and result.
+	GetWASMDuration = "water_get_wasm_duration_seconds"
+	// CacheHits counts WASM modules loaded from the local cache, labeled by
+	// transport.
+	CacheHits = "water_cache_hits_total"
+	// CacheMisses counts WASM modules that had to be downloaded, labeled by
+	// transport.
+	CacheMisses = "water_cache_misses_total"
+	// CacheEvictions counts cached WASM modules deleted for not being used,
+	// labeled by transport.
+	CacheEvictions = "water_cache_evictions_total"
+)
+
+// Label names and values used by the reported metrics.
+const (
+	LabelTransport = "transport"
+	LabelDirection = "direction"
+	LabelResult    = "result"
+	LabelSource    = "source"
+
+	DirectionDial   = "dial"
+	DirectionAccept = "accept"
+
+	ResultSuccess = "success"
+	ResultFailure = "failure"
+)
+
+// Labels are the dimensions of a metric value.
+type Labels map[string]string
+
+// Recorder receives the metrics. Implementations must be safe for concurrent
+// use.
+type Recorder interface {
+	// Add adds delta to the counter or gauge with the given name and labels.
+	Add(name string, delta float64, labels Labels)
+	// Observe records a value, such as a duration in seconds, in the
+	// distribution with the given name and labels.
+	Observe(name string, value float64, labels Labels)
+}
+
+// Nop is a Recorder discarding every metric.
+type Nop struct{}
+
+// Add does nothing.
+func (Nop) Add(string, float64, Labels) {}
+
+// Observe does nothing.
+func (Nop) Observe(string, float64, Labels) {}
+
+// OrNop returns r, or Nop if r is nil.
+func OrNop(r Recorder) Recorder {
+	if r == nil {
+		return Nop{}
+	}
+	return r
+}
+
+// Result returns the result label value for err.
+func Result(err error) string {
+	if err != nil {
+		return ResultFailure
+	}
+	return ResultSuccess
+}
+
+// ObserveSince observes the seconds elapsed since start.
+func ObserveSince(r Recorder, name string, start time.Time, labels Labels) {
+	r.Observe(name, time.Since(start).Seconds(), labels)
+}
+
+// WrapConn returns a connection counting the bytes transferred through conn
+// and keeping the ActiveConnections gauge until it's closed. It increases the
+// gauge right away.
+func WrapConn(conn water.Conn, r Recorder, transport, direction string) water.Conn {
+	labels := Labels{LabelTransport: transport, LabelDirection: direction}
+	r.Add(ActiveConnections, 1, labels)
+	return &meteredConn{Conn: conn, recorder: r, labels: labels}
+}
+
+type meteredConn struct {
+	water.Conn
+	recorder  Recorder
+	labels    Labels
+	closeOnce sync.Once
+}
+
+func (c *meteredConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.recorder.Add(BytesReceived, float64(n), c.labels)
+	}
+	return n, err
+}
+
+func (c *meteredConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if n > 0 {
+		c.recorder.Add(BytesSent, float64(n), c.labels)
+	}
+	return n, err
+}
+
+// Close closes the connection and decreases the ActiveConnections gauge the
+// first time it's called.
+func (c *meteredConn) Close() error {
+	err := c.Conn.Close()
+	c.closeOnce.Do(func() {
+		c.recorder.Add(ActiveConnections, -1, c.labels)
+	})
+	return err
+}
+
+// NetConn returns the underlying connection.
+func (c *meteredConn) NetConn() net.Conn {
+	return c.Conn
+}
@@ -0,0 +1,60 @@
+package metrics
+
+import (
+	"errors"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/refraction-networking/water"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExpvarRecorder(t *testing.T) {
+	r := NewExpvarRecorder()
+	labels := Labels{LabelTransport: "v1", LabelResult: Result(nil)}
+
+	r.Add(Accepts, 1, Labels{LabelTransport: "v1"})
+	r.Add(Accepts, 2, Labels{LabelTransport: "v1"})
+	r.Observe(DialDuration, 0.5, labels)
+	r.Observe(DialDuration, 1.5, labels)
+
+	assert.Equal(t, float64(3), r.Value(Accepts, Labels{LabelTransport: "v1"}))
+	assert.Zero(t, r.Value(Accepts, Labels{LabelTransport: "v2"}))
+	assert.Equal(t, float64(2), r.Value(DialDuration+"_count", labels))
+	assert.Equal(t, float64(2), r.Value(DialDuration+"_sum", labels))
+	assert.NotNil(t, r.Map().Get(`water_dial_duration_seconds_count{result="success",transport="v1"}`))
+	assert.Equal(t, ResultFailure, Result(errors.New("failed")))
+}
+
+func TestWrapConn(t *testing.T) {
+	r := NewExpvarRecorder()
+	labels := Labels{LabelTransport: "v1", LabelDirection: DirectionDial}
+	a, b := net.Pipe()
+	defer b.Close()
+
+	conn := WrapConn(&struct {
+		net.Conn
+		water.UnimplementedConn
+	}{Conn: a}, r, "v1", DirectionDial)
+	assert.Equal(t, float64(1), r.Value(ActiveConnections, labels))
+
+	go func() {
+		buf := make([]byte, 5)
+		io.ReadFull(b, buf)
+		b.Write([]byte("world!"))
+	}()
+	_, err := conn.Write([]byte("hello"))
+	require.NoError(t, err)
+	buf := make([]byte, 6)
+	_, err = io.ReadFull(conn, buf)
+	require.NoError(t, err)
+
+	assert.Equal(t, float64(5), r.Value(BytesSent, labels))
+	assert.Equal(t, float64(6), r.Value(BytesReceived, labels))
+
+	require.NoError(t, conn.Close())
+	conn.Close()
+	assert.Zero(t, r.Value(ActiveConnections, labels))
+}
@@ -0,0 +1,376 @@
+// Package prober periodically dials through WATER transports and scores
+// them, so apps can decide which WASM to prefer on a given network.
+package prober
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/getlantern/golog"
+	"github.com/getlantern/lantern-water/dialer"
+	"github.com/refraction-networking/water"
+)
+
+const (
+	defaultInterval = time.Minute
+	defaultTimeout  = 10 * time.Second
+	// defaultPayloadSize is large enough for the echo to take longer than
+	// the round trip latency on most networks
+	defaultPayloadSize = 64 * 1024
+	// smoothing is the weight of the newest sample in the moving averages
+	smoothing = 0.3
+)
+
+// ProbeFunc runs a round trip through an established connection and returns
+// how many bytes were transferred.
+type ProbeFunc func(ctx context.Context, conn net.Conn) (int64, error)
+
+// EchoProbe writes the payload and expects the listener to send it back. The
+// payload is written while the response is read, so it can be larger than
+// the connection buffers.
+func EchoProbe(payload []byte) ProbeFunc {
+	return func(ctx context.Context, conn net.Conn) (int64, error) {
+		if deadline, ok := ctx.Deadline(); ok {
+			conn.SetDeadline(deadline)
+		}
+		written := make(chan error, 1)
+		go func() {
+			_, err := conn.Write(payload)
+			written <- err
+		}()
+		buf := make([]byte, len(payload))
+		_, readErr := io.ReadFull(conn, buf)
+		if readErr != nil {
+			// unblock the write if the listener stopped reading
+			conn.SetWriteDeadline(time.Now())
+		}
+		if err := <-written; err != nil {
+			return 0, fmt.Errorf("failed to write probe: %w", err)
+		}
+		if readErr != nil {
+			return int64(len(payload)), fmt.Errorf("failed to read probe response: %w", readErr)
+		}
+		if !bytes.Equal(payload, buf) {
+			return int64(2 * len(payload)), errors.New("probe response doesn't match the payload")
+		}
+		return int64(2 * len(payload)), nil
+	}
+}
+
+// HTTPProbe sends a GET request for the given URL through the connection and
+// expects a response with status lower than 500.
+func HTTPProbe(url string) ProbeFunc {
+	return func(ctx context.Context, conn net.Conn) (int64, error) {
+		if deadline, ok := ctx.Deadline(); ok {
+			conn.SetDeadline(deadline)
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, http.NoBody)
+		if err != nil {
+			return 0, fmt.Errorf("failed to create a new HTTP request: %w", err)
+		}
+		counter := &countingConn{Conn: conn}
+		if err = req.Write(counter); err != nil {
+			return counter.n, fmt.Errorf("failed to send a HTTP request: %w", err)
+		}
+		resp, err := http.ReadResponse(bufio.NewReader(counter), req)
+		if err != nil {
+			return counter.n, fmt.Errorf("failed to read HTTP response: %w", err)
+		}
+		defer resp.Body.Close()
+		if _, err = io.Copy(io.Discard, resp.Body); err != nil {
+			return counter.n, fmt.Errorf("failed to read HTTP response body: %w", err)
+		}
+		if resp.StatusCode >= http.StatusInternalServerError {
+			return counter.n, fmt.Errorf("unexpected HTTP status: %s", resp.Status)
+		}
+		return counter.n, nil
+	}
+}
+
+type countingConn struct {
+	net.Conn
+	n int64
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.n += int64(n)
+	return n, err
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.n += int64(n)
+	return n, err
+}
+
+// Target is a transport that should be probed.
+type Target struct {
+	Transport string // Specifies transport being used.
+	WASM      []byte // The WASM module to use.
+	Address   string // The listener address to dial.
+}
+
+// Params are used when creating a new Prober.
+type Params struct {
+	// An optional golog.Logger used for keeping compatibility with http-proxy
+	// and flashlight logger. If not defined the dialers will use the default
+	// water logger.
+	Logger golog.Logger
+	// Targets are the transports being probed.
+	Targets []Target
+	// Interval between probe rounds. Defaults to one minute.
+	Interval time.Duration
+	// Timeout for a single probe, including the dial. Defaults to 10 seconds.
+	Timeout time.Duration
+	// Probe is the round trip executed through every connection. Defaults to
+	// an echo of a random payload of PayloadSize bytes.
+	Probe ProbeFunc
+	// PayloadSize is the size of the payload echoed by the default probe.
+	// The throughput is only meaningful when the transfer takes longer than
+	// the round trip latency, so it should be large enough for the network.
+	// Defaults to 64 KiB.
+	PayloadSize int
+}
+
+// Score contains the probing results for a transport.
+type Score struct {
+	Transport string
+	Attempts  int
+	Successes int
+	// SuccessRate is the ratio of successful probes, from 0 to 1.
+	SuccessRate float64
+	// HandshakeLatency is the moving average of the time needed for dialing
+	// through the transport, including the WASM handshake.
+	HandshakeLatency time.Duration
+	// Throughput is the moving average of bytes per second during the probe.
+	// As it includes the round trip latency, it estimates the bandwidth only
+	// when the probe transfers enough data, see Params.PayloadSize.
+	Throughput float64
+	// LastError is the error of the last probe, nil if it succeeded.
+	LastError error
+	// LastProbe is when the transport was last probed.
+	LastProbe time.Time
+	// Value summarizes the score, higher is better. It's the success rate
+	// penalized by the handshake latency in seconds, so failed probes only
+	// lower it through the success rate. The throughput isn't part of it.
+	Value float64
+}
+
+type target struct {
+	Target
+	dialer water.Dialer
+	score  Score
+}
+
+// Prober probes transports and keeps a Score for each one of them.
+type Prober struct {
+	log      golog.Logger
+	interval time.Duration
+	timeout  time.Duration
+	probe    ProbeFunc
+
+	mu          sync.Mutex
+	targets     []*target
+	subscribers map[chan Score]struct{}
+}
+
+// New creates a dialer for every target and returns a Prober for them.
+func New(ctx context.Context, params Params) (*Prober, error) {
+	if len(params.Targets) == 0 {
+		return nil, errors.New("prober requires at least one target")
+	}
+
+	targets := make([]*target, 0, len(params.Targets))
+	for _, t := range params.Targets {
+		d, err := dialer.NewDialer(ctx, dialer.DialerParameters{
+			Logger:    params.Logger,
+			Transport: t.Transport,
+			WASM:      t.WASM,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to create dialer for transport %s: %w", t.Transport, err)
+		}
+		targets = append(targets, &target{Target: t, dialer: d, score: Score{Transport: t.Transport}})
+	}
+
+	p := &Prober{
+		log:         params.Logger,
+		interval:    params.Interval,
+		timeout:     params.Timeout,
+		probe:       params.Probe,
+		targets:     targets,
+		subscribers: make(map[chan Score]struct{}),
+	}
+	if p.interval <= 0 {
+		p.interval = defaultInterval
+	}
+	if p.timeout <= 0 {
+		p.timeout = defaultTimeout
+	}
+	if p.probe == nil {
+		size := params.PayloadSize
+		if size <= 0 {
+			size = defaultPayloadSize
+		}
+		payload := make([]byte, size)
+		rand.Read(payload)
+		p.probe = EchoProbe(payload)
+	}
+	return p, nil
+}
+
+// Run probes all targets every interval until the context is done.
+func (p *Prober) Run(ctx context.Context) {
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+	for {
+		p.ProbeOnce(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// ProbeOnce probes all targets concurrently and waits for the results.
+func (p *Prober) ProbeOnce(ctx context.Context) {
+	wg := new(sync.WaitGroup)
+	for _, t := range p.targets {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p.probeTarget(ctx, t)
+		}()
+	}
+	wg.Wait()
+}
+
+// probeTarget probes the target and records the result, unless the parent
+// context is done, as the probe was then interrupted instead of failing.
+func (p *Prober) probeTarget(parent context.Context, t *target) {
+	ctx, cancel := context.WithTimeout(parent, p.timeout)
+	defer cancel()
+
+	start := time.Now()
+	conn, err := t.dialer.DialContext(ctx, "tcp", t.Address)
+	if err != nil {
+		if parent.Err() == nil {
+			p.record(t, 0, 0, 0, fmt.Errorf("failed to dial: %w", err))
+		}
+		return
+	}
+	defer conn.Close()
+	handshake := time.Since(start)
+
+	start = time.Now()
+	n, err := p.probe(ctx, conn)
+	if parent.Err() == nil {
+		p.record(t, handshake, n, time.Since(start), err)
+	}
+}
+
+func (p *Prober) record(t *target, handshake time.Duration, n int64, roundTrip time.Duration, err error) {
+	p.mu.Lock()
+	s := &t.score
+	s.Attempts++
+	s.LastProbe = time.Now()
+	s.LastError = err
+	if err == nil {
+		s.Successes++
+		s.HandshakeLatency = ewmaDuration(s.HandshakeLatency, handshake, s.Successes == 1)
+		if roundTrip > 0 {
+			s.Throughput = ewma(s.Throughput, float64(n)/roundTrip.Seconds(), s.Successes == 1)
+		}
+	}
+	s.SuccessRate = float64(s.Successes) / float64(s.Attempts)
+	s.Value = s.SuccessRate / (1 + s.HandshakeLatency.Seconds())
+	// the updates are sent with mu held, so unsubscribing can close the
+	// channel, and they never block
+	for ch := range p.subscribers {
+		select {
+		case ch <- *s:
+		default:
+		}
+	}
+	p.mu.Unlock()
+
+	if err != nil && p.log != nil {
+		p.log.Debugf("probe for transport %s failed: %v", t.Transport, err)
+	}
+}
+
+func ewma(avg, sample float64, first bool) float64 {
+	if first {
+		return sample
+	}
+	return smoothing*sample + (1-smoothing)*avg
+}
+
+func ewmaDuration(avg, sample time.Duration, first bool) time.Duration {
+	return time.Duration(ewma(float64(avg), float64(sample), first))
+}
+
+// Scores returns the score of every target, best first.
+func (p *Prober) Scores() []Score {
+	p.mu.Lock()
+	scores := make([]Score, 0, len(p.targets))
+	for _, t := range p.targets {
+		scores = append(scores, t.score)
+	}
+	p.mu.Unlock()
+
+	slices.SortStableFunc(scores, func(a, b Score) int {
+		switch {
+		case a.Value > b.Value:
+			return -1
+		case a.Value < b.Value:
+			return 1
+		default:
+			return 0
+		}
+	})
+	return scores
+}
+
+// Score returns the score for the given transport.
+func (p *Prober) Score(transport string) (Score, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, t := range p.targets {
+		if t.Transport == transport {
+			return t.score, true
+		}
+	}
+	return Score{}, false
+}
+
+// Subscribe returns a channel receiving the updated score after every probe,
+// and a function to unsubscribe, which closes the channel. Updates are
+// dropped if the channel buffer is full.
+func (p *Prober) Subscribe() (<-chan Score, func()) {
+	ch := make(chan Score, len(p.targets))
+	p.mu.Lock()
+	p.subscribers[ch] = struct{}{}
+	p.mu.Unlock()
+
+	return ch, func() {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		if _, ok := p.subscribers[ch]; ok {
+			delete(p.subscribers, ch)
+			close(ch)
+		}
+	}
+}
@@ -0,0 +1,179 @@
+package prober
+
+import (
+	"context"
+	"embed"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/getlantern/golog"
+	"github.com/getlantern/lantern-water/listener"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+//go:embed testdata/*
+var testData embed.FS
+
+func TestProber(t *testing.T) {
+	ctx := context.Background()
+	f, err := testData.Open("testdata/reverse_v1.wasm")
+	require.NoError(t, err)
+	wasm, err := io.ReadAll(f)
+	require.NoError(t, err)
+
+	ll, err := listener.NewWATERListener(ctx, listener.ListenerParams{
+		Logger:    golog.LoggerFor("water_listener"),
+		Transport: "reverse_v1",
+		Address:   "127.0.0.1:0",
+		WASM:      wasm,
+	})
+	require.NoError(t, err)
+	defer ll.Close()
+	go func() {
+		for {
+			conn, err := ll.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	closedAddr := closed.Addr().String()
+	require.NoError(t, closed.Close())
+
+	p, err := New(ctx, Params{
+		Logger: golog.LoggerFor("water_prober"),
+		Targets: []Target{
+			{Transport: "blocked", WASM: wasm, Address: closedAddr},
+			{Transport: "working", WASM: wasm, Address: ll.Addr().String()},
+		},
+		Timeout: 5 * time.Second,
+	})
+	require.NoError(t, err)
+
+	updates, unsubscribe := p.Subscribe()
+	defer unsubscribe()
+
+	p.ProbeOnce(ctx)
+	p.ProbeOnce(ctx)
+
+	scores := p.Scores()
+	require.Len(t, scores, 2)
+
+	working := scores[0]
+	assert.Equal(t, "working", working.Transport)
+	assert.Equal(t, 2, working.Attempts)
+	assert.Equal(t, 2, working.Successes)
+	assert.Equal(t, 1.0, working.SuccessRate)
+	assert.Positive(t, working.HandshakeLatency)
+	assert.Positive(t, working.Throughput)
+	assert.Positive(t, working.Value)
+	assert.NoError(t, working.LastError)
+
+	blocked, ok := p.Score("blocked")
+	require.True(t, ok)
+	assert.Equal(t, blocked, scores[1])
+	assert.Equal(t, 2, blocked.Attempts)
+	assert.Zero(t, blocked.Successes)
+	assert.Zero(t, blocked.Value)
+	assert.Error(t, blocked.LastError)
+
+	_, ok = p.Score("unknown")
+	assert.False(t, ok)
+
+	received := 0
+	for len(updates) > 0 {
+		<-updates
+		received++
+	}
+	assert.Equal(t, 2, received, "updates should be dropped when the subscriber buffer is full")
+
+	unsubscribe()
+	_, ok = <-updates
+	assert.False(t, ok, "unsubscribing should close the channel")
+	p.ProbeOnce(ctx)
+}
+
+func TestProberCanceled(t *testing.T) {
+	wasm, err := testData.ReadFile("testdata/reverse_v1.wasm")
+	require.NoError(t, err)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	p, err := New(ctx, Params{
+		Logger:  golog.LoggerFor("water_prober"),
+		Targets: []Target{{Transport: "reverse_v1", WASM: wasm, Address: l.Addr().String()}},
+		Timeout: 5 * time.Second,
+		// the probe is interrupted by canceling the context of the prober
+		Probe: func(probeCtx context.Context, conn net.Conn) (int64, error) {
+			cancel()
+			<-probeCtx.Done()
+			return 0, probeCtx.Err()
+		},
+	})
+	require.NoError(t, err)
+	updates, unsubscribe := p.Subscribe()
+	defer unsubscribe()
+
+	p.ProbeOnce(ctx)
+	p.ProbeOnce(ctx)
+	score, ok := p.Score("reverse_v1")
+	require.True(t, ok)
+	assert.Zero(t, score.Attempts, "interrupted probes should not be recorded")
+	assert.Empty(t, updates)
+}
+
+func TestEchoProbe(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	go func() {
+		defer server.Close()
+		buf := make([]byte, 5)
+		io.ReadFull(server, buf)
+		server.Write([]byte("world"))
+	}()
+
+	n, err := EchoProbe([]byte("hello"))(context.Background(), client)
+	assert.ErrorContains(t, err, "doesn't match")
+	assert.Equal(t, int64(10), n)
+}
+
+func TestEchoProbeLargePayload(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	go func() {
+		defer server.Close()
+		io.Copy(server, server)
+	}()
+
+	payload := make([]byte, 1<<20)
+	for i := range payload {
+		payload[i] = byte(i)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	n, err := EchoProbe(payload)(ctx, client)
+	require.NoError(t, err)
+	assert.Equal(t, int64(2*len(payload)), n)
+}
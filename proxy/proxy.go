@@ -0,0 +1,306 @@
+// Package proxy provides a local SOCKS5 and HTTP CONNECT proxy that forwards
+// every request through a WATER connection, and the matching listener-side
+// Tunnel that connects the requests to their targets.
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/getlantern/golog"
+	"github.com/getlantern/lantern-water/server"
+	"github.com/refraction-networking/water"
+)
+
+const (
+	socksVersion        = 0x05
+	socksNoAuth         = 0x00
+	socksNoAcceptable   = 0xff
+	socksCmdConnect     = 0x01
+	socksAddrIPv4       = 0x01
+	socksAddrDomain     = 0x03
+	socksAddrIPv6       = 0x04
+	socksSucceeded      = 0x00
+	socksGeneralFailure = 0x01
+	socksHostUnreach    = 0x04
+	socksCmdUnsupported = 0x07
+	socksAddrUnsupport  = 0x08
+)
+
+// Params are used when creating a new proxy Server.
+type Params struct {
+	// An optional golog.Logger used for keeping compatibility with http-proxy
+	// and flashlight logger.
+	Logger golog.Logger
+	// Dialer is the WATER dialer used for every proxied request.
+	Dialer water.Dialer
+	// Address is the address of the WATER listener running a Tunnel.
+	Address string
+}
+
+// Server is a local proxy accepting SOCKS5 and HTTP CONNECT requests and
+// forwarding them through WATER connections.
+type Server struct {
+	log     golog.Logger
+	dialer  water.Dialer
+	address string
+
+	mu        sync.Mutex
+	listeners map[net.Listener]struct{}
+	closed    bool
+}
+
+// NewServer creates a new proxy Server.
+func NewServer(params Params) (*Server, error) {
+	if params.Dialer == nil {
+		return nil, errors.New("proxy server requires a dialer")
+	}
+	if params.Address == "" {
+		return nil, errors.New("proxy server requires the WATER listener address")
+	}
+	log := params.Logger
+	if log == nil {
+		log = golog.LoggerFor("lantern-water-proxy")
+	}
+	return &Server{
+		log:       log,
+		dialer:    params.Dialer,
+		address:   params.Address,
+		listeners: make(map[net.Listener]struct{}),
+	}, nil
+}
+
+// ListenAndServe listens on the given local address and serves requests.
+func (s *Server) ListenAndServe(ctx context.Context, addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen: %w", err)
+	}
+	return s.Serve(ctx, l)
+}
+
+// Serve accepts connections from the listener and serves them until the
+// listener fails or the server is closed.
+func (s *Server) Serve(ctx context.Context, l net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return net.ErrClosed
+	}
+	s.listeners[l] = struct{}{}
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.listeners, l)
+		s.mu.Unlock()
+		l.Close()
+	}()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go s.handle(ctx, conn)
+	}
+}
+
+// Close stops all listeners. Established connections are not closed.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	var errs error
+	for l := range s.listeners {
+		errs = errors.Join(errs, l.Close())
+	}
+	return errs
+}
+
+func (s *Server) handle(ctx context.Context, conn net.Conn) {
+	defer conn.Close()
+	br := bufio.NewReader(conn)
+	first, err := br.Peek(1)
+	if err != nil {
+		s.log.Debugf("failed to read from %s: %v", conn.RemoteAddr(), err)
+		return
+	}
+
+	client := &bufferedConn{Conn: conn, r: br}
+	if first[0] == socksVersion {
+		err = s.handleSOCKS(ctx, client)
+	} else {
+		err = s.handleHTTP(ctx, client)
+	}
+	if err != nil {
+		s.log.Debugf("failed to proxy request from %s: %v", conn.RemoteAddr(), err)
+	}
+}
+
+// dialTarget dials through WATER and asks the Tunnel to connect to target.
+func (s *Server) dialTarget(ctx context.Context, target string) (net.Conn, error) {
+	conn, err := s.dialer.DialContext(ctx, "tcp", s.address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to dial WATER listener: %w", err)
+	}
+	if err = writeTarget(conn, target); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if err = readStatus(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+func (s *Server) handleHTTP(ctx context.Context, client *bufferedConn) error {
+	req, err := http.ReadRequest(client.r)
+	if err != nil {
+		return fmt.Errorf("failed to read HTTP request: %w", err)
+	}
+	if req.Method != http.MethodConnect {
+		io.WriteString(client, "HTTP/1.1 405 Method Not Allowed\r\nContent-Length: 0\r\n\r\n")
+		return fmt.Errorf("unsupported HTTP method: %s", req.Method)
+	}
+
+	upstream, err := s.dialTarget(ctx, connectTarget(req.Host))
+	if err != nil {
+		io.WriteString(client, "HTTP/1.1 502 Bad Gateway\r\nContent-Length: 0\r\n\r\n")
+		return err
+	}
+	defer upstream.Close()
+
+	if _, err = io.WriteString(client, "HTTP/1.1 200 Connection established\r\n\r\n"); err != nil {
+		return fmt.Errorf("failed to write HTTP response: %w", err)
+	}
+	_, _, err = server.Pipe(client, upstream, 0)
+	return err
+}
+
+// connectTarget returns the target of a CONNECT request to host, which
+// defaults to port 443 when it has none.
+func connectTarget(host string) string {
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host
+	}
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	return net.JoinHostPort(host, "443")
+}
+
+func (s *Server) handleSOCKS(ctx context.Context, client *bufferedConn) error {
+	// greeting: VER NMETHODS METHODS...
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(client, header); err != nil {
+		return fmt.Errorf("failed to read SOCKS greeting: %w", err)
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(client, methods); err != nil {
+		return fmt.Errorf("failed to read SOCKS methods: %w", err)
+	}
+	method := byte(socksNoAcceptable)
+	for _, m := range methods {
+		if m == socksNoAuth {
+			method = socksNoAuth
+		}
+	}
+	if _, err := client.Write([]byte{socksVersion, method}); err != nil {
+		return fmt.Errorf("failed to write SOCKS method: %w", err)
+	}
+	if method == socksNoAcceptable {
+		return errors.New("client doesn't support SOCKS without authentication")
+	}
+
+	// request: VER CMD RSV ATYP DST.ADDR DST.PORT
+	request := make([]byte, 4)
+	if _, err := io.ReadFull(client, request); err != nil {
+		return fmt.Errorf("failed to read SOCKS request: %w", err)
+	}
+	target, reply, err := readSOCKSAddr(client, request[3])
+	if err != nil {
+		writeSOCKSReply(client, reply)
+		return err
+	}
+	if request[1] != socksCmdConnect {
+		writeSOCKSReply(client, socksCmdUnsupported)
+		return fmt.Errorf("unsupported SOCKS command: %d", request[1])
+	}
+
+	upstream, err := s.dialTarget(ctx, target)
+	if err != nil {
+		writeSOCKSReply(client, socksHostUnreach)
+		return err
+	}
+	defer upstream.Close()
+
+	if err = writeSOCKSReply(client, socksSucceeded); err != nil {
+		return fmt.Errorf("failed to write SOCKS reply: %w", err)
+	}
+	_, _, err = server.Pipe(client, upstream, 0)
+	return err
+}
+
+func readSOCKSAddr(r io.Reader, addrType byte) (string, byte, error) {
+	var host string
+	switch addrType {
+	case socksAddrIPv4, socksAddrIPv6:
+		size := net.IPv4len
+		if addrType == socksAddrIPv6 {
+			size = net.IPv6len
+		}
+		ip := make(net.IP, size)
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return "", socksGeneralFailure, fmt.Errorf("failed to read SOCKS address: %w", err)
+		}
+		host = ip.String()
+	case socksAddrDomain:
+		size := make([]byte, 1)
+		if _, err := io.ReadFull(r, size); err != nil {
+			return "", socksGeneralFailure, fmt.Errorf("failed to read SOCKS address: %w", err)
+		}
+		domain := make([]byte, size[0])
+		if _, err := io.ReadFull(r, domain); err != nil {
+			return "", socksGeneralFailure, fmt.Errorf("failed to read SOCKS address: %w", err)
+		}
+		host = string(domain)
+	default:
+		return "", socksAddrUnsupport, fmt.Errorf("unsupported SOCKS address type: %d", addrType)
+	}
+
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(r, port); err != nil {
+		return "", socksGeneralFailure, fmt.Errorf("failed to read SOCKS port: %w", err)
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))), socksSucceeded, nil
+}
+
+func writeSOCKSReply(w io.Writer, reply byte) error {
+	// the bound address isn't meaningful for the client, so it's always 0.0.0.0:0
+	_, err := w.Write([]byte{socksVersion, reply, 0x00, socksAddrIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
+
+// bufferedConn is a net.Conn reading through a bufio.Reader, so bytes
+// buffered while parsing the request are not lost.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// NetConn returns the underlying connection.
+func (c *bufferedConn) NetConn() net.Conn {
+	return c.Conn
+}
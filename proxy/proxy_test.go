@@ -0,0 +1,259 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"embed"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"testing"
+
+	"github.com/getlantern/golog"
+	"github.com/getlantern/lantern-water/dialer"
+	"github.com/getlantern/lantern-water/listener"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+//go:embed testdata/*
+var testData embed.FS
+
+// allowAll allows the Tunnel to connect to the echo servers on loopback.
+func allowAll(string, string) error {
+	return nil
+}
+
+// startEcho runs an echo server and returns its address.
+func startEcho(t *testing.T) string {
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { echo.Close() })
+	go func() {
+		for {
+			conn, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return echo.Addr().String()
+}
+
+// startProxy runs an echo server as target, a WATER listener running a
+// Tunnel and a proxy Server dialing through WATER. It returns the proxy and
+// the echo server addresses.
+func startProxy(t *testing.T, params TunnelParams) (string, string) {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	f, err := testData.Open("testdata/reverse_v1.wasm")
+	require.NoError(t, err)
+	wasm, err := io.ReadAll(f)
+	require.NoError(t, err)
+
+	echoAddr := startEcho(t)
+
+	ll, err := listener.NewWATERListener(ctx, listener.ListenerParams{
+		Logger:    golog.LoggerFor("water_listener"),
+		Transport: "reverse_v1",
+		Address:   "127.0.0.1:0",
+		WASM:      wasm,
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { ll.Close() })
+	params.Logger = golog.LoggerFor("water_tunnel")
+	go NewTunnel(params).Serve(ctx, ll)
+
+	d, err := dialer.NewDialer(ctx, dialer.DialerParameters{
+		Logger:    golog.LoggerFor("water_dialer"),
+		Transport: "reverse_v1",
+		WASM:      wasm,
+	})
+	require.NoError(t, err)
+
+	server, err := NewServer(Params{
+		Logger:  golog.LoggerFor("water_proxy"),
+		Dialer:  d,
+		Address: ll.Addr().String(),
+	})
+	require.NoError(t, err)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { server.Close() })
+	go server.Serve(ctx, l)
+
+	return l.Addr().String(), echoAddr
+}
+
+func socksConnect(t *testing.T, proxyAddr, target string) (net.Conn, byte) {
+	conn, err := net.Dial("tcp", proxyAddr)
+	require.NoError(t, err)
+
+	_, err = conn.Write([]byte{socksVersion, 1, socksNoAuth})
+	require.NoError(t, err)
+	method := make([]byte, 2)
+	_, err = io.ReadFull(conn, method)
+	require.NoError(t, err)
+	require.Equal(t, []byte{socksVersion, socksNoAuth}, method)
+
+	host, portStr, err := net.SplitHostPort(target)
+	require.NoError(t, err)
+	port, err := strconv.Atoi(portStr)
+	require.NoError(t, err)
+	req := []byte{socksVersion, socksCmdConnect, 0x00, socksAddrIPv4}
+	req = append(req, net.ParseIP(host).To4()...)
+	req = binary.BigEndian.AppendUint16(req, uint16(port))
+	_, err = conn.Write(req)
+	require.NoError(t, err)
+
+	reply := make([]byte, 10)
+	_, err = io.ReadFull(conn, reply)
+	require.NoError(t, err)
+	return conn, reply[1]
+}
+
+func assertEcho(t *testing.T, conn net.Conn) {
+	_, err := conn.Write([]byte("hello"))
+	require.NoError(t, err)
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(conn, buf)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(buf))
+}
+
+func TestServer(t *testing.T) {
+	proxyAddr, echoAddr := startProxy(t, TunnelParams{AllowTarget: allowAll})
+
+	t.Run("it should tunnel SOCKS5 requests", func(t *testing.T) {
+		conn, reply := socksConnect(t, proxyAddr, echoAddr)
+		defer conn.Close()
+		require.Equal(t, byte(socksSucceeded), reply)
+		assertEcho(t, conn)
+	})
+
+	t.Run("it should reply host unreachable when the tunnel can't connect", func(t *testing.T) {
+		closed, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		closedAddr := closed.Addr().String()
+		require.NoError(t, closed.Close())
+
+		conn, reply := socksConnect(t, proxyAddr, closedAddr)
+		defer conn.Close()
+		assert.Equal(t, byte(socksHostUnreach), reply)
+	})
+
+	t.Run("it should tunnel HTTP CONNECT requests", func(t *testing.T) {
+		conn, err := net.Dial("tcp", proxyAddr)
+		require.NoError(t, err)
+		defer conn.Close()
+
+		_, err = conn.Write([]byte("CONNECT " + echoAddr + " HTTP/1.1\r\nHost: " + echoAddr + "\r\n\r\n"))
+		require.NoError(t, err)
+		br := bufio.NewReader(conn)
+		resp, err := http.ReadResponse(br, nil)
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		assertEcho(t, &bufferedConn{Conn: conn, r: br})
+	})
+
+	t.Run("it should reject HTTP requests other than CONNECT", func(t *testing.T) {
+		conn, err := net.Dial("tcp", proxyAddr)
+		require.NoError(t, err)
+		defer conn.Close()
+
+		_, err = conn.Write([]byte("GET http://" + echoAddr + "/ HTTP/1.1\r\nHost: " + echoAddr + "\r\n\r\n"))
+		require.NoError(t, err)
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+	})
+}
+
+func TestConnectTarget(t *testing.T) {
+	tests := []struct {
+		host string
+		want string
+	}{
+		{host: "example.com:8080", want: "example.com:8080"},
+		{host: "example.com", want: "example.com:443"},
+		{host: "1.2.3.4", want: "1.2.3.4:443"},
+		{host: "[2001:db8::1]", want: "[2001:db8::1]:443"},
+		{host: "[2001:db8::1]:80", want: "[2001:db8::1]:80"},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, connectTarget(tt.host), tt.host)
+	}
+}
+
+func TestDenyPrivateTargets(t *testing.T) {
+	tests := []struct {
+		addr    string
+		allowed bool
+	}{
+		{addr: "127.0.0.1:80"},
+		{addr: "[::1]:80"},
+		{addr: "[::ffff:127.0.0.1]:80"},
+		{addr: "10.1.2.3:80"},
+		{addr: "172.16.0.1:80"},
+		{addr: "192.168.1.1:443"},
+		{addr: "[fd00::1]:443"},
+		{addr: "169.254.169.254:80"},
+		{addr: "[fe80::1]:80"},
+		{addr: "0.0.0.0:80"},
+		{addr: "93.184.216.34:443", allowed: true},
+		{addr: "[2606:2800:220:1::1]:443", allowed: true},
+		{addr: "example.com:443", allowed: true},
+	}
+	for _, tt := range tests {
+		err := DenyPrivateTargets("tcp", tt.addr)
+		if tt.allowed {
+			assert.NoError(t, err, tt.addr)
+		} else {
+			assert.ErrorIs(t, err, ErrTargetNotAllowed, tt.addr)
+		}
+	}
+}
+
+func TestTunnelAllowTarget(t *testing.T) {
+	t.Run("it should reply host unreachable for targets denied by default", func(t *testing.T) {
+		proxyAddr, echoAddr := startProxy(t, TunnelParams{})
+		conn, reply := socksConnect(t, proxyAddr, echoAddr)
+		defer conn.Close()
+		assert.Equal(t, byte(socksHostUnreach), reply)
+	})
+
+	t.Run("it should deny host names resolving to denied addresses", func(t *testing.T) {
+		_, port, err := net.SplitHostPort(startEcho(t))
+		require.NoError(t, err)
+		client, conn := net.Pipe()
+		defer client.Close()
+		go NewTunnel(TunnelParams{}).HandleConn(context.Background(), conn)
+
+		require.NoError(t, writeTarget(client, net.JoinHostPort("localhost", port)))
+		assert.ErrorIs(t, readStatus(client), errTargetUnreachable)
+	})
+
+	t.Run("it should use the given AllowTarget", func(t *testing.T) {
+		echoAddr := startEcho(t)
+		var targets []string
+		tunnel := NewTunnel(TunnelParams{AllowTarget: func(network, addr string) error {
+			targets = append(targets, network+" "+addr)
+			return nil
+		}})
+		client, conn := net.Pipe()
+		defer client.Close()
+		go tunnel.HandleConn(context.Background(), conn)
+
+		require.NoError(t, writeTarget(client, echoAddr))
+		require.NoError(t, readStatus(client))
+		assertEcho(t, client)
+		assert.Equal(t, []string{"tcp " + echoAddr, "tcp4 " + echoAddr}, targets)
+	})
+}
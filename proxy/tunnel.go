@@ -0,0 +1,200 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"syscall"
+	"time"
+
+	"github.com/getlantern/golog"
+	"github.com/getlantern/lantern-water/server"
+)
+
+// The proxy Server and the Tunnel talk a minimal protocol on top of the WATER
+// connection: the Server sends the target address prefixed by its length in a
+// single byte and the Tunnel answers with a status byte before the payload
+// starts flowing in both directions.
+const (
+	statusOK          = 0x00
+	statusUnreachable = 0x01
+
+	defaultDialTimeout = 30 * time.Second
+)
+
+var (
+	// ErrTargetNotAllowed is returned by DenyPrivateTargets for the targets
+	// the Tunnel must not connect to.
+	ErrTargetNotAllowed = errors.New("target not allowed")
+
+	// errTargetUnreachable is returned by the Server when the Tunnel can't
+	// connect to the target.
+	errTargetUnreachable = errors.New("tunnel failed to connect to target")
+)
+
+// DenyPrivateTargets is the default TunnelParams.AllowTarget. It denies the
+// loopback, private, link-local and unspecified addresses, so the clients of
+// a Tunnel can't reach the host and the network it runs in. Host names are
+// allowed, as they're only resolved when dialing: the default dialer of the
+// Tunnel checks the resolved addresses again.
+func DenyPrivateTargets(network, addr string) error {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Errorf("invalid target address %q: %w", addr, err)
+	}
+	ip, err := netip.ParseAddr(host)
+	if err != nil {
+		return nil
+	}
+	ip = ip.Unmap()
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsUnspecified() {
+		return fmt.Errorf("%w: %s", ErrTargetNotAllowed, addr)
+	}
+	return nil
+}
+
+func writeTarget(w io.Writer, target string) error {
+	if len(target) == 0 || len(target) > 255 {
+		return fmt.Errorf("invalid target address: %q", target)
+	}
+	if _, err := w.Write(append([]byte{byte(len(target))}, target...)); err != nil {
+		return fmt.Errorf("failed to write target: %w", err)
+	}
+	return nil
+}
+
+func readTarget(r io.Reader) (string, error) {
+	size := make([]byte, 1)
+	if _, err := io.ReadFull(r, size); err != nil {
+		return "", fmt.Errorf("failed to read target: %w", err)
+	}
+	target := make([]byte, size[0])
+	if _, err := io.ReadFull(r, target); err != nil {
+		return "", fmt.Errorf("failed to read target: %w", err)
+	}
+	return string(target), nil
+}
+
+func readStatus(r io.Reader) error {
+	status := make([]byte, 1)
+	if _, err := io.ReadFull(r, status); err != nil {
+		return fmt.Errorf("failed to read tunnel status: %w", err)
+	}
+	if status[0] != statusOK {
+		return errTargetUnreachable
+	}
+	return nil
+}
+
+// TunnelParams are used when creating a new Tunnel.
+type TunnelParams struct {
+	// An optional golog.Logger used for keeping compatibility with http-proxy
+	// and flashlight logger.
+	Logger golog.Logger
+	// DialContext is an optional function used for connecting to targets.
+	// If not defined a net.Dialer is used.
+	DialContext func(ctx context.Context, network, address string) (net.Conn, error)
+	// AllowTarget is an optional function returning an error for the targets
+	// the Tunnel must not connect to. It's called with every target before
+	// dialing it and, when DialContext isn't defined, with every address the
+	// target resolves to before connecting to it. Defaults to
+	// DenyPrivateTargets.
+	AllowTarget func(network, addr string) error
+	// DialTimeout bounds the time for connecting to a target. Defaults to 30
+	// seconds.
+	DialTimeout time.Duration
+	// IdleTimeout closes tunnels after no data flows for this long. Zero
+	// means no timeout.
+	IdleTimeout time.Duration
+}
+
+// Tunnel is the listener-side counterpart of the proxy Server. It reads the
+// target sent by the Server through every accepted WATER connection, connects
+// to it and forwards the traffic.
+type Tunnel struct {
+	log         golog.Logger
+	dialContext func(ctx context.Context, network, address string) (net.Conn, error)
+	allowTarget func(network, addr string) error
+	dialTimeout time.Duration
+	idleTimeout time.Duration
+}
+
+// NewTunnel creates a new Tunnel.
+func NewTunnel(params TunnelParams) *Tunnel {
+	t := &Tunnel{
+		log:         params.Logger,
+		dialContext: params.DialContext,
+		allowTarget: params.AllowTarget,
+		dialTimeout: params.DialTimeout,
+		idleTimeout: params.IdleTimeout,
+	}
+	if t.log == nil {
+		t.log = golog.LoggerFor("lantern-water-tunnel")
+	}
+	if t.allowTarget == nil {
+		t.allowTarget = DenyPrivateTargets
+	}
+	if t.dialContext == nil {
+		d := &net.Dialer{
+			// host names may resolve to addresses that aren't allowed
+			Control: func(network, address string, _ syscall.RawConn) error {
+				return t.allowTarget(network, address)
+			},
+		}
+		t.dialContext = d.DialContext
+	}
+	if t.dialTimeout <= 0 {
+		t.dialTimeout = defaultDialTimeout
+	}
+	return t
+}
+
+// Serve handles every connection accepted by the listener, usually the one
+// returned by listener.NewWATERListener, until it fails.
+func (t *Tunnel) Serve(ctx context.Context, l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go t.HandleConn(ctx, conn)
+	}
+}
+
+// HandleConn connects the WATER connection to the target it requests, if
+// allowed, and forwards the traffic until both sides are done. It closes
+// conn.
+func (t *Tunnel) HandleConn(ctx context.Context, conn net.Conn) {
+	defer conn.Close()
+	target, err := readTarget(conn)
+	if err != nil {
+		t.log.Debugf("failed to read target from %s: %v", conn.RemoteAddr(), err)
+		return
+	}
+
+	if err = t.allowTarget("tcp", target); err != nil {
+		t.log.Debugf("refused to connect to %s: %v", target, err)
+		conn.Write([]byte{statusUnreachable})
+		return
+	}
+	dialCtx, cancel := context.WithTimeout(ctx, t.dialTimeout)
+	upstream, err := t.dialContext(dialCtx, "tcp", target)
+	cancel()
+	if err != nil {
+		t.log.Debugf("failed to connect to %s: %v", target, err)
+		conn.Write([]byte{statusUnreachable})
+		return
+	}
+	defer upstream.Close()
+
+	if _, err = conn.Write([]byte{statusOK}); err != nil {
+		t.log.Debugf("failed to write status to %s: %v", conn.RemoteAddr(), err)
+		return
+	}
+	if _, _, err = server.Pipe(conn, upstream, t.idleTimeout); err != nil {
+		t.log.Debugf("failed to forward %s to %s: %v", conn.RemoteAddr(), target, err)
+	}
+}
@@ -0,0 +1,177 @@
+// Package relay contains the WATER relay creation functions
+package relay
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"sync"
+
+	"github.com/getlantern/golog"
+	"github.com/getlantern/lantern-water/listener"
+	"github.com/getlantern/lantern-water/logger"
+	"github.com/getlantern/lantern-water/server"
+	"github.com/refraction-networking/water"
+	_ "github.com/refraction-networking/water/transport/v1"
+)
+
+// RelayParams contain arguments/parameters used for creating a new WATER relay
+type RelayParams struct {
+	// BaseListener is a listener accepting the incoming connections, it's
+	// optional and can be nil. If nil, the relay listens on ListenAddress.
+	BaseListener net.Listener
+	// An optional golog.Logger used for keeping compatibility with http-proxy
+	// and flashlight logger. If not defined the relay will use the default
+	// water logger.
+	Logger golog.Logger
+	// Transport represents the protocol, version or whatever detail that will
+	// be used at local logs to help understanding which WASM file is being used
+	Transport string
+	// ListenAddress is the address where incoming connections are accepted
+	ListenAddress string
+	// RemoteAddress is the address every relayed connection is dialed to
+	RemoteAddress string
+	// WASM must contain the WASM data used by the WATER relay
+	WASM []byte
+	// Unwrap makes the relay accept WATER connections and relay the unwrapped
+	// traffic to the remote address as plain TCP, as a WATER listener
+	// forwarding its connections would. By default the relay accepts plain
+	// connections and wraps the traffic.
+	Unwrap bool
+}
+
+// Relay accepts plain connections and relays each one to the remote address
+// through a WATER connection dialed with the WASM transport, as a WATER
+// dialer would: the traffic sent to the remote address is wrapped and the
+// traffic received from it unwrapped. With RelayParams.Unwrap it works the
+// other way around, accepting WATER connections as a WATER listener would
+// and relaying them to the remote address as plain TCP connections.
+type Relay struct {
+	listener net.Listener
+	// serve relays the connections until stop is called
+	serve func() error
+	stop  func() error
+
+	mu     sync.Mutex
+	closed bool
+}
+
+// NewRelay creates a WATER relay. Call Serve to start relaying.
+// The context controls the lifetime of every relayed connection: when it's
+// done, established connections are terminated.
+func NewRelay(ctx context.Context, params RelayParams) (*Relay, error) {
+	if params.RemoteAddress == "" {
+		return nil, errors.New("relay requires a remote address")
+	}
+
+	l := params.BaseListener
+	if l == nil {
+		var err error
+		if l, err = net.Listen("tcp", params.ListenAddress); err != nil {
+			return nil, err
+		}
+	}
+
+	r := &Relay{listener: l}
+	var err error
+	if params.Unwrap {
+		err = r.unwrap(ctx, params)
+	} else {
+		err = r.wrap(ctx, params)
+	}
+	if err != nil {
+		l.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+// wrap relays the plain connections accepted by the listener through WATER
+// connections dialed to the remote address.
+func (r *Relay) wrap(ctx context.Context, params RelayParams) error {
+	cfg := &water.Config{
+		TransportModuleBin: params.WASM,
+		NetworkListener:    r.listener,
+	}
+
+	if params.Logger != nil {
+		cfg.OverrideLogger = slog.New(logger.NewLogHandler(params.Logger, params.Transport))
+	}
+
+	waterRelay, err := water.NewRelayWithContext(ctx, cfg)
+	if err != nil {
+		return err
+	}
+	r.serve = func() error {
+		return waterRelay.RelayTo("tcp", params.RemoteAddress)
+	}
+	r.stop = waterRelay.Close
+	return nil
+}
+
+// unwrap relays the WATER connections accepted by the listener through plain
+// connections dialed to the remote address.
+func (r *Relay) unwrap(ctx context.Context, params RelayParams) error {
+	wl, err := listener.NewWATERListener(ctx, listener.ListenerParams{
+		BaseListener: r.listener,
+		Logger:       params.Logger,
+		Transport:    params.Transport,
+		WASM:         params.WASM,
+	})
+	if err != nil {
+		return err
+	}
+	srv, err := server.New(server.Params{
+		Logger:   params.Logger,
+		Upstream: params.RemoteAddress,
+	})
+	if err != nil {
+		return err
+	}
+	r.serve = func() error {
+		return srv.Serve(ctx, wl)
+	}
+	// closing the listener only stops accepting, unlike closing the server
+	r.stop = wl.Close
+	return nil
+}
+
+// Addr returns the address where the relay accepts connections.
+func (r *Relay) Addr() net.Addr {
+	return r.listener.Addr()
+}
+
+// Serve relays incoming connections until the relay is closed. It returns nil
+// after Close.
+func (r *Relay) Serve() error {
+	err := r.serve()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return nil
+	}
+	return err
+}
+
+// Close gracefully shuts the relay down: it stops accepting new connections
+// while established connections keep running until they're done or the
+// context given to NewRelay is done.
+func (r *Relay) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return nil
+	}
+	r.closed = true
+	err := r.stop()
+	if errors.Is(err, net.ErrClosed) {
+		err = nil
+	}
+	// the WATER relay only closes the listener once it's running, so close it
+	// here in case Serve was never called
+	if closeErr := r.listener.Close(); closeErr != nil && !errors.Is(closeErr, net.ErrClosed) {
+		err = errors.Join(err, closeErr)
+	}
+	return err
+}
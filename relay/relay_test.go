@@ -0,0 +1,238 @@
+package relay
+
+import (
+	"context"
+	"embed"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/getlantern/golog"
+	"github.com/getlantern/lantern-water/dialer"
+	"github.com/getlantern/lantern-water/listener"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+//go:embed testdata/*
+var testData embed.FS
+
+func echo(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			io.Copy(conn, conn)
+		}()
+	}
+}
+
+func assertEcho(t *testing.T, conn net.Conn) {
+	_, err := conn.Write([]byte("hello"))
+	require.NoError(t, err)
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(conn, buf)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(buf))
+}
+
+// plainServer accepts a single connection, sends the first 5 bytes it reads
+// to received and replies "world". It keeps the connection open until the
+// client closes it, as WATER connections can't be half-closed.
+func plainServer(t *testing.T) (string, <-chan []byte) {
+	plain, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { plain.Close() })
+	received := make(chan []byte, 1)
+	go func() {
+		conn, err := plain.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		buf := make([]byte, 5)
+		io.ReadFull(conn, buf)
+		received <- buf
+		conn.Write([]byte("world"))
+		io.Copy(io.Discard, conn)
+	}()
+	return plain.Addr().String(), received
+}
+
+// TestRelay chains a relay and a WATER listener: the relay accepts plain TCP
+// and wraps it for the WATER listener.
+func TestRelay(t *testing.T) {
+	ctx := context.Background()
+	f, err := testData.Open("testdata/reverse_v1.wasm")
+	require.NoError(t, err)
+	wasm, err := io.ReadAll(f)
+	require.NoError(t, err)
+
+	ll, err := listener.NewWATERListener(ctx, listener.ListenerParams{
+		Logger:    golog.LoggerFor("water_listener"),
+		Transport: "reverse_v1",
+		Address:   "127.0.0.1:0",
+		WASM:      wasm,
+	})
+	require.NoError(t, err)
+	defer ll.Close()
+	go echo(ll)
+
+	t.Run("it should wrap plain connections for a WATER listener", func(t *testing.T) {
+		r, err := NewRelay(ctx, RelayParams{
+			Logger:        golog.LoggerFor("water_relay"),
+			Transport:     "reverse_v1",
+			ListenAddress: "127.0.0.1:0",
+			RemoteAddress: ll.Addr().String(),
+			WASM:          wasm,
+		})
+		require.NoError(t, err)
+		served := make(chan error, 1)
+		go func() { served <- r.Serve() }()
+
+		conn, err := net.Dial("tcp", r.Addr().String())
+		require.NoError(t, err)
+		assertEcho(t, conn)
+
+		// graceful shutdown keeps the established connection running
+		require.NoError(t, r.Close())
+		assert.NoError(t, <-served)
+		assertEcho(t, conn)
+		conn.Close()
+
+		_, err = net.Dial("tcp", r.Addr().String())
+		assert.Error(t, err)
+	})
+
+	t.Run("it should wrap the outbound traffic only", func(t *testing.T) {
+		plainAddr, received := plainServer(t)
+		r, err := NewRelay(ctx, RelayParams{
+			Logger:        golog.LoggerFor("water_relay"),
+			Transport:     "reverse_v1",
+			ListenAddress: "127.0.0.1:0",
+			RemoteAddress: plainAddr,
+			WASM:          wasm,
+		})
+		require.NoError(t, err)
+		defer r.Close()
+		go r.Serve()
+
+		conn, err := net.Dial("tcp", r.Addr().String())
+		require.NoError(t, err)
+		defer conn.Close()
+		_, err = conn.Write([]byte("hello"))
+		require.NoError(t, err)
+		// reverse_v1 reverses the bytes, so the remote address receives the
+		// wrapped traffic reversed and the client the unwrapped reply reversed
+		assert.Equal(t, "olleh", string(<-received))
+		buf := make([]byte, 5)
+		_, err = io.ReadFull(conn, buf)
+		require.NoError(t, err)
+		assert.Equal(t, "dlrow", string(buf))
+	})
+
+	t.Run("it should unwrap WATER connections for a plain remote address", func(t *testing.T) {
+		plainAddr, received := plainServer(t)
+		r, err := NewRelay(ctx, RelayParams{
+			Logger:        golog.LoggerFor("water_relay"),
+			Transport:     "reverse_v1",
+			ListenAddress: "127.0.0.1:0",
+			RemoteAddress: plainAddr,
+			WASM:          wasm,
+			Unwrap:        true,
+		})
+		require.NoError(t, err)
+		served := make(chan error, 1)
+		go func() { served <- r.Serve() }()
+
+		d, err := dialer.NewDialer(ctx, dialer.DialerParameters{
+			Logger:    golog.LoggerFor("water_dialer"),
+			Transport: "reverse_v1",
+			WASM:      wasm,
+		})
+		require.NoError(t, err)
+		conn, err := d.DialContext(ctx, "tcp", r.Addr().String())
+		require.NoError(t, err)
+		defer conn.Close()
+		_, err = conn.Write([]byte("hello"))
+		require.NoError(t, err)
+		// the dialer and the relay reverse the bytes twice, so the remote
+		// address and the client receive them as sent
+		assert.Equal(t, "hello", string(<-received))
+		buf := make([]byte, 5)
+		_, err = io.ReadFull(conn, buf)
+		require.NoError(t, err)
+		assert.Equal(t, "world", string(buf))
+
+		require.NoError(t, r.Close())
+		assert.NoError(t, <-served)
+	})
+
+	t.Run("it should close the relay before serving", func(t *testing.T) {
+		r, err := NewRelay(ctx, RelayParams{
+			Transport:     "reverse_v1",
+			ListenAddress: "127.0.0.1:0",
+			RemoteAddress: ll.Addr().String(),
+			WASM:          wasm,
+		})
+		require.NoError(t, err)
+		require.NoError(t, r.Close())
+		assert.NoError(t, r.Serve())
+	})
+}
+
+// TestRelayChain chains a WATER dialer, a relay unwrapping its connections, a
+// relay wrapping them again and a WATER listener, so the traffic goes through
+// four WATER transports.
+func TestRelayChain(t *testing.T) {
+	ctx := context.Background()
+	wasm, err := testData.ReadFile("testdata/reverse_v1.wasm")
+	require.NoError(t, err)
+
+	ll, err := listener.NewWATERListener(ctx, listener.ListenerParams{
+		Logger:    golog.LoggerFor("water_listener"),
+		Transport: "reverse_v1",
+		Address:   "127.0.0.1:0",
+		WASM:      wasm,
+	})
+	require.NoError(t, err)
+	defer ll.Close()
+	go echo(ll)
+
+	wrap, err := NewRelay(ctx, RelayParams{
+		Logger:        golog.LoggerFor("water_relay"),
+		Transport:     "reverse_v1",
+		ListenAddress: "127.0.0.1:0",
+		RemoteAddress: ll.Addr().String(),
+		WASM:          wasm,
+	})
+	require.NoError(t, err)
+	defer wrap.Close()
+	go wrap.Serve()
+
+	unwrap, err := NewRelay(ctx, RelayParams{
+		Logger:        golog.LoggerFor("water_relay"),
+		Transport:     "reverse_v1",
+		ListenAddress: "127.0.0.1:0",
+		RemoteAddress: wrap.Addr().String(),
+		WASM:          wasm,
+		Unwrap:        true,
+	})
+	require.NoError(t, err)
+	defer unwrap.Close()
+	go unwrap.Serve()
+
+	d, err := dialer.NewDialer(ctx, dialer.DialerParameters{
+		Logger:    golog.LoggerFor("water_dialer"),
+		Transport: "reverse_v1",
+		WASM:      wasm,
+	})
+	require.NoError(t, err)
+	conn, err := d.DialContext(ctx, "tcp", unwrap.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	assertEcho(t, conn)
+}
@@ -0,0 +1,520 @@
+package seed
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/anacrolix/generics"
+	"github.com/anacrolix/torrent"
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/anacrolix/torrent/storage"
+)
+
+// SeedManager seeds several WASM files from a single torrent client, so they
+// share one listening port and DHT node. Files can be added and removed at
+// runtime, and the ones of watched directories are kept in sync with them.
+type SeedManager struct {
+	client       *torrent.Client
+	storage      storage.ClientImplCloser
+	announceList [][]string
+	webSeeds     []string
+
+	quota       int64
+	quotaPeriod time.Duration
+
+	mu      sync.Mutex
+	files   map[string]*seededFile // by absolute path, or name for readers
+	watches map[string]bool
+	paused  bool // uploads are paused until the next quota period
+	done    chan struct{}
+	// wg counts the watches and the files being added
+	wg sync.WaitGroup
+}
+
+type seededFile struct {
+	torrent *torrent.Torrent
+	storage storage.ClientImplCloser
+	// name is the name of the file in its torrent, and path its absolute
+	// path, empty for readers
+	name      string
+	path      string
+	magnetURI string
+	size      int64
+	modTime   time.Time
+	// watchDir is the watched directory the file was found in, if any
+	watchDir string
+	// uploaded is the data uploaded already counted in the quota
+	uploaded int64
+}
+
+// FileStats holds the state of a seeded file.
+type FileStats struct {
+	// Name is the name of the file in its torrent, the one given for the
+	// files seeded from memory.
+	Name string
+	// Path is the absolute path of the file. It's empty for the files seeded
+	// from memory, which aren't read from disk.
+	Path string
+	// MagnetURI is the magnet URI of the file.
+	MagnetURI string
+	// Peers is the number of peers connected for the file.
+	Peers int
+	// UploadedBytes is the amount of file data uploaded to peers.
+	UploadedBytes int64
+}
+
+// NewSeedManager creates a SeedManager without any file. The announce list
+// and options apply to all the files.
+func NewSeedManager(announceList [][]string, httpClient *http.Client, opts ...Option) (*SeedManager, error) {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.uploadRateLimit < 0 || o.maxPeers < 0 || o.uploadQuota < 0 {
+		return nil, errors.New("limits must not be negative")
+	}
+	if o.uploadQuota > 0 && o.quotaPeriod <= 0 {
+		return nil, errors.New("upload quota period must be positive")
+	}
+
+	cfg := torrent.NewDefaultClientConfig()
+	// every file is added with its own storage, the default one is only set
+	// so the client doesn't create a piece completion database
+	defaultStorage := newFileStorage(os.TempDir())
+	cfg.DefaultStorage = defaultStorage
+	cfg.Seed = true
+	cfg.NoDHT = false
+	cfg.NoUpload = false
+	cfg.PeriodicallyAnnounceTorrentsToDht = true
+	cfg.AcceptPeerConnections = true
+	applyPlatformConfig(cfg)
+	if httpClient != nil {
+		cfg.WebTransport = httpClient.Transport
+	}
+	o.apply(cfg)
+
+	client, err := torrent.NewClient(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("creating torrent client: %w", errors.Join(err, defaultStorage.Close()))
+	}
+	m := &SeedManager{
+		client:       client,
+		storage:      defaultStorage,
+		announceList: announceList,
+		webSeeds:     o.webSeeds,
+		quota:        o.uploadQuota,
+		quotaPeriod:  o.quotaPeriod,
+		files:        make(map[string]*seededFile),
+		watches:      make(map[string]bool),
+		done:         make(chan struct{}),
+	}
+	if m.quota > 0 {
+		m.wg.Add(1)
+		go func() {
+			defer m.wg.Done()
+			m.enforceQuota()
+		}()
+	}
+	return m, nil
+}
+
+// Add begins seeding the file at filePath and returns its magnet URI. Adding
+// a file already seeded only seeds it again if it changed since.
+func (m *SeedManager) Add(filePath string) (string, error) {
+	return m.add(filePath, "")
+}
+
+func (m *SeedManager) add(filePath, watchDir string) (string, error) {
+	path, err := filepath.Abs(filePath)
+	if err != nil {
+		return "", fmt.Errorf("resolving path: %w", err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", fmt.Errorf("reading file info: %w", err)
+	}
+	if !info.Mode().IsRegular() {
+		return "", fmt.Errorf("%s is not a regular file", path)
+	}
+
+	m.mu.Lock()
+	if err = m.startAdding(); err != nil {
+		m.mu.Unlock()
+		return "", err
+	}
+	defer m.wg.Done()
+	if f, ok := m.files[path]; ok {
+		if f.size == info.Size() && f.modTime.Equal(info.ModTime()) {
+			m.mu.Unlock()
+			return f.magnetURI, nil
+		}
+		// the torrent of the changed file is dropped before seeding it again,
+		// as its content may be the same
+		if err = m.remove(path); err != nil {
+			m.mu.Unlock()
+			return "", err
+		}
+	}
+	m.mu.Unlock()
+
+	mi, err := buildMetainfo(path, m.announceList, m.webSeeds)
+	if err != nil {
+		return "", fmt.Errorf("building metainfo: %w", err)
+	}
+	f, err := m.seed(mi, newFileStorage(filepath.Dir(path)))
+	if err != nil {
+		return "", err
+	}
+	f.path, f.size, f.modTime, f.watchDir = path, info.Size(), info.ModTime(), watchDir
+	return m.publish(path, f)
+}
+
+// addReaderAt begins seeding the size bytes of r as a file with the given
+// name, which names it in the seeded files too.
+func (m *SeedManager) addReaderAt(name string, r io.ReaderAt, size int64) (string, error) {
+	m.mu.Lock()
+	err := m.startAdding()
+	if err == nil && m.files[name] != nil {
+		m.wg.Done()
+		err = fmt.Errorf("%s is already seeded", name)
+	}
+	m.mu.Unlock()
+	if err != nil {
+		return "", err
+	}
+	defer m.wg.Done()
+
+	mi, err := buildReaderMetainfo(name, r, size, m.announceList, m.webSeeds)
+	if err != nil {
+		return "", fmt.Errorf("building metainfo: %w", err)
+	}
+	f, err := m.seed(mi, newReaderStorage(r, size))
+	if err != nil {
+		return "", err
+	}
+	return m.publish(name, f)
+}
+
+// startAdding fails if the manager is closed, or counts the file being added
+// in wg so Close waits for it, with mu held. The file is hashed and verified
+// without holding mu, so the other files can be used meanwhile.
+func (m *SeedManager) startAdding() error {
+	if m.isClosed() {
+		return errors.New("seed manager is closed")
+	}
+	m.wg.Add(1)
+	return nil
+}
+
+// seed adds the torrent of the metainfo with its storage and verifies its
+// data. The storage is closed on failure. Its uploads are disallowed until
+// it's published.
+func (m *SeedManager) seed(mi *metainfo.MetaInfo, impl storage.ClientImplCloser) (*seededFile, error) {
+	magnet, err := mi.MagnetV2()
+	if err != nil {
+		return nil, fmt.Errorf("building magnet URI: %w", errors.Join(err, impl.Close()))
+	}
+	spec, err := torrent.TorrentSpecFromMetaInfoErr(mi)
+	if err != nil {
+		return nil, fmt.Errorf("building torrent spec: %w", errors.Join(err, impl.Close()))
+	}
+
+	spec.Storage = impl
+	spec.DisallowDataDownload = true
+	spec.DisallowDataUpload = true
+	t, isNew, err := m.client.AddTorrentSpec(spec)
+	if err != nil {
+		return nil, fmt.Errorf("adding torrent: %w", errors.Join(err, impl.Close()))
+	}
+	if !isNew {
+		return nil, errors.Join(errors.New("a file with the same name and content is already seeded"), impl.Close())
+	}
+	<-t.GotInfo()
+	if err = t.VerifyDataContext(context.Background()); err != nil {
+		t.Drop()
+		return nil, fmt.Errorf("verifying data: %w", errors.Join(err, impl.Close()))
+	}
+	return &seededFile{torrent: t, storage: impl, name: t.Name(), magnetURI: magnet.String()}, nil
+}
+
+// publish makes the verified file seeded under key, replacing the file added
+// concurrently under the same key, if any.
+func (m *SeedManager) publish(key string, f *seededFile) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.isClosed() {
+		f.torrent.Drop()
+		return "", errors.Join(errors.New("seed manager is closed"), f.storage.Close())
+	}
+	if _, ok := m.files[key]; ok {
+		if err := m.remove(key); err != nil {
+			f.torrent.Drop()
+			return "", errors.Join(err, f.storage.Close())
+		}
+	}
+	if !m.paused {
+		f.torrent.AllowDataUpload()
+	}
+	m.files[key] = f
+	return f.magnetURI, nil
+}
+
+// Remove stops seeding the file at filePath.
+func (m *SeedManager) Remove(filePath string) error {
+	path, err := filepath.Abs(filePath)
+	if err != nil {
+		return fmt.Errorf("resolving path: %w", err)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.files[path]; !ok {
+		return fmt.Errorf("file %s is not seeded", path)
+	}
+	return m.remove(path)
+}
+
+// remove stops seeding the file at the absolute path, with mu held.
+func (m *SeedManager) remove(path string) error {
+	f := m.files[path]
+	delete(m.files, path)
+	f.torrent.Drop()
+	if err := f.storage.Close(); err != nil {
+		return fmt.Errorf("closing torrent storage: %w", err)
+	}
+	return nil
+}
+
+// Stats returns the state of the file at filePath, and whether it's seeded.
+func (m *SeedManager) Stats(filePath string) (FileStats, bool) {
+	path, err := filepath.Abs(filePath)
+	if err != nil {
+		return FileStats{}, false
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	f, ok := m.files[path]
+	if !ok {
+		return FileStats{}, false
+	}
+	return f.stats(), true
+}
+
+// Files returns the state of all the seeded files, sorted by path then name.
+func (m *SeedManager) Files() []FileStats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	files := make([]FileStats, 0, len(m.files))
+	for _, f := range m.files {
+		files = append(files, f.stats())
+	}
+	sort.Slice(files, func(i, j int) bool {
+		if files[i].Path != files[j].Path {
+			return files[i].Path < files[j].Path
+		}
+		return files[i].Name < files[j].Name
+	})
+	return files
+}
+
+func (f *seededFile) stats() FileStats {
+	stats := f.torrent.Stats()
+	return FileStats{
+		Name:          f.name,
+		Path:          f.path,
+		MagnetURI:     f.magnetURI,
+		Peers:         stats.ActivePeers,
+		UploadedBytes: stats.BytesWrittenData.Int64(),
+	}
+}
+
+// Watch seeds the files of dir matching the filepath.Match pattern, such as
+// "*.wasm", and rescans it every interval until Close: new and modified files
+// are seeded, and removed ones aren't anymore. Files failing to be seeded,
+// for example while they're written, are tried again on the next rescan. It
+// returns the errors of the first scan.
+func (m *SeedManager) Watch(dir, pattern string, interval time.Duration) error {
+	if interval <= 0 {
+		return errors.New("rescan interval must be positive")
+	}
+	if _, err := filepath.Match(pattern, ""); err != nil {
+		return fmt.Errorf("invalid pattern: %w", err)
+	}
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return fmt.Errorf("resolving path: %w", err)
+	}
+
+	m.mu.Lock()
+	if m.isClosed() {
+		m.mu.Unlock()
+		return errors.New("seed manager is closed")
+	}
+	if m.watches[dir] {
+		m.mu.Unlock()
+		return fmt.Errorf("%s is already watched", dir)
+	}
+	m.watches[dir] = true
+	m.wg.Add(1)
+	m.mu.Unlock()
+
+	err = m.scan(dir, pattern)
+	go func() {
+		defer m.wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				_ = m.scan(dir, pattern)
+			case <-m.done:
+				return
+			}
+		}
+	}()
+	return err
+}
+
+// scan seeds the files of the watched dir matching the pattern, and stops
+// seeding the ones found before which don't exist anymore.
+func (m *SeedManager) scan(dir, pattern string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("reading watched dir: %w", err)
+	}
+	var errs []error
+	found := make(map[string]bool)
+	for _, entry := range entries {
+		if matched, _ := filepath.Match(pattern, entry.Name()); !matched || !entry.Type().IsRegular() {
+			continue
+		}
+		path := filepath.Join(dir, entry.Name())
+		found[path] = true
+		if _, err := m.add(path, dir); err != nil {
+			errs = append(errs, fmt.Errorf("seeding %s: %w", path, err))
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for path, f := range m.files {
+		if f.watchDir == dir && !found[path] {
+			if err := m.remove(path); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// quotaCheckInterval is how often the uploads are checked against the quota.
+const quotaCheckInterval = time.Second
+
+// enforceQuota pauses the uploads once the quota of the period is reached,
+// and resumes them when the next period starts, until Close.
+func (m *SeedManager) enforceQuota() {
+	ticker := time.NewTicker(min(quotaCheckInterval, m.quotaPeriod))
+	defer ticker.Stop()
+	periodStart := time.Now()
+	var used int64
+	for {
+		select {
+		case now := <-ticker.C:
+			m.mu.Lock()
+			if now.Sub(periodStart) >= m.quotaPeriod {
+				periodStart, used = now, 0
+				m.setPaused(false)
+			}
+			// the uploads since the last check count in the current period
+			for _, f := range m.files {
+				stats := f.torrent.Stats()
+				uploaded := stats.BytesWrittenData.Int64()
+				used += uploaded - f.uploaded
+				f.uploaded = uploaded
+			}
+			if used >= m.quota {
+				m.setPaused(true)
+			}
+			m.mu.Unlock()
+		case <-m.done:
+			return
+		}
+	}
+}
+
+// setPaused pauses or resumes the uploads of all the files, with mu held.
+func (m *SeedManager) setPaused(paused bool) {
+	if m.paused == paused {
+		return
+	}
+	m.paused = paused
+	for _, f := range m.files {
+		if paused {
+			f.torrent.DisallowDataUpload()
+		} else {
+			f.torrent.AllowDataUpload()
+		}
+	}
+}
+
+// UploadsPaused reports whether the uploads are paused because the quota of
+// the current period was reached.
+func (m *SeedManager) UploadsPaused() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.paused
+}
+
+func (m *SeedManager) isClosed() bool {
+	select {
+	case <-m.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// Close stops seeding all the files and shuts down the torrent client.
+func (m *SeedManager) Close() error {
+	m.mu.Lock()
+	if m.isClosed() {
+		m.mu.Unlock()
+		return nil
+	}
+	close(m.done)
+	m.mu.Unlock()
+	m.wg.Wait()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var errs []error
+	for path := range m.files {
+		if err := m.remove(path); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if closeErrs := m.client.Close(); len(closeErrs) > 0 {
+		errs = append(errs, fmt.Errorf("closing torrent client: %w", errors.Join(closeErrs...)))
+	}
+	if err := m.storage.Close(); err != nil {
+		errs = append(errs, fmt.Errorf("closing torrent storage: %w", err))
+	}
+	return errors.Join(errs...)
+}
+
+// newFileStorage returns a storage reading the files in place from dir,
+// keeping the piece completion in memory so nothing is written next to them.
+func newFileStorage(dir string) storage.ClientImplCloser {
+	return storage.NewFileOpts(storage.NewFileClientOpts{
+		ClientBaseDir:   dir,
+		PieceCompletion: storage.NewMapPieceCompletion(),
+		UsePartFiles:    generics.Some(false),
+	})
+}
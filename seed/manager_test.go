@@ -0,0 +1,214 @@
+package seed
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSeedManager(t *testing.T) {
+	content, err := os.ReadFile("testdata/shadowsocks_client.wasm")
+	require.NoError(t, err)
+	writeFile := func(t *testing.T, dir, name string, content []byte) string {
+		path := filepath.Join(dir, name)
+		require.NoError(t, os.WriteFile(path, content, 0o644))
+		return path
+	}
+	newManager := func(t *testing.T) *SeedManager {
+		m, err := NewSeedManager(nil, nil, WithListenPort(0))
+		require.NoError(t, err)
+		t.Cleanup(func() { m.Close() })
+		return m
+	}
+
+	t.Run("it should seed several files from one client", func(t *testing.T) {
+		m := newManager(t)
+		first := writeFile(t, t.TempDir(), "first.wasm", content)
+		second := writeFile(t, t.TempDir(), "second.wasm", []byte("second"))
+		firstMagnet, err := m.Add(first)
+		require.NoError(t, err)
+		secondMagnet, err := m.Add(second)
+		require.NoError(t, err)
+		assert.NotEqual(t, firstMagnet, secondMagnet)
+
+		peer := fmt.Sprintf("127.0.0.1:%d", m.client.LocalPort())
+		assert.Equal(t, content, download(t, firstMagnet, peer))
+		assert.Equal(t, []byte("second"), download(t, secondMagnet, peer))
+
+		stats, ok := m.Stats(first)
+		require.True(t, ok)
+		assert.Equal(t, first, stats.Path)
+		assert.Equal(t, "first.wasm", stats.Name)
+		assert.Equal(t, firstMagnet, stats.MagnetURI)
+		assert.Equal(t, int64(len(content)), stats.UploadedBytes)
+		assert.Len(t, m.Files(), 2)
+
+		require.NoError(t, m.Remove(first))
+		_, ok = m.Stats(first)
+		assert.False(t, ok)
+		assert.Len(t, m.Files(), 1)
+		assert.ErrorContains(t, m.Remove(first), "is not seeded")
+	})
+
+	t.Run("it should seed files again only when they changed", func(t *testing.T) {
+		m := newManager(t)
+		path := writeFile(t, t.TempDir(), "module.wasm", content)
+		magnet, err := m.Add(path)
+		require.NoError(t, err)
+		again, err := m.Add(path)
+		require.NoError(t, err)
+		assert.Equal(t, magnet, again)
+
+		writeFile(t, filepath.Dir(path), "module.wasm", []byte("changed"))
+		changed, err := m.Add(path)
+		require.NoError(t, err)
+		assert.NotEqual(t, magnet, changed)
+		assert.Len(t, m.Files(), 1)
+	})
+
+	t.Run("it should pause uploads once the quota is reached", func(t *testing.T) {
+		m, err := NewSeedManager(nil, nil, WithListenPort(0), WithUploadQuota(1, time.Hour))
+		require.NoError(t, err)
+		t.Cleanup(func() { m.Close() })
+		magnet, err := m.Add(writeFile(t, t.TempDir(), "module.wasm", content))
+		require.NoError(t, err)
+		assert.False(t, m.UploadsPaused())
+
+		assert.Equal(t, content, download(t, magnet, fmt.Sprintf("127.0.0.1:%d", m.client.LocalPort())))
+		assert.Eventually(t, m.UploadsPaused, 5*time.Second, 50*time.Millisecond)
+	})
+
+	t.Run("it should resume uploads in the next quota period", func(t *testing.T) {
+		m, err := NewSeedManager(nil, nil, WithListenPort(0), WithUploadQuota(1, 500*time.Millisecond))
+		require.NoError(t, err)
+		t.Cleanup(func() { m.Close() })
+		magnet, err := m.Add(writeFile(t, t.TempDir(), "module.wasm", content))
+		require.NoError(t, err)
+
+		assert.Equal(t, content, download(t, magnet, fmt.Sprintf("127.0.0.1:%d", m.client.LocalPort())))
+		assert.Eventually(t, m.UploadsPaused, 5*time.Second, 10*time.Millisecond)
+		assert.Eventually(t, func() bool { return !m.UploadsPaused() }, 5*time.Second, 10*time.Millisecond)
+	})
+
+	t.Run("it should reject invalid limits", func(t *testing.T) {
+		_, err := NewSeedManager(nil, nil, WithListenPort(0), WithUploadQuota(1024, 0))
+		assert.ErrorContains(t, err, "period must be positive")
+		_, err = NewSeedManager(nil, nil, WithListenPort(0), WithMaxPeers(-1))
+		assert.ErrorContains(t, err, "must not be negative")
+	})
+
+	t.Run("it should reject files with the same torrent", func(t *testing.T) {
+		m := newManager(t)
+		_, err := m.Add(writeFile(t, t.TempDir(), "module.wasm", content))
+		require.NoError(t, err)
+		_, err = m.Add(writeFile(t, t.TempDir(), "module.wasm", content))
+		assert.ErrorContains(t, err, "already seeded")
+	})
+
+	t.Run("it should keep up with a watched dir", func(t *testing.T) {
+		m := newManager(t)
+		dir := t.TempDir()
+		first := writeFile(t, dir, "first.wasm", content)
+		writeFile(t, dir, "notes.txt", []byte("notes"))
+		manual := writeFile(t, t.TempDir(), "manual.wasm", []byte("manual"))
+		_, err := m.Add(manual)
+		require.NoError(t, err)
+
+		require.NoError(t, m.Watch(dir, "*.wasm", 10*time.Millisecond))
+		assert.ErrorContains(t, m.Watch(dir, "*.wasm", time.Second), "already watched")
+		paths := func() []string {
+			var paths []string
+			for _, f := range m.Files() {
+				paths = append(paths, f.Path)
+			}
+			return paths
+		}
+		assert.ElementsMatch(t, []string{first, manual}, paths())
+
+		second := writeFile(t, dir, "second.wasm", []byte("second"))
+		require.NoError(t, os.Remove(first))
+		assert.Eventually(t, func() bool {
+			return assert.ObjectsAreEqual([]string{manual, second}, paths()) ||
+				assert.ObjectsAreEqual([]string{second, manual}, paths())
+		}, 5*time.Second, 10*time.Millisecond)
+	})
+
+	t.Run("it should not block the other files while verifying one", func(t *testing.T) {
+		m := newManager(t)
+		_, err := m.Add(writeFile(t, t.TempDir(), "module.wasm", content))
+		require.NoError(t, err)
+
+		// the reads of the verification block, after the ones of the hashing
+		r := &blockingReaderAt{
+			ReaderAt: bytes.NewReader(content),
+			after:    int64(len(content)),
+			reading:  make(chan struct{}),
+			release:  make(chan struct{}),
+		}
+		added := make(chan error, 1)
+		go func() {
+			_, err := m.addReaderAt("blocked.wasm", r, int64(len(content)))
+			added <- err
+		}()
+		<-r.reading
+		files := make(chan []FileStats, 1)
+		go func() { files <- m.Files() }()
+		select {
+		case f := <-files:
+			assert.Len(t, f, 1)
+		case <-time.After(5 * time.Second):
+			t.Fatal("files blocked by the file being verified")
+		}
+
+		close(r.release)
+		require.NoError(t, <-added)
+		f := m.Files()
+		require.Len(t, f, 2)
+		assert.Equal(t, "blocked.wasm", f[0].Name)
+		assert.Empty(t, f[0].Path)
+	})
+
+	t.Run("it should stop seeding on close", func(t *testing.T) {
+		m := newManager(t)
+		path := writeFile(t, t.TempDir(), "module.wasm", content)
+		require.NoError(t, m.Watch(filepath.Dir(path), "*.wasm", 10*time.Millisecond))
+		require.NoError(t, m.Close())
+		assert.Empty(t, m.Files())
+		assert.NoError(t, m.Close())
+		_, err := m.Add(path)
+		assert.ErrorContains(t, err, "closed")
+	})
+}
+
+// blockingReaderAt blocks its reads once after bytes were read, signaling
+// reading, until release is closed.
+type blockingReaderAt struct {
+	io.ReaderAt
+	after   int64
+	reading chan struct{}
+	release chan struct{}
+
+	mu   sync.Mutex
+	read int64
+	once sync.Once
+}
+
+func (r *blockingReaderAt) ReadAt(b []byte, off int64) (int, error) {
+	r.mu.Lock()
+	block := r.read >= r.after
+	r.read += int64(len(b))
+	r.mu.Unlock()
+	if block {
+		r.once.Do(func() { close(r.reading) })
+		<-r.release
+	}
+	return r.ReaderAt.ReadAt(b, off)
+}
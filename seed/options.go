@@ -0,0 +1,100 @@
+package seed
+
+import (
+	"net"
+	"time"
+
+	"github.com/anacrolix/generics"
+	"github.com/anacrolix/torrent"
+	"golang.org/x/time/rate"
+)
+
+// Option configures a Seeder or a SeedManager.
+type Option func(*options)
+
+type options struct {
+	webSeeds        []string
+	uploadRateLimit int
+	maxPeers        int
+	uploadQuota     int64
+	quotaPeriod     time.Duration
+	listenHost      string
+	listenPort      generics.Option[int]
+}
+
+// WithWebSeeds adds BEP 19 HTTP web seeds to the metainfo and magnet URI, so
+// downloaders can fetch the file over HTTP when there are no peers. A web
+// seed is either the URL of the file itself or, when ending with a slash, of
+// the directory holding it.
+func WithWebSeeds(urls ...string) Option {
+	return func(o *options) {
+		o.webSeeds = append(o.webSeeds, urls...)
+	}
+}
+
+// WithUploadRateLimit limits the upload bandwidth of the seeder in bytes per
+// second, shared by all the files of a SeedManager. It's unlimited by default.
+func WithUploadRateLimit(bytesPerSecond int) Option {
+	return func(o *options) {
+		o.uploadRateLimit = bytesPerSecond
+	}
+}
+
+// WithMaxPeers limits the number of peers connected for every seeded file.
+// It's the default of anacrolix/torrent otherwise.
+func WithMaxPeers(peers int) Option {
+	return func(o *options) {
+		o.maxPeers = peers
+	}
+}
+
+// WithUploadQuota limits the file data uploaded by the seeder to maxBytes in
+// every period, such as a day. Once reached, uploads are paused until the
+// next period starts. As the uploads are checked every second, the quota can
+// be exceeded by up to one second of uploads, which WithUploadRateLimit
+// bounds.
+func WithUploadQuota(maxBytes int64, period time.Duration) Option {
+	return func(o *options) {
+		o.uploadQuota = maxBytes
+		o.quotaPeriod = period
+	}
+}
+
+// WithListenHost sets the host or IP address of the interface accepting
+// peer connections, instead of all of them. An IPv4 address disables IPv6
+// and conversely.
+func WithListenHost(host string) Option {
+	return func(o *options) {
+		o.listenHost = host
+	}
+}
+
+// WithListenPort sets the port accepting peer connections, 0 picking a random
+// one. It's required for running several seeders at once, as they all use the
+// default port of anacrolix/torrent otherwise.
+func WithListenPort(port int) Option {
+	return func(o *options) {
+		o.listenPort = generics.Some(port)
+	}
+}
+
+// apply sets the options on the torrent client config.
+func (o options) apply(cfg *torrent.ClientConfig) {
+	cfg.ListenPort = o.listenPort.UnwrapOr(cfg.ListenPort)
+	if o.listenHost != "" {
+		host := o.listenHost
+		cfg.ListenHost = func(string) string { return host }
+		if ip := net.ParseIP(host); ip != nil {
+			cfg.DisableIPv6 = ip.To4() != nil
+			cfg.DisableIPv4 = ip.To4() == nil
+		}
+	}
+	if o.uploadRateLimit > 0 {
+		// the burst is set by the client
+		cfg.UploadRateLimiter = rate.NewLimiter(rate.Limit(o.uploadRateLimit), 0)
+	}
+	if o.maxPeers > 0 {
+		cfg.EstablishedConnsPerTorrent = o.maxPeers
+		cfg.HalfOpenConnsPerTorrent = min(cfg.HalfOpenConnsPerTorrent, o.maxPeers)
+	}
+}
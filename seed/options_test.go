@@ -0,0 +1,76 @@
+package seed
+
+import (
+	"testing"
+	"time"
+
+	"github.com/anacrolix/torrent"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/time/rate"
+)
+
+func TestOptionsApply(t *testing.T) {
+	var tests = []struct {
+		name   string
+		opts   []Option
+		assert func(t *testing.T, cfg *torrent.ClientConfig)
+	}{
+		{
+			name: "it should keep the client defaults without options",
+			assert: func(t *testing.T, cfg *torrent.ClientConfig) {
+				defaults := torrent.NewDefaultClientConfig()
+				assert.Equal(t, defaults.ListenPort, cfg.ListenPort)
+				assert.Equal(t, defaults.EstablishedConnsPerTorrent, cfg.EstablishedConnsPerTorrent)
+				assert.Equal(t, rate.Inf, cfg.UploadRateLimiter.Limit())
+				assert.False(t, cfg.DisableIPv6)
+			},
+		},
+		{
+			name: "it should set the listen port and IPv4 interface",
+			opts: []Option{WithListenPort(0), WithListenHost("127.0.0.1")},
+			assert: func(t *testing.T, cfg *torrent.ClientConfig) {
+				assert.Equal(t, 0, cfg.ListenPort)
+				assert.Equal(t, "127.0.0.1", cfg.ListenHost("tcp"))
+				assert.True(t, cfg.DisableIPv6)
+				assert.False(t, cfg.DisableIPv4)
+			},
+		},
+		{
+			name: "it should disable IPv4 with an IPv6 interface",
+			opts: []Option{WithListenHost("::1")},
+			assert: func(t *testing.T, cfg *torrent.ClientConfig) {
+				assert.Equal(t, "::1", cfg.ListenHost("tcp"))
+				assert.True(t, cfg.DisableIPv4)
+				assert.False(t, cfg.DisableIPv6)
+			},
+		},
+		{
+			name: "it should limit the upload rate and peers",
+			opts: []Option{WithUploadRateLimit(1024), WithMaxPeers(5)},
+			assert: func(t *testing.T, cfg *torrent.ClientConfig) {
+				assert.Equal(t, rate.Limit(1024), cfg.UploadRateLimiter.Limit())
+				assert.Equal(t, 5, cfg.EstablishedConnsPerTorrent)
+				assert.LessOrEqual(t, cfg.HalfOpenConnsPerTorrent, 5)
+			},
+		},
+		{
+			name: "it should keep the upload quota out of the client config",
+			opts: []Option{WithUploadQuota(1024, time.Hour)},
+			assert: func(t *testing.T, cfg *torrent.ClientConfig) {
+				assert.Equal(t, rate.Inf, cfg.UploadRateLimiter.Limit())
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var o options
+			for _, opt := range tt.opts {
+				opt(&o)
+			}
+			cfg := torrent.NewDefaultClientConfig()
+			o.apply(cfg)
+			tt.assert(t, cfg)
+		})
+	}
+}
@@ -0,0 +1,99 @@
+package seed
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/anacrolix/torrent/storage"
+)
+
+// errReadOnly is returned when the torrent client tries writing to a
+// readerStorage, which never happens as data download is disallowed.
+var errReadOnly = errors.New("seeded data is read-only")
+
+// readerStorage is a read-only anacrolix storage serving the data of a single
+// file torrent from an io.ReaderAt, keeping the piece completion in memory.
+type readerStorage struct {
+	r    io.ReaderAt
+	size int64
+
+	mu       sync.Mutex
+	complete map[int]bool
+}
+
+func newReaderStorage(r io.ReaderAt, size int64) *readerStorage {
+	return &readerStorage{r: r, size: size, complete: make(map[int]bool)}
+}
+
+// OpenTorrent for readerStorage checks the torrent is the size of the data.
+func (s *readerStorage) OpenTorrent(_ context.Context, info *metainfo.Info, _ metainfo.Hash) (storage.TorrentImpl, error) {
+	if info.TotalLength() != s.size {
+		return storage.TorrentImpl{}, fmt.Errorf("torrent length %d doesn't match the data size %d", info.TotalLength(), s.size)
+	}
+	return storage.TorrentImpl{
+		Piece: func(p metainfo.Piece) storage.PieceImpl {
+			return &readerPiece{storage: s, index: p.Index(), offset: p.Offset(), length: p.Length()}
+		},
+		Close: func() error { return nil },
+	}, nil
+}
+
+// Close for readerStorage does nothing, the io.ReaderAt is owned by the
+// caller.
+func (s *readerStorage) Close() error {
+	return nil
+}
+
+type readerPiece struct {
+	storage *readerStorage
+	index   int
+	offset  int64
+	length  int64
+}
+
+func (p *readerPiece) ReadAt(b []byte, off int64) (int, error) {
+	if off >= p.length {
+		return 0, io.EOF
+	}
+	if remaining := p.length - off; int64(len(b)) > remaining {
+		b = b[:remaining]
+	}
+	n, err := p.storage.r.ReadAt(b, p.offset+off)
+	if n == len(b) && errors.Is(err, io.EOF) {
+		// reading up to the end of the data isn't an error
+		err = nil
+	}
+	return n, err
+}
+
+func (p *readerPiece) WriteAt([]byte, int64) (int, error) {
+	return 0, errReadOnly
+}
+
+func (p *readerPiece) MarkComplete() error {
+	p.setComplete(true)
+	return nil
+}
+
+func (p *readerPiece) MarkNotComplete() error {
+	p.setComplete(false)
+	return nil
+}
+
+func (p *readerPiece) setComplete(complete bool) {
+	p.storage.mu.Lock()
+	defer p.storage.mu.Unlock()
+	p.storage.complete[p.index] = complete
+}
+
+// Completion for readerPiece is unknown until the piece was verified.
+func (p *readerPiece) Completion() storage.Completion {
+	p.storage.mu.Lock()
+	defer p.storage.mu.Unlock()
+	complete, ok := p.storage.complete[p.index]
+	return storage.Completion{Ok: ok, Complete: complete}
+}
@@ -0,0 +1,42 @@
+package seed
+
+import (
+	"context"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReaderStorage(t *testing.T) {
+	s := newReaderStorage(strings.NewReader("0123456789"), 10)
+	info := &metainfo.Info{Name: "module.wasm", Length: 10, PieceLength: 4, Pieces: make([]byte, 3*20)}
+
+	_, err := s.OpenTorrent(context.Background(), &metainfo.Info{Name: "module.wasm", Length: 11, PieceLength: 4}, metainfo.Hash{})
+	assert.ErrorContains(t, err, "doesn't match")
+
+	impl, err := s.OpenTorrent(context.Background(), info, metainfo.Hash{})
+	require.NoError(t, err)
+	last := impl.Piece(info.Piece(2))
+
+	b := make([]byte, 4)
+	n, err := last.ReadAt(b, 0)
+	require.NoError(t, err)
+	assert.Equal(t, "89", string(b[:n]))
+	_, err = last.ReadAt(b, 2)
+	assert.ErrorIs(t, err, io.EOF)
+	_, err = last.WriteAt(b, 0)
+	assert.ErrorIs(t, err, errReadOnly)
+
+	assert.False(t, last.Completion().Ok)
+	require.NoError(t, last.MarkComplete())
+	assert.Equal(t, true, impl.Piece(info.Piece(2)).Completion().Complete)
+	assert.False(t, impl.Piece(info.Piece(1)).Completion().Ok)
+	require.NoError(t, last.MarkNotComplete())
+	assert.Equal(t, false, last.Completion().Complete)
+	assert.True(t, last.Completion().Ok)
+	assert.NoError(t, impl.Close())
+}
@@ -1,15 +1,16 @@
 // Package seed provides a BitTorrent seeder for WASM files.
-// It builds a metainfo and magnet URI from a local file and seeds it to peers.
+// It builds a metainfo and magnet URI from a local file and seeds it to peers,
+// either one file with a Seeder or several with a SeedManager.
 package seed
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
+	"io"
 	"net/http"
-	"os"
-	"path/filepath"
+	"strings"
 
-	"github.com/anacrolix/torrent"
 	"github.com/anacrolix/torrent/bencode"
 	"github.com/anacrolix/torrent/metainfo"
 )
@@ -18,8 +19,7 @@ const defaultPieceLength = 256 * 1024 // 256 KiB
 
 // Seeder seeds a WASM file via BitTorrent.
 type Seeder struct {
-	client    *torrent.Client
-	dataDir   string
+	manager   *SeedManager
 	magnetURI string
 }
 
@@ -27,52 +27,39 @@ type Seeder struct {
 // returns the Seeder alongside the generated magnet URI.
 // It uses the default options from anacrolix/torrent config and make sure
 // it enables seed options based on the announce list and enable DHT
-func New(filePath string, announceList [][]string, httpClient *http.Client) (*Seeder, error) {
-	mi, err := buildMetainfo(filePath, announceList)
+func New(filePath string, announceList [][]string, httpClient *http.Client, opts ...Option) (*Seeder, error) {
+	manager, err := NewSeedManager(announceList, httpClient, opts...)
 	if err != nil {
-		return nil, fmt.Errorf("building metainfo: %w", err)
+		return nil, err
 	}
-
-	magnet, err := mi.MagnetV2()
+	magnetURI, err := manager.Add(filePath)
 	if err != nil {
-		return nil, fmt.Errorf("building magnet URI: %w", err)
+		return nil, errors.Join(err, manager.Close())
 	}
-	magnetURI := magnet.String()
+	return &Seeder{manager: manager, magnetURI: magnetURI}, nil
+}
 
-	cfg := torrent.NewDefaultClientConfig()
-	path, err := os.MkdirTemp(filepath.Dir(filePath), "lantern-water-torrent")
-	if err != nil {
-		return nil, fmt.Errorf("failed to create temp dir: %w", err)
-	}
-	cfg.DataDir = path
-	cfg.Seed = true
-	cfg.NoDHT = false
-	cfg.NoUpload = false
-	cfg.PeriodicallyAnnounceTorrentsToDht = true
-	cfg.AcceptPeerConnections = true
-	applyPlatformConfig(cfg)
-	if httpClient != nil {
-		cfg.WebTransport = httpClient.Transport
-	}
+// NewFromBytes creates a Seeder for the data, seeded as a file with the given
+// name, without writing anything to disk. The data must not be modified
+// while seeded.
+func NewFromBytes(name string, data []byte, announceList [][]string, httpClient *http.Client, opts ...Option) (*Seeder, error) {
+	return NewFromReaderAt(name, bytes.NewReader(data), int64(len(data)), announceList, httpClient, opts...)
+}
 
-	client, err := torrent.NewClient(cfg)
+// NewFromReaderAt creates a Seeder for the size bytes of r, seeded as a file
+// with the given name, without writing anything to disk. The torrent matches
+// the one of New for a file with the same name and content. r must stay
+// readable until the Seeder is closed.
+func NewFromReaderAt(name string, r io.ReaderAt, size int64, announceList [][]string, httpClient *http.Client, opts ...Option) (*Seeder, error) {
+	manager, err := NewSeedManager(announceList, httpClient, opts...)
 	if err != nil {
-		return nil, fmt.Errorf("creating torrent client: %w", err)
+		return nil, err
 	}
-
-	t, err := client.AddTorrent(mi)
+	magnetURI, err := manager.addReaderAt(name, r, size)
 	if err != nil {
-		if errs := client.Close(); errs != nil {
-			closeErr := errors.Join(errs...)
-			err = errors.Join(err, closeErr)
-		}
-		return nil, fmt.Errorf("adding torrent: %w", err)
+		return nil, errors.Join(err, manager.Close())
 	}
-
-	<-t.GotInfo()
-	t.DisallowDataDownload()
-
-	return &Seeder{client: client, dataDir: path, magnetURI: magnetURI}, nil
+	return &Seeder{manager: manager, magnetURI: magnetURI}, nil
 }
 
 // MagnetURI returns the magnet URI for the seeded file.
@@ -82,22 +69,45 @@ func (s *Seeder) MagnetURI() string {
 
 // Close stops seeding and shuts down the torrent client.
 func (s *Seeder) Close() error {
-	if errs := s.client.Close(); len(errs) > 0 {
-		return fmt.Errorf("closing torrent client: %w", errors.Join(errs...))
-	}
-
-	return os.RemoveAll(s.dataDir)
+	return s.manager.Close()
 }
 
 // buildMetainfo creates a MetaInfo for the file at filePath.
-func buildMetainfo(filePath string, announceList [][]string) (*metainfo.MetaInfo, error) {
+func buildMetainfo(filePath string, announceList [][]string, webSeeds []string) (*metainfo.MetaInfo, error) {
 	info := metainfo.Info{
 		PieceLength: defaultPieceLength,
 	}
 	if err := info.BuildFromFilePath(filePath); err != nil {
 		return nil, fmt.Errorf("building info from file path: %w", err)
 	}
+	return newMetainfo(info, announceList, webSeeds)
+}
+
+// buildReaderMetainfo creates a MetaInfo for a file with the given name and
+// the size bytes of r as content.
+func buildReaderMetainfo(name string, r io.ReaderAt, size int64, announceList [][]string, webSeeds []string) (*metainfo.MetaInfo, error) {
+	if name == "" || strings.ContainsAny(name, `/\`) {
+		return nil, fmt.Errorf("invalid file name %q", name)
+	}
+	if size < 0 {
+		return nil, fmt.Errorf("invalid size %d", size)
+	}
+	info := metainfo.Info{
+		Name:        name,
+		Length:      size,
+		PieceLength: defaultPieceLength,
+	}
+	err := info.GeneratePieces(func(metainfo.FileInfo) (io.ReadCloser, error) {
+		return io.NopCloser(io.NewSectionReader(r, 0, size)), nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("generating pieces: %w", err)
+	}
+	return newMetainfo(info, announceList, webSeeds)
+}
 
+// newMetainfo creates a MetaInfo for the info.
+func newMetainfo(info metainfo.Info, announceList [][]string, webSeeds []string) (*metainfo.MetaInfo, error) {
 	infoBytes, err := bencode.Marshal(info)
 	if err != nil {
 		return nil, fmt.Errorf("marshaling info: %w", err)
@@ -106,6 +116,7 @@ func buildMetainfo(filePath string, announceList [][]string) (*metainfo.MetaInfo
 	mi := &metainfo.MetaInfo{
 		InfoBytes:    infoBytes,
 		AnnounceList: metainfo.AnnounceList(announceList),
+		UrlList:      webSeeds,
 	}
 	mi.SetDefaults()
 
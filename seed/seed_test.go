@@ -1,9 +1,19 @@
 package seed
 
 import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
 	"net/http"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
+	"github.com/anacrolix/torrent"
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
 
@@ -15,3 +25,105 @@ func TestNewSeeder(t *testing.T) {
 	defer seed.Close()
 	t.Logf("Magnet URI: %s", seed.MagnetURI())
 }
+
+func TestNewSeederWithWebSeeds(t *testing.T) {
+	seed, err := New("testdata/shadowsocks_client.wasm", nil, http.DefaultClient, WithListenPort(0),
+		WithWebSeeds("https://example.com/wasm/", "https://mirror.example.com/shadowsocks_client.wasm"))
+	require.NoError(t, err)
+	defer seed.Close()
+
+	magnet, err := metainfo.ParseMagnetV2Uri(seed.MagnetURI())
+	require.NoError(t, err)
+	assert.Equal(t, []string{"https://example.com/wasm/", "https://mirror.example.com/shadowsocks_client.wasm"}, magnet.Params["ws"])
+
+	mi, err := buildMetainfo("testdata/shadowsocks_client.wasm", nil, []string{"https://example.com/wasm/"})
+	require.NoError(t, err)
+	assert.Equal(t, metainfo.UrlList{"https://example.com/wasm/"}, mi.UrlList)
+}
+
+func TestSeederServesData(t *testing.T) {
+	dir := t.TempDir()
+	content, err := os.ReadFile("testdata/shadowsocks_client.wasm")
+	require.NoError(t, err)
+	path := filepath.Join(dir, "shadowsocks_client.wasm")
+	require.NoError(t, os.WriteFile(path, content, 0o644))
+
+	seeder, err := New(path, nil, nil, WithListenPort(0), WithUploadRateLimit(64<<20))
+	require.NoError(t, err)
+	defer seeder.Close()
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Len(t, entries, 1, "nothing should be written next to the seeded file")
+
+	got := download(t, seeder.MagnetURI(), fmt.Sprintf("127.0.0.1:%d", seeder.manager.client.LocalPort()))
+	assert.Equal(t, content, got)
+}
+
+// download downloads the torrent of the magnet URI from the peer with a local
+// torrent client.
+func download(t *testing.T, magnetURI, peer string) []byte {
+	cfg := torrent.NewDefaultClientConfig()
+	cfg.DataDir = t.TempDir()
+	cfg.NoDHT = true
+	cfg.DisableIPv6 = true
+	cfg.ListenPort = 0
+	client, err := torrent.NewClient(cfg)
+	require.NoError(t, err)
+	defer client.Close()
+
+	magnet, err := metainfo.ParseMagnetV2Uri(magnetURI)
+	require.NoError(t, err)
+	tor, _, err := client.AddTorrentSpec(&torrent.TorrentSpec{
+		AddTorrentOpts: torrent.AddTorrentOpts{InfoHash: magnet.InfoHash.Unwrap()},
+		PeerAddrs:      []string{peer},
+	})
+	require.NoError(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	select {
+	case <-tor.GotInfo():
+	case <-ctx.Done():
+		t.Fatal("timed out waiting for the torrent metadata")
+	}
+	r := tor.NewReader()
+	r.SetContext(ctx)
+	defer r.Close()
+	got, err := io.ReadAll(r)
+	require.NoError(t, err)
+	return got
+}
+
+func TestNewSeederFromReaderAt(t *testing.T) {
+	content, err := os.ReadFile("testdata/shadowsocks_client.wasm")
+	require.NoError(t, err)
+	fromFile, err := New("testdata/shadowsocks_client.wasm", nil, nil, WithListenPort(0))
+	require.NoError(t, err)
+	defer fromFile.Close()
+
+	// nothing may be written to the temp dir
+	tempDir := t.TempDir()
+	t.Setenv("TMPDIR", tempDir)
+
+	seeder, err := NewFromBytes("shadowsocks_client.wasm", content, nil, nil, WithListenPort(0))
+	require.NoError(t, err)
+	defer seeder.Close()
+	assert.Equal(t, fromFile.MagnetURI(), seeder.MagnetURI())
+	got := download(t, seeder.MagnetURI(), fmt.Sprintf("127.0.0.1:%d", seeder.manager.client.LocalPort()))
+	assert.Equal(t, content, got)
+	stats := seeder.manager.Files()
+	require.Len(t, stats, 1)
+	assert.Equal(t, "shadowsocks_client.wasm", stats[0].Name)
+	assert.Empty(t, stats[0].Path)
+	assert.Equal(t, int64(len(content)), stats[0].UploadedBytes)
+
+	entries, err := os.ReadDir(tempDir)
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+
+	t.Run("it should reject invalid names and sizes", func(t *testing.T) {
+		_, err := NewFromReaderAt("dir/module.wasm", bytes.NewReader(content), int64(len(content)), nil, nil, WithListenPort(0))
+		assert.ErrorContains(t, err, "invalid file name")
+		_, err = NewFromReaderAt("module.wasm", bytes.NewReader(content), int64(len(content))+1, nil, nil, WithListenPort(0))
+		assert.ErrorContains(t, err, "generating pieces")
+	})
+}
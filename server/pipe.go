@@ -0,0 +1,108 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// Pipe copies data between a and b in both directions until both are done,
+// returning the number of bytes copied from a to b and from b to a.
+//
+// When one direction is done it half-closes the destination if it supports
+// CloseWrite, so the peer still can finish sending, otherwise it closes both
+// connections. If idleTimeout is positive both connections are closed when no
+// data flows in any direction for that long.
+//
+// WATER connections don't support CloseWrite, so they are closed as soon as
+// the other side is done, dropping the data the WASM module didn't send yet.
+// Half-close and data sent right before closing aren't preserved for them:
+// the protocols carried over WATER must delimit their messages, such as HTTP
+// with a Content-Length, and leave the closing to the WATER side.
+func Pipe(a, b net.Conn, idleTimeout time.Duration) (int64, int64, error) {
+	var once sync.Once
+	closeBoth := func() {
+		once.Do(func() {
+			a.Close()
+			b.Close()
+		})
+	}
+
+	activity := func() {}
+	if idleTimeout > 0 {
+		timer := time.AfterFunc(idleTimeout, closeBoth)
+		defer timer.Stop()
+		activity = func() { timer.Reset(idleTimeout) }
+	}
+
+	type result struct {
+		n   int64
+		err error
+	}
+	aToB := make(chan result, 1)
+	bToA := make(chan result, 1)
+	copyHalf := func(dst, src net.Conn, done chan<- result) {
+		n, err := io.Copy(dst, &activityReader{r: src, activity: activity})
+		if !closeWrite(dst) {
+			closeBoth()
+		}
+		done <- result{n: n, err: err}
+	}
+	go copyHalf(b, a, aToB)
+	go copyHalf(a, b, bToA)
+
+	var first, second result
+	var secondCh chan result
+	select {
+	case first = <-aToB:
+		secondCh = bToA
+	case first = <-bToA:
+		secondCh = aToB
+	}
+	if first.err != nil {
+		closeBoth()
+	}
+	second = <-secondCh
+
+	sent, received := first.n, second.n
+	if secondCh == aToB {
+		sent, received = second.n, first.n
+	}
+	if first.err != nil {
+		return sent, received, first.err
+	}
+	if second.err != nil && !errors.Is(second.err, net.ErrClosed) {
+		return sent, received, second.err
+	}
+	return sent, received, nil
+}
+
+type activityReader struct {
+	r        io.Reader
+	activity func()
+}
+
+func (r *activityReader) Read(b []byte) (int, error) {
+	n, err := r.r.Read(b)
+	if n > 0 {
+		r.activity()
+	}
+	return n, err
+}
+
+// closeWrite half-closes the connection and reports if it was supported.
+// Wrapped connections exposing NetConn are unwrapped.
+func closeWrite(conn net.Conn) bool {
+	for {
+		if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+			return cw.CloseWrite() == nil
+		}
+		wrapped, ok := conn.(interface{ NetConn() net.Conn })
+		if !ok {
+			return false
+		}
+		conn = wrapped.NetConn()
+	}
+}
@@ -0,0 +1,235 @@
+// Package server turns the connections accepted by a WATER listener into
+// something useful, forwarding them to a fixed upstream TCP address or
+// serving them with an http.Handler.
+package server
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/getlantern/golog"
+)
+
+const (
+	defaultDialTimeout       = 30 * time.Second
+	defaultReadHeaderTimeout = 30 * time.Second
+)
+
+// Params are used when creating a new Server. Exactly one of Upstream or
+// Handler must be set.
+type Params struct {
+	// An optional golog.Logger used for keeping compatibility with http-proxy
+	// and flashlight logger.
+	Logger golog.Logger
+	// Upstream is the TCP address every accepted connection is forwarded to,
+	// copying data with Pipe. See Pipe for the half-close limitation of
+	// WATER connections.
+	Upstream string
+	// Handler serves HTTP requests received through the accepted connections.
+	Handler http.Handler
+	// IdleTimeout closes connections after no data flows for this long. Zero
+	// means no timeout.
+	IdleTimeout time.Duration
+	// DialTimeout bounds the time for connecting to Upstream. Defaults to 30
+	// seconds.
+	DialTimeout time.Duration
+	// ReadHeaderTimeout bounds the time for reading the headers of the
+	// requests served by Handler. Defaults to 30 seconds.
+	ReadHeaderTimeout time.Duration
+}
+
+// Server serves the connections accepted by a listener, usually the one
+// returned by listener.NewWATERListener.
+type Server struct {
+	log         golog.Logger
+	upstream    string
+	idleTimeout time.Duration
+	dialTimeout time.Duration
+	httpServer  *http.Server
+
+	mu        sync.Mutex
+	listeners map[net.Listener]struct{}
+	conns     map[net.Conn]struct{}
+	closed    bool
+}
+
+// New creates a new Server.
+func New(params Params) (*Server, error) {
+	if (params.Upstream == "") == (params.Handler == nil) {
+		return nil, errors.New("server requires either an upstream address or an HTTP handler")
+	}
+
+	s := &Server{
+		log:         params.Logger,
+		upstream:    params.Upstream,
+		idleTimeout: params.IdleTimeout,
+		dialTimeout: params.DialTimeout,
+		listeners:   make(map[net.Listener]struct{}),
+		conns:       make(map[net.Conn]struct{}),
+	}
+	if s.log == nil {
+		s.log = golog.LoggerFor("lantern-water-server")
+	}
+	if s.dialTimeout <= 0 {
+		s.dialTimeout = defaultDialTimeout
+	}
+	if params.Handler != nil {
+		readHeaderTimeout := params.ReadHeaderTimeout
+		if readHeaderTimeout <= 0 {
+			readHeaderTimeout = defaultReadHeaderTimeout
+		}
+		s.httpServer = &http.Server{
+			Handler:           params.Handler,
+			IdleTimeout:       params.IdleTimeout,
+			ReadHeaderTimeout: readHeaderTimeout,
+			ErrorLog:          s.log.AsDebugLogger(),
+			ConnState:         s.logConnState,
+			ConnContext:       connContext,
+		}
+	}
+	return s, nil
+}
+
+// Serve accepts connections from the listener and serves them until the
+// listener fails or the server is closed.
+func (s *Server) Serve(ctx context.Context, l net.Listener) error {
+	if s.httpServer != nil {
+		return s.httpServer.Serve(&ctxListener{Listener: l, ctx: ctx})
+	}
+
+	if !s.trackListener(l, true) {
+		return net.ErrClosed
+	}
+	defer s.trackListener(l, false)
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go s.forward(ctx, conn)
+	}
+}
+
+// Close stops all listeners and closes active connections.
+func (s *Server) Close() error {
+	if s.httpServer != nil {
+		return s.httpServer.Close()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	var errs error
+	for l := range s.listeners {
+		errs = errors.Join(errs, l.Close())
+	}
+	for conn := range s.conns {
+		conn.Close()
+	}
+	return errs
+}
+
+func (s *Server) trackListener(l net.Listener, add bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !add {
+		delete(s.listeners, l)
+		return true
+	}
+	if s.closed {
+		return false
+	}
+	s.listeners[l] = struct{}{}
+	return true
+}
+
+func (s *Server) trackConn(conn net.Conn, add bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !add {
+		delete(s.conns, conn)
+		return true
+	}
+	if s.closed {
+		return false
+	}
+	s.conns[conn] = struct{}{}
+	return true
+}
+
+func (s *Server) forward(ctx context.Context, conn net.Conn) {
+	defer conn.Close()
+	if !s.trackConn(conn, true) {
+		return
+	}
+	defer s.trackConn(conn, false)
+
+	start := time.Now()
+	s.log.Debugf("accepted connection from %s", conn.RemoteAddr())
+
+	dialCtx, cancel := context.WithTimeout(ctx, s.dialTimeout)
+	upstream, err := new(net.Dialer).DialContext(dialCtx, "tcp", s.upstream)
+	cancel()
+	if err != nil {
+		s.log.Errorf("failed to connect %s to upstream %s: %v", conn.RemoteAddr(), s.upstream, err)
+		return
+	}
+	defer upstream.Close()
+
+	sent, received, err := Pipe(conn, upstream, s.idleTimeout)
+	if err != nil {
+		s.log.Debugf("failed to forward %s to %s: %v", conn.RemoteAddr(), s.upstream, err)
+	}
+	s.log.Debugf("closed connection from %s to %s after %s, sent %d bytes, received %d bytes",
+		conn.RemoteAddr(), s.upstream, time.Since(start), sent, received)
+}
+
+// ctxListener passes the context given to Serve to the requests of the
+// connections it accepts, as the http.Server is shared by the calls to Serve.
+type ctxListener struct {
+	net.Listener
+	ctx context.Context
+}
+
+func (l *ctxListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &ctxConn{Conn: conn, ctx: l.ctx}, nil
+}
+
+type ctxConn struct {
+	net.Conn
+	ctx context.Context
+}
+
+// NetConn returns the underlying connection.
+func (c *ctxConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// connContext returns the context of the requests of the connection, the one
+// given to Serve for its listener, with the values set by the http.Server.
+func connContext(ctx context.Context, conn net.Conn) context.Context {
+	c, ok := conn.(*ctxConn)
+	if !ok {
+		return ctx
+	}
+	connCtx := context.WithValue(c.ctx, http.ServerContextKey, ctx.Value(http.ServerContextKey))
+	return context.WithValue(connCtx, http.LocalAddrContextKey, ctx.Value(http.LocalAddrContextKey))
+}
+
+func (s *Server) logConnState(conn net.Conn, state http.ConnState) {
+	switch state {
+	case http.StateNew:
+		s.log.Debugf("accepted connection from %s", conn.RemoteAddr())
+	case http.StateClosed, http.StateHijacked:
+		s.log.Debugf("connection from %s %s", conn.RemoteAddr(), state)
+	}
+}
@@ -0,0 +1,273 @@
+package server
+
+import (
+	"context"
+	"embed"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/getlantern/golog"
+	"github.com/getlantern/lantern-water/dialer"
+	"github.com/getlantern/lantern-water/listener"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+//go:embed testdata/*
+var testData embed.FS
+
+// startUpstream runs a TCP server that reads everything until EOF and then
+// answers with what it received.
+func startUpstream(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				b, _ := io.ReadAll(conn)
+				io.WriteString(conn, "received "+string(b))
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+func TestServerForward(t *testing.T) {
+	ctx := context.Background()
+	upstream := startUpstream(t)
+
+	t.Run("it should forward with half-close", func(t *testing.T) {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		s, err := New(Params{Logger: golog.LoggerFor("water_server"), Upstream: upstream})
+		require.NoError(t, err)
+		defer s.Close()
+		go s.Serve(ctx, l)
+
+		conn, err := net.Dial("tcp", l.Addr().String())
+		require.NoError(t, err)
+		defer conn.Close()
+		_, err = io.WriteString(conn, "hello")
+		require.NoError(t, err)
+		require.NoError(t, conn.(*net.TCPConn).CloseWrite())
+
+		b, err := io.ReadAll(conn)
+		require.NoError(t, err)
+		assert.Equal(t, "received hello", string(b))
+	})
+
+	t.Run("it should close idle connections", func(t *testing.T) {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		s, err := New(Params{Upstream: upstream, IdleTimeout: 50 * time.Millisecond})
+		require.NoError(t, err)
+		defer s.Close()
+		go s.Serve(ctx, l)
+
+		conn, err := net.Dial("tcp", l.Addr().String())
+		require.NoError(t, err)
+		defer conn.Close()
+		require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+
+		_, err = io.ReadAll(conn)
+		assert.NoError(t, err, "connection should be closed by the server before the read deadline")
+	})
+
+	t.Run("it should close active connections on Close", func(t *testing.T) {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		s, err := New(Params{Upstream: upstream})
+		require.NoError(t, err)
+		served := make(chan error, 1)
+		go func() { served <- s.Serve(ctx, l) }()
+
+		conn, err := net.Dial("tcp", l.Addr().String())
+		require.NoError(t, err)
+		defer conn.Close()
+		require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+		_, err = io.WriteString(conn, "hello")
+		require.NoError(t, err)
+
+		require.Eventually(t, func() bool {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			return len(s.conns) == 1
+		}, time.Second, 10*time.Millisecond)
+		require.NoError(t, s.Close())
+		assert.Error(t, <-served)
+		_, err = io.ReadAll(conn)
+		var netErr net.Error
+		assert.False(t, errors.As(err, &netErr) && netErr.Timeout(), "connection should be closed by the server before the read deadline")
+	})
+}
+
+func TestServerForwardWATER(t *testing.T) {
+	ctx := context.Background()
+	wasm, err := testData.ReadFile("testdata/reverse_v1.wasm")
+	require.NoError(t, err)
+
+	// WATER connections can't be half-closed, so the upstream answers
+	// requests of known size and the client closes once answered
+	upstream, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer upstream.Close()
+	go func() {
+		for {
+			conn, err := upstream.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				b := make([]byte, len("hello"))
+				for {
+					if _, err := io.ReadFull(conn, b); err != nil {
+						return
+					}
+					io.WriteString(conn, "received "+string(b))
+				}
+			}()
+		}
+	}()
+
+	ll, err := listener.NewWATERListener(ctx, listener.ListenerParams{
+		Logger:    golog.LoggerFor("water_listener"),
+		Transport: "reverse_v1",
+		Address:   "127.0.0.1:0",
+		WASM:      wasm,
+	})
+	require.NoError(t, err)
+	s, err := New(Params{Logger: golog.LoggerFor("water_server"), Upstream: upstream.Addr().String()})
+	require.NoError(t, err)
+	defer s.Close()
+	go s.Serve(ctx, ll)
+
+	d, err := dialer.NewDialer(ctx, dialer.DialerParameters{
+		Logger:    golog.LoggerFor("water_dialer"),
+		Transport: "reverse_v1",
+		WASM:      wasm,
+	})
+	require.NoError(t, err)
+	conn, err := d.DialContext(ctx, "tcp", ll.Addr().String())
+	require.NoError(t, err)
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(10*time.Second)))
+
+	for _, msg := range []string{"hello", "world"} {
+		_, err = io.WriteString(conn, msg)
+		require.NoError(t, err)
+		b := make([]byte, len("received "+msg))
+		_, err = io.ReadFull(conn, b)
+		require.NoError(t, err)
+		assert.Equal(t, "received "+msg, string(b))
+	}
+
+	require.NoError(t, conn.Close())
+	assert.Eventually(t, func() bool {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return len(s.conns) == 0
+	}, 5*time.Second, 10*time.Millisecond, "the forwarded connection should be closed with the client")
+}
+
+func TestServerHandler(t *testing.T) {
+	ctx := context.Background()
+	f, err := testData.Open("testdata/reverse_v1.wasm")
+	require.NoError(t, err)
+	wasm, err := io.ReadAll(f)
+	require.NoError(t, err)
+
+	ll, err := listener.NewWATERListener(ctx, listener.ListenerParams{
+		Logger:    golog.LoggerFor("water_listener"),
+		Transport: "reverse_v1",
+		Address:   "127.0.0.1:0",
+		WASM:      wasm,
+	})
+	require.NoError(t, err)
+
+	s, err := New(Params{
+		Logger: golog.LoggerFor("water_server"),
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, "hello from "+r.URL.Path)
+		}),
+		IdleTimeout: time.Minute,
+	})
+	require.NoError(t, err)
+	defer s.Close()
+	go s.Serve(ctx, ll)
+
+	d, err := dialer.NewDialer(ctx, dialer.DialerParameters{
+		Logger:    golog.LoggerFor("water_dialer"),
+		Transport: "reverse_v1",
+		WASM:      wasm,
+	})
+	require.NoError(t, err)
+
+	cli := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return d.DialContext(ctx, network, addr)
+		},
+	}}
+	resp, err := cli.Get("http://" + ll.Addr().String() + "/water")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "hello from /water", string(b))
+}
+
+func TestServerHandlerContexts(t *testing.T) {
+	type key struct{}
+	s, err := New(Params{
+		Logger: golog.LoggerFor("water_server"),
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, r.Context().Value(key{}).(string))
+			assert.NotNil(t, r.Context().Value(http.LocalAddrContextKey))
+		}),
+	})
+	require.NoError(t, err)
+	defer s.Close()
+
+	// every listener is served with its own context, concurrently
+	var addrs []string
+	for _, name := range []string{"first", "second"} {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		go s.Serve(context.WithValue(context.Background(), key{}, name), l)
+		addrs = append(addrs, l.Addr().String())
+	}
+	for i, name := range []string{"first", "second"} {
+		resp, err := http.Get("http://" + addrs[i])
+		require.NoError(t, err)
+		b, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		require.NoError(t, err)
+		assert.Equal(t, name, string(b))
+	}
+}
+
+func TestNew(t *testing.T) {
+	_, err := New(Params{})
+	assert.Error(t, err)
+
+	_, err = New(Params{Upstream: "127.0.0.1:1", Handler: http.NotFoundHandler()})
+	assert.Error(t, err)
+
+	s, err := New(Params{Handler: http.NotFoundHandler(), IdleTimeout: time.Hour})
+	require.NoError(t, err)
+	assert.Equal(t, defaultReadHeaderTimeout, s.httpServer.ReadHeaderTimeout)
+	assert.Equal(t, time.Hour, s.httpServer.IdleTimeout)
+
+	s, err = New(Params{Handler: http.NotFoundHandler(), ReadHeaderTimeout: time.Second})
+	require.NoError(t, err)
+	assert.Equal(t, time.Second, s.httpServer.ReadHeaderTimeout)
+}
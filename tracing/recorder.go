@@ -0,0 +1,104 @@
+package tracing
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// RecordedSpan is a span collected by the Recorder.
+type RecordedSpan struct {
+	ID       uint64
+	ParentID uint64 // zero for root spans
+	Name     string
+	Attrs    []slog.Attr
+	Err      error
+	Start    time.Time
+	End      time.Time
+}
+
+// Attr returns the value of the attribute with the given key.
+func (s RecordedSpan) Attr(key string) (slog.Value, bool) {
+	for _, attr := range s.Attrs {
+		if attr.Key == key {
+			return attr.Value, true
+		}
+	}
+	return slog.Value{}, false
+}
+
+// Recorder is a Tracer collecting the ended spans in memory, useful in tests.
+type Recorder struct {
+	nextID atomic.Uint64
+
+	mu    sync.Mutex
+	spans []RecordedSpan
+}
+
+// NewRecorder creates an empty Recorder.
+func NewRecorder() *Recorder {
+	return new(Recorder)
+}
+
+type recorderKey struct{}
+
+// Start starts a span, child of the Recorder span carried by ctx if any.
+func (r *Recorder) Start(ctx context.Context, name string, attrs ...slog.Attr) (context.Context, Span) {
+	span := &recorderSpan{recorder: r, span: RecordedSpan{
+		ID:    r.nextID.Add(1),
+		Name:  name,
+		Attrs: attrs,
+		Start: time.Now(),
+	}}
+	if parent, ok := ctx.Value(recorderKey{}).(*recorderSpan); ok {
+		span.span.ParentID = parent.span.ID
+	}
+	return context.WithValue(ctx, recorderKey{}, span), span
+}
+
+// Spans returns the ended spans in the order they ended.
+func (r *Recorder) Spans() []RecordedSpan {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	spans := make([]RecordedSpan, len(r.spans))
+	copy(spans, r.spans)
+	return spans
+}
+
+// SpansNamed returns the ended spans with the given name.
+func (r *Recorder) SpansNamed(name string) []RecordedSpan {
+	var spans []RecordedSpan
+	for _, span := range r.Spans() {
+		if span.Name == name {
+			spans = append(spans, span)
+		}
+	}
+	return spans
+}
+
+type recorderSpan struct {
+	recorder *Recorder
+
+	mu   sync.Mutex
+	span RecordedSpan
+}
+
+func (s *recorderSpan) SetAttributes(attrs ...slog.Attr) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.span.Attrs = append(s.span.Attrs, attrs...)
+}
+
+func (s *recorderSpan) End(err error) {
+	s.mu.Lock()
+	s.span.Err = err
+	s.span.End = time.Now()
+	span := s.span
+	s.mu.Unlock()
+
+	s.recorder.mu.Lock()
+	defer s.recorder.mu.Unlock()
+	s.recorder.spans = append(s.recorder.spans, span)
+}
@@ -0,0 +1,77 @@
+// Package tracing defines optional hooks for tracing the phases of fetching a
+// WASM module and connecting with it. It doesn't depend on any tracing
+// library: implement Tracer for exporting the spans to OpenTelemetry or any
+// other system, or use the Recorder for collecting them in memory.
+package tracing
+
+import (
+	"context"
+	"log/slog"
+)
+
+// Names of the spans started by the lantern-water packages.
+const (
+	// SpanGetWASM covers version_control GetWASM, including the download
+	// when the module isn't cached.
+	SpanGetWASM = "water.get_wasm"
+	// SpanDownload covers every download attempt from a single source,
+	// including the hash verification. Retries are separate spans.
+	SpanDownload = "water.download"
+	// SpanTorrentInfo covers waiting for the torrent metadata of a magnet
+	// link.
+	SpanTorrentInfo = "water.torrent_info"
+	// SpanCompile covers the WASM module compilation in NewDialer.
+	SpanCompile = "water.compile"
+	// SpanDial covers every dial, including the WASM transport handshake.
+	SpanDial = "water.dial"
+)
+
+// Keys of the span attributes.
+const (
+	AttrTransport = "transport"
+	AttrURL       = "url"
+	AttrSource    = "source"
+	AttrAttempt   = "attempt"
+	AttrBytes     = "bytes"
+	AttrHashOK    = "hash_ok"
+	AttrCacheHit  = "cache_hit"
+	AttrAddress   = "address"
+	AttrConnID    = "conn_id"
+)
+
+// Tracer starts spans. Implementations must be safe for concurrent use.
+type Tracer interface {
+	// Start starts a span with the given name and attributes. The returned
+	// context carries the span, so spans started with it are its children.
+	Start(ctx context.Context, name string, attrs ...slog.Attr) (context.Context, Span)
+}
+
+// Span is a traced phase, which must be ended exactly once.
+type Span interface {
+	// SetAttributes adds attributes to the span.
+	SetAttributes(attrs ...slog.Attr)
+	// End ends the span, recording err if the phase failed.
+	End(err error)
+}
+
+// Nop is a Tracer whose spans do nothing.
+type Nop struct{}
+
+// Start returns ctx and a span doing nothing.
+func (Nop) Start(ctx context.Context, _ string, _ ...slog.Attr) (context.Context, Span) {
+	return ctx, nopSpan{}
+}
+
+type nopSpan struct{}
+
+func (nopSpan) SetAttributes(...slog.Attr) {}
+
+func (nopSpan) End(error) {}
+
+// OrNop returns t, or Nop if t is nil.
+func OrNop(t Tracer) Tracer {
+	if t == nil {
+		return Nop{}
+	}
+	return t
+}
@@ -0,0 +1,46 @@
+package tracing
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRecorder(t *testing.T) {
+	r := NewRecorder()
+	ctx, parent := r.Start(context.Background(), SpanGetWASM, slog.String(AttrTransport, "v1"))
+	_, child := r.Start(ctx, SpanDownload)
+	child.SetAttributes(slog.Int(AttrBytes, 10))
+	child.End(errors.New("failed"))
+	parent.End(nil)
+
+	spans := r.Spans()
+	require.Len(t, spans, 2)
+	assert.Equal(t, SpanDownload, spans[0].Name)
+	assert.Equal(t, spans[1].ID, spans[0].ParentID)
+	assert.Zero(t, spans[1].ParentID)
+	assert.EqualError(t, spans[0].Err, "failed")
+	assert.False(t, spans[0].End.Before(spans[0].Start))
+
+	bytes, ok := spans[0].Attr(AttrBytes)
+	require.True(t, ok)
+	assert.Equal(t, int64(10), bytes.Int64())
+	transport, ok := spans[1].Attr(AttrTransport)
+	require.True(t, ok)
+	assert.Equal(t, "v1", transport.String())
+
+	assert.Len(t, r.SpansNamed(SpanGetWASM), 1)
+	assert.Empty(t, r.SpansNamed(SpanDial))
+}
+
+func TestNop(t *testing.T) {
+	ctx := context.Background()
+	gotCtx, span := OrNop(nil).Start(ctx, SpanDial)
+	assert.Equal(t, ctx, gotCtx)
+	span.SetAttributes(slog.String(AttrAddress, "127.0.0.1:1"))
+	span.End(nil)
+}
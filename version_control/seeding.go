@@ -0,0 +1,221 @@
+package version_control
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/getlantern/lantern-water/seed"
+)
+
+// SeedingParams configure the seeding of the cached WASM files enabled with
+// WithSeeding.
+type SeedingParams struct {
+	// AnnounceList holds the tiers of trackers the files are announced to, in
+	// addition to the DHT. It's optional.
+	AnnounceList [][]string
+	// HTTPClient is an optional client whose transport is used for trackers.
+	HTTPClient *http.Client
+	// UploadRateLimit limits the upload bandwidth shared by all the seeded
+	// files in bytes per second. It's unlimited if 0.
+	UploadRateLimit int
+	// Duration limits how long a file is seeded after it was last downloaded
+	// or loaded from the cache. It's seeded until Close if 0.
+	Duration time.Duration
+}
+
+// WithSeeding makes the version control seed the verified WASM files of its
+// cache back to the swarm with the seed package, so the clients distribute
+// them too. A file is seeded once downloaded and verified, or loaded from the
+// cache after it was loaded correctly before. Its torrent matches the one of
+// a publisher seeding the same file named "<transport>.wasm" with the seed
+// package. All the files are seeded by one seed.SeedManager, so they share
+// its listening port, DHT node and upload rate limit. It's disabled by
+// default.
+func WithSeeding(params SeedingParams) Option {
+	return func(vc *waterVersionControl) {
+		vc.seeding = &params
+		vc.seeders = make(map[string]*seeding)
+	}
+}
+
+type seeding struct {
+	timer *time.Timer
+	// done is closed once the file was added to the seed manager, or failed
+	// to be
+	done chan struct{}
+	// added reports whether the file was added, set before done is closed
+	added bool
+}
+
+// startSeeding seeds the WASM file of the transport if seeding is enabled, or
+// extends the time it's seeded for. The file is added to the seed manager in
+// the background, as it's hashed and verified, so it doesn't delay GetWASM.
+// Seeding is best effort, so failures are only logged.
+func (vc *waterVersionControl) startSeeding(transport string) {
+	if vc.seeding == nil {
+		return
+	}
+	vc.seedersMu.Lock()
+	defer vc.seedersMu.Unlock()
+	if vc.closed {
+		return
+	}
+	if s, ok := vc.seeders[transport]; ok {
+		if s.timer != nil {
+			s.timer.Reset(vc.seeding.Duration)
+		}
+		return
+	}
+
+	s := &seeding{done: make(chan struct{})}
+	if vc.seeding.Duration > 0 {
+		s.timer = time.AfterFunc(vc.seeding.Duration, func() {
+			vc.stopSeeding(transport, s)
+		})
+	}
+	vc.seeders[transport] = s
+	go vc.seed(transport, s)
+}
+
+// seed adds the WASM file of the transport to the seed manager. If seeding
+// was stopped in the meantime, the file is removed again before done is
+// closed, so it's not seeded after the file is replaced.
+func (vc *waterVersionControl) seed(transport string, s *seeding) {
+	defer close(s.done)
+	m, err := vc.manager()
+	var magnet string
+	if err == nil {
+		magnet, err = m.Add(vc.seedPath(transport))
+	}
+
+	vc.seedersMu.Lock()
+	current := vc.seeders[transport] == s
+	if current && err != nil {
+		// it's tried again the next time the file is used
+		delete(vc.seeders, transport)
+	}
+	s.added = current && err == nil
+	vc.seedersMu.Unlock()
+
+	switch {
+	case err != nil:
+		if s.timer != nil {
+			s.timer.Stop()
+		}
+		vc.logger.Error("failed to seed wasm file", slog.String("transport", transport), slog.Any("err", err))
+	case !current:
+		if err = m.Remove(vc.seedPath(transport)); err != nil {
+			vc.logger.Error("failed to stop seeding wasm file", slog.String("transport", transport), slog.Any("err", err))
+		}
+	default:
+		vc.logger.Debug("seeding wasm file", slog.String("transport", transport), slog.String("magnet", magnet))
+	}
+}
+
+// manager returns the seed manager, creating it with the first seeded file
+// as it opens a listening port.
+func (vc *waterVersionControl) manager() (*seed.SeedManager, error) {
+	vc.seedManagerMu.Lock()
+	defer vc.seedManagerMu.Unlock()
+	if vc.seedManager != nil {
+		return vc.seedManager, nil
+	}
+	opts := []seed.Option{seed.WithListenPort(0)}
+	if vc.seeding.UploadRateLimit > 0 {
+		opts = append(opts, seed.WithUploadRateLimit(vc.seeding.UploadRateLimit))
+	}
+	m, err := seed.NewSeedManager(vc.seeding.AnnounceList, vc.seeding.HTTPClient, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create seed manager: %w", err)
+	}
+	vc.seedManager = m
+	return m, nil
+}
+
+// stopSeeding stops seeding the WASM file of the transport, if it's still
+// seeded by s when not nil. It's called before the file is replaced or
+// removed, and waits for the file to be added if it's still in progress.
+func (vc *waterVersionControl) stopSeeding(transport string, s *seeding) {
+	if vc.seeding == nil {
+		return
+	}
+	vc.seedersMu.Lock()
+	current, ok := vc.seeders[transport]
+	if !ok || (s != nil && current != s) {
+		vc.seedersMu.Unlock()
+		return
+	}
+	delete(vc.seeders, transport)
+	vc.seedersMu.Unlock()
+
+	if current.timer != nil {
+		current.timer.Stop()
+	}
+	<-current.done
+	if !current.added {
+		return
+	}
+	vc.seedManagerMu.Lock()
+	defer vc.seedManagerMu.Unlock()
+	if vc.seedManager == nil {
+		// closed in the meantime, which stopped seeding all the files
+		return
+	}
+	if err := vc.seedManager.Remove(vc.seedPath(transport)); err != nil {
+		vc.logger.Error("failed to stop seeding wasm file", slog.String("transport", transport), slog.Any("err", err))
+	}
+}
+
+// seedPath returns the path of the seeded WASM file of the transport.
+func (vc *waterVersionControl) seedPath(transport string) string {
+	return filepath.Join(vc.dir, transport+".wasm")
+}
+
+// seeded returns the transports whose WASM file is seeded.
+func (vc *waterVersionControl) seeded() []string {
+	vc.seedManagerMu.Lock()
+	defer vc.seedManagerMu.Unlock()
+	if vc.seedManager == nil {
+		return []string{}
+	}
+	files := vc.seedManager.Files()
+	transports := make([]string, 0, len(files))
+	for _, f := range files {
+		transports = append(transports, strings.TrimSuffix(filepath.Base(f.Path), ".wasm"))
+	}
+	return transports
+}
+
+// Close stops seeding the cached WASM files, waiting for the ones being added
+// to the seed manager. The version control can still be used afterwards, but
+// doesn't seed anymore.
+func (vc *waterVersionControl) Close() error {
+	vc.seedersMu.Lock()
+	vc.closed = true
+	seeders := vc.seeders
+	vc.seeders = make(map[string]*seeding)
+	vc.seedersMu.Unlock()
+
+	for _, s := range seeders {
+		if s.timer != nil {
+			s.timer.Stop()
+		}
+		<-s.done
+	}
+
+	vc.seedManagerMu.Lock()
+	defer vc.seedManagerMu.Unlock()
+	if vc.seedManager == nil {
+		return nil
+	}
+	err := vc.seedManager.Close()
+	vc.seedManager = nil
+	if err != nil {
+		return fmt.Errorf("failed to stop seeding: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,125 @@
+package version_control
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/getlantern/golog"
+	"github.com/getlantern/lantern-water/downloader"
+	"github.com/getlantern/lantern-water/logger"
+	"github.com/getlantern/lantern-water/seed"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	gomock "go.uber.org/mock/gomock"
+)
+
+func TestGetWASMSeeding(t *testing.T) {
+	content := []byte("test")
+	newDownloader := func(t *testing.T) downloader.WASMDownloader {
+		d := downloader.NewMockWASMDownloader(gomock.NewController(t))
+		d.EXPECT().DownloadWASM(gomock.Any(), gomock.Any()).DoAndReturn(func(ctx context.Context, w io.Writer) error {
+			_, err := w.Write(content)
+			return err
+		}).AnyTimes()
+		return d
+	}
+	newVersionControl := func(t *testing.T, params SeedingParams) *waterVersionControl {
+		vc := NewWaterVersionControl(t.TempDir(), slog.New(logger.NewLogHandler(golog.LoggerFor("version_control_test"), "test")), WithSeeding(params))
+		t.Cleanup(func() { vc.Close() })
+		return vc
+	}
+	getWASM := func(t *testing.T, vc *waterVersionControl, d downloader.WASMDownloader) {
+		r, err := vc.GetWASM(context.Background(), "test", d)
+		require.NoError(t, err)
+		r.Close()
+	}
+	// waitSeeding waits for the file of the transport to be added to the seed
+	// manager in the background.
+	waitSeeding := func(t *testing.T, vc *waterVersionControl, transport string) {
+		vc.seedersMu.Lock()
+		s, ok := vc.seeders[transport]
+		vc.seedersMu.Unlock()
+		require.True(t, ok)
+		<-s.done
+	}
+
+	t.Run("it should seed the downloaded file as the publisher does", func(t *testing.T) {
+		vc := newVersionControl(t, SeedingParams{UploadRateLimit: 1 << 20})
+		getWASM(t, vc, newDownloader(t))
+		waitSeeding(t, vc, "test")
+		require.Equal(t, []string{"test"}, vc.seeded())
+
+		// a publisher seeding the same file gets the same torrent
+		publisherDir := t.TempDir()
+		require.NoError(t, os.WriteFile(filepath.Join(publisherDir, "test.wasm"), content, 0o644))
+		publisher, err := seed.New(filepath.Join(publisherDir, "test.wasm"), nil, nil, seed.WithListenPort(0))
+		require.NoError(t, err)
+		defer publisher.Close()
+		stats, ok := vc.seedManager.Stats(filepath.Join(vc.dir, "test.wasm"))
+		require.True(t, ok)
+		assert.Equal(t, publisher.MagnetURI(), stats.MagnetURI)
+	})
+
+	t.Run("it should seed all the files with one manager", func(t *testing.T) {
+		vc := newVersionControl(t, SeedingParams{UploadRateLimit: 1 << 20})
+		d := newDownloader(t)
+		for _, transport := range []string{"first", "second"} {
+			r, err := vc.GetWASM(context.Background(), transport, d)
+			require.NoError(t, err)
+			r.Close()
+			waitSeeding(t, vc, transport)
+		}
+		files := vc.seedManager.Files()
+		require.Len(t, files, 2)
+		assert.Equal(t, filepath.Join(vc.dir, "first.wasm"), files[0].Path)
+		assert.Equal(t, filepath.Join(vc.dir, "second.wasm"), files[1].Path)
+	})
+
+	t.Run("it should seed the files loaded from the cache", func(t *testing.T) {
+		vc := newVersionControl(t, SeedingParams{})
+		d := newDownloader(t)
+		getWASM(t, vc, d)
+		require.NoError(t, vc.Close())
+		assert.Empty(t, vc.seeded())
+
+		vc = NewWaterVersionControl(vc.dir, vc.logger, WithSeeding(SeedingParams{}))
+		defer vc.Close()
+		getWASM(t, vc, d)
+		waitSeeding(t, vc, "test")
+		assert.Equal(t, []string{"test"}, vc.seeded())
+	})
+
+	t.Run("it should stop seeding after the duration", func(t *testing.T) {
+		vc := newVersionControl(t, SeedingParams{Duration: 200 * time.Millisecond})
+		getWASM(t, vc, newDownloader(t))
+		waitSeeding(t, vc, "test")
+		require.Equal(t, []string{"test"}, vc.seeded())
+		assert.Eventually(t, func() bool { return len(vc.seeded()) == 0 }, 5*time.Second, 10*time.Millisecond)
+	})
+
+	t.Run("it should stop seeding the file before downloading it again", func(t *testing.T) {
+		vc := newVersionControl(t, SeedingParams{})
+		d := newDownloader(t)
+		getWASM(t, vc, d)
+		first := vc.seeders["test"]
+		// the file can be replaced while it's still being added
+		require.NoError(t, os.Remove(filepath.Join(vc.dir, "test.last-loaded")))
+		getWASM(t, vc, d)
+		assert.NotSame(t, first, vc.seeders["test"])
+		waitSeeding(t, vc, "test")
+		_, ok := vc.seedManager.Stats(filepath.Join(vc.dir, "test.wasm"))
+		assert.True(t, ok)
+	})
+
+	t.Run("it should not seed without the option", func(t *testing.T) {
+		vc := NewWaterVersionControl(t.TempDir(), slog.New(logger.NewLogHandler(golog.LoggerFor("version_control_test"), "test")))
+		getWASM(t, vc, newDownloader(t))
+		assert.Empty(t, vc.seeded())
+		assert.NoError(t, vc.Close())
+	})
+}
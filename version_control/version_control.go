@@ -16,11 +16,36 @@ import (
 	"time"
 
 	"github.com/getlantern/lantern-water/downloader"
+	"github.com/getlantern/lantern-water/metrics"
+	"github.com/getlantern/lantern-water/seed"
+	"github.com/getlantern/lantern-water/tracing"
 )
 
 type waterVersionControl struct {
-	dir    string
-	logger *slog.Logger
+	dir      string
+	logger   *slog.Logger
+	metrics  metrics.Recorder
+	tracer   tracing.Tracer
+	progress downloader.ProgressFunc
+
+	seeding   *SeedingParams
+	seedersMu sync.Mutex
+	seeders   map[string]*seeding
+	closed    bool
+	// seedManagerMu guards seedManager, created by the first seeding
+	seedManagerMu sync.Mutex
+	seedManager   *seed.SeedManager
+}
+
+// Option configures optional features of the version control.
+type Option func(*waterVersionControl)
+
+// WithMetrics sets a recorder receiving the GetWASM duration, cache hits,
+// misses and evictions.
+func WithMetrics(recorder metrics.Recorder) Option {
+	return func(vc *waterVersionControl) {
+		vc.metrics = recorder
+	}
 }
 
 type wasmInfo struct {
@@ -28,13 +53,37 @@ type wasmInfo struct {
 	path           string
 }
 
+// WithTracer sets a tracer receiving a span for every GetWASM call. The
+// context of the span is given to the downloader, so its spans are children
+// of it.
+func WithTracer(tracer tracing.Tracer) Option {
+	return func(vc *waterVersionControl) {
+		vc.tracer = tracer
+	}
+}
+
+// WithProgress sets a function observing the progress of the downloads made
+// by GetWASM. It's forwarded to the downloader through the context, so it's
+// reported in addition to the one the downloader was created with.
+func WithProgress(fn downloader.ProgressFunc) Option {
+	return func(vc *waterVersionControl) {
+		vc.progress = fn
+	}
+}
+
 // NewWaterVersionControl creates a new instance of the version control system.
 // It requires a directory where the WASM files will be stored and a logger.
-func NewWaterVersionControl(dir string, logger *slog.Logger) *waterVersionControl {
-	return &waterVersionControl{
+func NewWaterVersionControl(dir string, logger *slog.Logger, opts ...Option) *waterVersionControl {
+	vc := &waterVersionControl{
 		dir:    dir,
 		logger: logger,
 	}
+	for _, opt := range opts {
+		opt(vc)
+	}
+	vc.metrics = metrics.OrNop(vc.metrics)
+	vc.tracer = tracing.OrNop(vc.tracer)
+	return vc
 }
 
 // GetWASM returns the WASM file for the given transport.
@@ -46,7 +95,19 @@ func NewWaterVersionControl(dir string, logger *slog.Logger) *waterVersionContro
 // 4. If it was not loaded correctly or the last-loaded file doesn't exist, download it again
 // 5. If it was loaded correctly, return the file and mark the file as loaded
 // 6. It deletes the WASM files that were not used for more than 7 days after successful loading
-func (vc *waterVersionControl) GetWASM(ctx context.Context, transport string, downloader downloader.WASMDownloader) (io.ReadCloser, error) {
+func (vc *waterVersionControl) GetWASM(ctx context.Context, transport string, downloader downloader.WASMDownloader) (rc io.ReadCloser, err error) {
+	start := time.Now()
+	ctx, span := vc.tracer.Start(ctx, tracing.SpanGetWASM, slog.String(tracing.AttrTransport, transport))
+	cacheHit := false
+	defer func() {
+		span.SetAttributes(slog.Bool(tracing.AttrCacheHit, cacheHit))
+		span.End(err)
+		metrics.ObserveSince(vc.metrics, metrics.GetWASMDuration, start, metrics.Labels{
+			metrics.LabelTransport: transport,
+			metrics.LabelResult:    metrics.Result(err),
+		})
+	}()
+
 	path := filepath.Join(vc.dir, transport+".wasm")
 	f, err := os.Open(path)
 	if err != nil && !os.IsNotExist(err) {
@@ -88,6 +149,9 @@ func (vc *waterVersionControl) GetWASM(ctx context.Context, transport string, do
 	if err = vc.markUsed(transport); err != nil {
 		return nil, fmt.Errorf("failed to update WASM history: %w", err)
 	}
+	vc.metrics.Add(metrics.CacheHits, 1, metrics.Labels{metrics.LabelTransport: transport})
+	cacheHit = true
+	vc.startSeeding(transport)
 	return f, nil
 }
 
@@ -147,10 +211,12 @@ func (vc *waterVersionControl) cleanOutdated() error {
 		go func() {
 			defer wg.Done()
 			transport := strings.TrimSuffix(filepath.Base(path), ".last-loaded")
+			vc.stopSeeding(transport, nil)
 			if err = os.Remove(filepath.Join(vc.dir, transport+".wasm")); err != nil {
 				vc.logger.Error("failed to remove wasm file", slog.String("file", transport+".wasm"), slog.Any("err", err))
 				return
 			}
+			vc.metrics.Add(metrics.CacheEvictions, 1, metrics.Labels{metrics.LabelTransport: transport})
 			if err = os.Remove(path); err != nil {
 				vc.logger.Error("failed to remove last-loaded file", slog.String("path", path), slog.Any("err", err))
 				return
@@ -161,14 +227,20 @@ func (vc *waterVersionControl) cleanOutdated() error {
 	return err
 }
 
-func (vc *waterVersionControl) downloadWASM(ctx context.Context, transport string, downloader downloader.WASMDownloader) (io.ReadCloser, error) {
+func (vc *waterVersionControl) downloadWASM(ctx context.Context, transport string, wasmDownloader downloader.WASMDownloader) (io.ReadCloser, error) {
+	vc.metrics.Add(metrics.CacheMisses, 1, metrics.Labels{metrics.LabelTransport: transport})
+	// the file is replaced, so the seeded one can't be served anymore
+	vc.stopSeeding(transport, nil)
 	outputPath := filepath.Join(vc.dir, transport+".wasm")
 	f, err := os.Create(outputPath)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create file %s: %w", transport, err)
 	}
 
-	if err = downloader.DownloadWASM(ctx, f); err != nil {
+	if vc.progress != nil {
+		ctx = downloader.ContextWithProgress(ctx, vc.progress)
+	}
+	if err = wasmDownloader.DownloadWASM(ctx, f); err != nil {
 		return nil, fmt.Errorf("failed to download wasm: %w", err)
 	}
 
@@ -179,6 +251,7 @@ func (vc *waterVersionControl) downloadWASM(ctx context.Context, transport strin
 	if err = vc.markUsed(transport); err != nil {
 		return nil, fmt.Errorf("failed to update WASM history: %w", err)
 	}
+	vc.startSeeding(transport)
 
 	return f, nil
 }
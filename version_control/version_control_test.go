@@ -2,8 +2,12 @@ package version_control
 
 import (
 	"context"
+	"crypto/sha256"
+	"fmt"
 	"io"
 	"log/slog"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
 	"strconv"
@@ -13,6 +17,8 @@ import (
 	"github.com/getlantern/golog"
 	"github.com/getlantern/lantern-water/downloader"
 	"github.com/getlantern/lantern-water/logger"
+	"github.com/getlantern/lantern-water/metrics"
+	"github.com/getlantern/lantern-water/tracing"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	gomock "go.uber.org/mock/gomock"
@@ -126,3 +132,115 @@ func TestNewWaterVersionControl(t *testing.T) {
 		})
 	}
 }
+
+func TestGetWASMMetrics(t *testing.T) {
+	dir, err := os.MkdirTemp("", "water")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	transport := "test"
+	labels := metrics.Labels{metrics.LabelTransport: transport}
+
+	// an outdated module that should be evicted
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "old-test.wasm"), []byte("test"), 0o644))
+	oldTime := strconv.FormatInt(time.Now().UTC().AddDate(0, 0, -8).Unix(), 10)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "old-test.last-loaded"), []byte(oldTime), 0o644))
+
+	d := downloader.NewMockWASMDownloader(gomock.NewController(t))
+	d.EXPECT().DownloadWASM(gomock.Any(), gomock.Any()).DoAndReturn(func(ctx context.Context, w io.Writer) error {
+		_, err := w.Write([]byte("test"))
+		return err
+	}).Times(1)
+
+	recorder := metrics.NewExpvarRecorder()
+	vc := NewWaterVersionControl(dir, slog.New(logger.NewLogHandler(golog.LoggerFor("version_control_test"), transport)), WithMetrics(recorder))
+	ctx := context.Background()
+
+	r, err := vc.GetWASM(ctx, transport, d)
+	require.NoError(t, err)
+	r.Close()
+	assert.Equal(t, float64(1), recorder.Value(metrics.CacheMisses, labels))
+	assert.Zero(t, recorder.Value(metrics.CacheHits, labels))
+	assert.Equal(t, float64(1), recorder.Value(metrics.CacheEvictions, metrics.Labels{metrics.LabelTransport: "old-test"}))
+
+	r, err = vc.GetWASM(ctx, transport, d)
+	require.NoError(t, err)
+	r.Close()
+	assert.Equal(t, float64(1), recorder.Value(metrics.CacheHits, labels))
+	assert.Equal(t, float64(2), recorder.Value(metrics.GetWASMDuration+"_count", metrics.Labels{
+		metrics.LabelTransport: transport,
+		metrics.LabelResult:    metrics.ResultSuccess,
+	}))
+}
+
+func TestGetWASMTracing(t *testing.T) {
+	content := []byte("test")
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(content)
+	}))
+	defer srv.Close()
+
+	dir, err := os.MkdirTemp("", "water")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	recorder := tracing.NewRecorder()
+	d, err := downloader.NewWASMDownloader(fmt.Sprintf("%x", sha256.Sum256(content)), []string{srv.URL}, srv.Client(), downloader.WithTracer(recorder))
+	require.NoError(t, err)
+	vc := NewWaterVersionControl(dir, slog.New(logger.NewLogHandler(golog.LoggerFor("version_control_test"), "test")), WithTracer(recorder))
+
+	r, err := vc.GetWASM(context.Background(), "test", d)
+	require.NoError(t, err)
+	r.Close()
+
+	getWASM := recorder.SpansNamed(tracing.SpanGetWASM)
+	require.Len(t, getWASM, 1)
+	cacheHit, _ := getWASM[0].Attr(tracing.AttrCacheHit)
+	assert.False(t, cacheHit.Bool())
+
+	downloads := recorder.SpansNamed(tracing.SpanDownload)
+	require.Len(t, downloads, 1)
+	assert.Equal(t, getWASM[0].ID, downloads[0].ParentID)
+	url, _ := downloads[0].Attr(tracing.AttrURL)
+	assert.Equal(t, srv.URL, url.String())
+	bytes, _ := downloads[0].Attr(tracing.AttrBytes)
+	assert.Equal(t, int64(len(content)), bytes.Int64())
+	hashOK, _ := downloads[0].Attr(tracing.AttrHashOK)
+	assert.True(t, hashOK.Bool())
+
+	r, err = vc.GetWASM(context.Background(), "test", d)
+	require.NoError(t, err)
+	r.Close()
+	getWASM = recorder.SpansNamed(tracing.SpanGetWASM)
+	require.Len(t, getWASM, 2)
+	cacheHit, _ = getWASM[1].Attr(tracing.AttrCacheHit)
+	assert.True(t, cacheHit.Bool())
+}
+
+func TestGetWASMProgress(t *testing.T) {
+	content := []byte("test")
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(content)
+	}))
+	defer srv.Close()
+
+	dir, err := os.MkdirTemp("", "water")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	d, err := downloader.NewWASMDownloader(fmt.Sprintf("%x", sha256.Sum256(content)), []string{srv.URL}, srv.Client())
+	require.NoError(t, err)
+	var reported []downloader.Progress
+	vc := NewWaterVersionControl(dir, slog.New(logger.NewLogHandler(golog.LoggerFor("version_control_test"), "test")), WithProgress(func(p downloader.Progress) {
+		reported = append(reported, p)
+	}))
+
+	r, err := vc.GetWASM(context.Background(), "test", d)
+	require.NoError(t, err)
+	r.Close()
+
+	require.NotEmpty(t, reported)
+	last := reported[len(reported)-1]
+	assert.Equal(t, srv.URL, last.Source)
+	assert.Equal(t, int64(len(content)), last.BytesReceived)
+	assert.Equal(t, int64(len(content)), last.TotalBytes)
+}